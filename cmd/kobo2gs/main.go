@@ -1,9 +1,12 @@
 package main
 
 import (
+	"flag"
+	"github.com/rostis232/kobo2googlesheet-db/config"
 	"github.com/rostis232/kobo2googlesheet-db/internal/pkg/app"
 	"github.com/sirupsen/logrus"
 	"os"
+	"strings"
 
 	"github.com/rostis232/kobo2googlesheet-db/internal/app/repository"
 	"github.com/spf13/viper"
@@ -28,19 +31,176 @@ func main() {
 		Password: viper.GetString("db.password"),
 		DBName:   viper.GetString("db.dbname"),
 	}
+	storage := repository.StorageConfig{
+		StateDir:     viper.GetString("app.state-dir"),
+		SnapshotDir:  viper.GetString("app.snapshot-dir"),
+		SnapshotKeep: viper.GetInt("app.snapshot-keep"),
+	}
+	if err := viper.UnmarshalKey("app.media", &storage.Media); err != nil {
+		logrus.Fatalf("Error while media config loading: %s\n", err)
+	}
+
+	config.SetRowsGuard(config.RowsGuardConfig{
+		MaxDropPercent: viper.GetFloat64("app.max-drop-percent"),
+		MaxDropRows:    viper.GetInt("app.max-drop-rows"),
+	})
+	config.SetBackup(viper.GetString("app.backup"), viper.GetInt("app.backup-tabs-keep"))
+	config.SetDiffWrites(viper.GetBool("app.diff-writes"), viper.GetFloat64("app.diff-write-max-ratio"))
+	config.SetColumnTypes(viper.GetStringMapString("app.column-types"))
+	config.SetSanitize(viper.GetString("app.sanitize"), viper.GetStringSlice("app.sanitize-numeric-columns"))
+	config.SetStreaming(viper.GetInt64("app.memory-limit-mb")<<20, viper.GetString("app.spool-dir"), viper.GetInt("app.write-chunk-rows"))
+
+	var rewrites []config.KoboRewrite
+	if err := viper.UnmarshalKey("app.kobo-rewrites", &rewrites); err != nil {
+		logrus.Fatalf("Error while kobo rewrites config loading: %s\n", err)
+	}
+	config.SetKobo(rewrites, viper.GetStringSlice("app.kobo-servers"))
+	config.SetAssetCacheTTL(viper.GetDuration("app.asset-cache-ttl"))
+	config.SetExports(viper.GetDuration("app.export-timeout"), viper.GetInt("app.export-keep"))
+
+	var jobs []config.JobConfig
+	if err := viper.UnmarshalKey("jobs", &jobs); err != nil {
+		logrus.Fatalf("Error while jobs config loading: %s\n", err)
+	}
+	config.SetJobs(jobs)
 
-	a, err := app.NewApp(dbconf)
+	a, err := app.NewApp(dbconf, storage)
 	if err != nil {
 		logrus.Fatalf("Error while creating new app: %s\n", err)
 	}
 	logrus.Info("Підключено до бази даних!")
+
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		runRestore(a, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "discover" {
+		runDiscover(a, os.Args[2:])
+		return
+	}
+
+	dryRun := flag.Bool("dry-run", false, "print what would change in the sheets without writing and exit")
+	id := flag.Int("id", 0, "form id (model_kobo_g_s.id) for -dry-run, all active forms if 0")
+	flag.Parse()
+
+	if *dryRun {
+		if err := a.DryRun(*id); err != nil {
+			logrus.Fatalf("Error while making dry run: %s\n", err)
+		}
+		return
+	}
+
+	listen := viper.GetString("app.listen")
+	if listen == "" {
+		// Назва ключа до появи discover
+		listen = viper.GetString("app.webhook-listen")
+	}
+	if listen != "" {
+		go func() {
+			if err := a.ServeAPI(listen, viper.GetString("app.webhook-path"), viper.GetString("app.assets-path")); err != nil {
+				logrus.Fatalf("Error while serving API: %s\n", err)
+			}
+		}()
+	}
+
 	if err := a.Run(viper.GetString("app.sleep-time"), viper.GetString("app.log-level")); err != nil {
 		logrus.Fatalf("Error while running app: %s\n", err)
 	}
 
 }
 
+// runRestore handles "restore -id N [-snapshot NAME] [-backup local|tab] [-list]".
+func runRestore(a *app.App, args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	id := fs.Int("id", 0, "form id (model_kobo_g_s.id)")
+	snapshot := fs.String("snapshot", "", "snapshot name, all snapshots of the latest run if empty")
+	backup := fs.String("backup", "local", "restore local snapshots or the latest hidden backup tabs: local or tab")
+	list := fs.Bool("list", false, "list snapshots of the form")
+	_ = fs.Parse(args)
+
+	if *id == 0 {
+		logrus.Fatal("restore: -id is required")
+	}
+
+	if *list {
+		if err := a.ListSnapshots(*id); err != nil {
+			logrus.Fatalf("Error while listing snapshots: %s\n", err)
+		}
+		return
+	}
+
+	if *backup != "local" && *backup != "tab" {
+		logrus.Fatal("restore: -backup must be local or tab")
+	}
+	if err := a.Restore(*id, *snapshot, *backup == "tab"); err != nil {
+		logrus.Fatalf("Error while restoring snapshot: %s\n", err)
+	}
+}
+
+// runDiscover handles "discover -token T [-server HOST] [-all]" and adds jobs with
+// "-add uid1,uid2 -user N -spreadsheet ID -sheet RANGE [-format csv|xls] [-options OPTS]".
+func runDiscover(a *app.App, args []string) {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	token := fs.String("token", "", "Kobo API token")
+	server := fs.String("server", "", "Kobo server, the first of app.kobo-servers if empty")
+	all := fs.Bool("all", false, "list surveys which are not deployed too")
+	add := fs.String("add", "", "comma separated asset uids to add jobs for")
+	format := fs.String("format", "csv", "export format of the jobs: csv or xls")
+	user := fs.Int("user", 0, "user id (model_users_api_g_s.userid) of the jobs, required with -add")
+	spreadsheet := fs.String("spreadsheet", "", "spreadsheet id of the jobs")
+	sheet := fs.String("sheet", "", "range of the jobs like 'Sheet1!A1:XYZ', {name} is replaced by the asset name")
+	options := fs.String("options", "", "job options added after the asset name, like '-labels'")
+	_ = fs.Parse(args)
+
+	if *token == "" {
+		logrus.Fatal("discover: -token is required")
+	}
+	var uids []string
+	for _, uid := range strings.Split(*add, ",") {
+		if uid = strings.TrimSpace(uid); uid != "" {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) > 0 && *user == 0 {
+		logrus.Fatal("discover: -user is required with -add")
+	}
+
+	err := a.Discover(app.DiscoverRequest{
+		Server:        *server,
+		Token:         *token,
+		All:           *all,
+		UIDs:          uids,
+		Format:        *format,
+		UserID:        *user,
+		SpreadSheetID: *spreadsheet,
+		SheetName:     *sheet,
+		Options:       *options,
+	})
+	if err != nil {
+		logrus.Fatalf("Error while discovering assets: %s\n", err)
+	}
+}
+
 func initConfig() error {
+	viper.SetDefault("app.state-dir", "state")
+	viper.SetDefault("app.snapshot-dir", "snapshots")
+	viper.SetDefault("app.snapshot-keep", 20)
+	viper.SetDefault("app.backup-tabs-keep", 3)
+	viper.SetDefault("app.max-drop-percent", 50)
+	viper.SetDefault("app.diff-writes", true)
+	viper.SetDefault("app.diff-write-max-ratio", 0.5)
+	viper.SetDefault("app.sanitize", "quote")
+	viper.SetDefault("app.memory-limit-mb", 64)
+	viper.SetDefault("app.write-chunk-rows", 5000)
+	viper.SetDefault("app.asset-cache-ttl", "1h")
+	viper.SetDefault("app.export-timeout", "15m")
+	viper.SetDefault("app.export-keep", 1)
+	viper.SetDefault("app.media.dir", "media")
+	viper.SetDefault("app.webhook-path", "/kobo/webhook")
+	viper.SetDefault("app.assets-path", "/kobo/assets")
+	viper.SetDefault("app.kobo-rewrites", []map[string]string{
+		{"from": "kobo.humanitarianresponse.info", "to": "eu.kobotoolbox.org"},
+	})
 	viper.AddConfigPath("config")
 	viper.SetConfigName("config")
 	return viper.ReadInConfig()
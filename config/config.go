@@ -1,9 +1,217 @@
 package config
 
-import "github.com/sirupsen/logrus"
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
 
 var LogLevel logrus.Level
 
 func SetLogLevel(level logrus.Level) {
 	LogLevel = level
 }
+
+// RowsGuard limits how much a sheet may shrink between two successful runs.
+// Zero value of a limit disables it.
+var RowsGuard RowsGuardConfig
+
+type RowsGuardConfig struct {
+	MaxDropPercent float64
+	MaxDropRows    int
+}
+
+func SetRowsGuard(guard RowsGuardConfig) {
+	RowsGuard = guard
+}
+
+// BackupMode is the default backup mode for jobs without " -backup=" flag:
+// "local", "tab" or empty to disable backups.
+var BackupMode string
+
+// BackupTabsKeep is how many hidden backup tabs are kept per sheet.
+var BackupTabsKeep int
+
+func SetBackup(mode string, tabsKeep int) {
+	BackupMode = mode
+	BackupTabsKeep = tabsKeep
+}
+
+// DiffWrites enables writing only changed row blocks instead of the whole range.
+// The whole range is written when the share of changed rows is over DiffWriteMaxRatio.
+var DiffWrites bool
+var DiffWriteMaxRatio float64
+
+func SetDiffWrites(enabled bool, maxRatio float64) {
+	DiffWrites = enabled
+	DiffWriteMaxRatio = maxRatio
+}
+
+// ColumnTypes are type hints by column title for jobs with " -column-types":
+// text, number, integer, date, datetime or boolean.
+var ColumnTypes map[string]string
+
+func SetColumnTypes(types map[string]string) {
+	ColumnTypes = types
+}
+
+// Sanitize is the policy for values starting with formula triggers (= + - @ tab CR):
+// "quote" prefixes them with an apostrophe, "strip" removes the triggers, "off" keeps them.
+var Sanitize string
+
+// SanitizeNumericColumns are columns where plain numbers like -5 are kept as is.
+var SanitizeNumericColumns []string
+
+func SetSanitize(policy string, numericColumns []string) {
+	Sanitize = policy
+	SanitizeNumericColumns = numericColumns
+}
+
+// JobConfig holds per-job settings that do not fit into the spreadsheet name.
+type JobConfig struct {
+	ID int `mapstructure:"id"`
+	// Include and Exclude select source sheets of an XLS export, all sheets if both are empty.
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+	// RemoveVanished deletes tabs created by the app when their source sheet is gone.
+	RemoveVanished bool        `mapstructure:"remove-vanished"`
+	Tabs           []TabConfig `mapstructure:"tabs"`
+	// ValidationWriteBack sends validation decisions from the sheet to Kobo.
+	ValidationWriteBack *ValidationWriteBack `mapstructure:"validation-write-back"`
+	// Webhook accepts submissions of the job from a Kobo REST Service.
+	Webhook *WebhookConfig `mapstructure:"webhook"`
+	// Export creates a Kobo export of the asset of the job link on every run
+	// instead of downloading the link.
+	Export *ExportTask `mapstructure:"export"`
+}
+
+// ExportTask holds parameters of an export created on demand, empty ones take Kobo defaults
+// the jobs expect: XML names, "/" group separator and fields of all form versions.
+type ExportTask struct {
+	// Type is "csv" or "xls".
+	Type string `mapstructure:"type"`
+	// Lang is a form language like "English (en)", "_xml" for names or "_default".
+	Lang              string `mapstructure:"lang"`
+	GroupSep          string `mapstructure:"group-sep"`
+	HierarchyInLabels bool   `mapstructure:"hierarchy-in-labels"`
+	// MultipleSelect is "both", "summary" or "details".
+	MultipleSelect string `mapstructure:"multiple-select"`
+	// Fields are xpaths of exported questions, all questions if empty.
+	Fields []string `mapstructure:"fields"`
+	// LatestVersion exports fields of the deployed form version only.
+	LatestVersion bool `mapstructure:"latest-version"`
+	// Timeout is how long the export is waited for, config.ExportTimeout if zero.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// WebhookConfig describes how submissions posted by a Kobo REST Service are handled.
+type WebhookConfig struct {
+	// Secret is the shared secret of the REST Service: the X-Webhook-Secret header,
+	// the basic auth password or the secret query parameter.
+	Secret string `mapstructure:"secret"`
+	// Mode is "run" to run the job right away or "append" to append the submission
+	// to the sheet. Jobs which cannot take an appended row are run.
+	Mode string `mapstructure:"mode"`
+}
+
+// ValidationWriteBack describes the sheet column reviewers put validation decisions in.
+// The column must be outside the written range, so imports do not overwrite it.
+type ValidationWriteBack struct {
+	// Column is the title of the column in the header row, the row with the _id column.
+	Column string `mapstructure:"column"`
+	// Tab is the tab with the column, the tab of the job if empty.
+	Tab string `mapstructure:"tab"`
+	// Values map sheet values to approved, not_approved or on_hold, case is ignored.
+	// Kobo labels like "On Hold" and status uids are understood without them.
+	Values map[string]string `mapstructure:"values"`
+}
+
+// TabConfig holds settings of one source sheet of an XLS export.
+type TabConfig struct {
+	// Sheet is the sheet name in the Kobo workbook.
+	Sheet string `mapstructure:"sheet"`
+	// Options replace job options (" -wot -idx filter='...'") for this sheet.
+	Options string `mapstructure:"options"`
+	// Range is where the sheet is written, like "A100:XYZ". A1 if empty.
+	Range string `mapstructure:"range"`
+	// Name is the target tab name, the sheet name if empty.
+	Name string `mapstructure:"name"`
+	// Index is the target tab position, starting from 0.
+	Index *int `mapstructure:"index"`
+	// Color is the tab colour like "#FF0000".
+	Color string `mapstructure:"color"`
+}
+
+var Jobs map[int]JobConfig
+
+func SetJobs(jobs []JobConfig) {
+	Jobs = make(map[int]JobConfig, len(jobs))
+	for _, job := range jobs {
+		Jobs[job.ID] = job
+	}
+}
+
+// GetTab returns settings of the source sheet of the job.
+func GetTab(id int, sheet string) (TabConfig, bool) {
+	for _, tab := range Jobs[id].Tabs {
+		if tab.Sheet == sheet {
+			return tab, true
+		}
+	}
+	return TabConfig{}, false
+}
+
+// MemoryLimit is how many bytes of export records are kept in memory,
+// records over it are spilled to a temp file in SpoolDir. Zero disables the limit.
+var MemoryLimit int64
+
+// SpoolDir is where records over MemoryLimit are spilled, the system temp dir if empty.
+var SpoolDir string
+
+// WriteChunkRows is how many rows are sent in one request when spilled records are written.
+var WriteChunkRows int
+
+func SetStreaming(memoryLimit int64, spoolDir string, chunkRows int) {
+	MemoryLimit = memoryLimit
+	SpoolDir = spoolDir
+	WriteChunkRows = chunkRows
+}
+
+// KoboRewrite replaces the host of Kobo links, like the old kobo.humanitarianresponse.info
+// with eu.kobotoolbox.org.
+type KoboRewrite struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+var KoboRewrites []KoboRewrite
+
+// KoboServers are hosts Kobo links may point to after rewriting, any host if empty.
+var KoboServers []string
+
+func SetKobo(rewrites []KoboRewrite, servers []string) {
+	KoboRewrites = rewrites
+	KoboServers = servers
+}
+
+// ExportTimeout is how long an export created on demand is waited for.
+var ExportTimeout time.Duration
+
+// ExportKeep is how many exports created on demand are kept in Kobo per form and
+// export parameters, at least one.
+var ExportKeep int
+
+func SetExports(timeout time.Duration, keep int) {
+	ExportTimeout = timeout
+	if keep < 1 {
+		keep = 1
+	}
+	ExportKeep = keep
+}
+
+// AssetCacheTTL is how long a fetched Kobo form schema is reused.
+var AssetCacheTTL time.Duration
+
+func SetAssetCacheTTL(ttl time.Duration) {
+	AssetCacheTTL = ttl
+}
@@ -4,6 +4,7 @@ go 1.20
 
 require (
 	github.com/go-sql-driver/mysql v1.6.0
+	github.com/sirupsen/logrus v1.9.4
 	github.com/spf13/viper v1.16.0
 	github.com/tealeg/xlsx/v3 v3.3.11
 	golang.org/x/oauth2 v0.7.0
@@ -22,7 +23,6 @@ require (
 	github.com/rogpeppe/fastuuid v1.2.0 // indirect
 	github.com/rogpeppe/go-internal v1.9.0 // indirect
 	github.com/shabbyrobe/xmlwriter v0.0.0-20200208144257-9fca06d00ffa // indirect
-	github.com/sirupsen/logrus v1.9.4 // indirect
 )
 
 require (
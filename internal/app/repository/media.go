@@ -0,0 +1,289 @@
+package repository
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+const (
+	MediaLocal = "local"
+	MediaS3    = "s3"
+	MediaDrive = "drive"
+)
+
+// MediaConfig selects where attachment files are stored. Media is off when Backend is empty.
+type MediaConfig struct {
+	Backend string `mapstructure:"backend"`
+	// Dir and PublicURL are for the local backend: files are written to Dir
+	// and linked as PublicURL/key, so Dir must be served by a web server.
+	Dir       string `mapstructure:"dir"`
+	PublicURL string `mapstructure:"public-url"`
+	// S3 is any S3-compatible storage, MinIO for a local setup.
+	// Links are PublicURL/key if it is set, Endpoint/Bucket/key otherwise.
+	S3 S3Config `mapstructure:"s3"`
+	// DriveCredentials is a service account JSON file, DriveFolder the folder shared with it.
+	DriveCredentials string `mapstructure:"drive-credentials"`
+	DriveFolder      string `mapstructure:"drive-folder"`
+}
+
+type S3Config struct {
+	Endpoint  string `mapstructure:"endpoint"`
+	Region    string `mapstructure:"region"`
+	Bucket    string `mapstructure:"bucket"`
+	AccessKey string `mapstructure:"access-key"`
+	SecretKey string `mapstructure:"secret-key"`
+}
+
+// NewMedia returns the configured backend, nil if media is off.
+func NewMedia(cfg MediaConfig) (Media, error) {
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case MediaLocal:
+		return NewLocalMedia(cfg.Dir, cfg.PublicURL)
+	case MediaS3:
+		return NewS3Media(cfg.S3, cfg.PublicURL)
+	case MediaDrive:
+		return NewDriveMedia(cfg.DriveCredentials, cfg.DriveFolder)
+	default:
+		return nil, fmt.Errorf("unknown media backend %q", cfg.Backend)
+	}
+}
+
+// LocalMedia keeps files in a directory served by a web server.
+type LocalMedia struct {
+	dir       string
+	publicURL string
+}
+
+func NewLocalMedia(dir string, publicURL string) (*LocalMedia, error) {
+	if publicURL == "" {
+		return nil, fmt.Errorf("public-url is required for local media")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error while creating media dir: %w", err)
+	}
+	return &LocalMedia{
+		dir:       dir,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+	}, nil
+}
+
+func (m *LocalMedia) SaveMedia(key string, contentType string, content io.Reader) (string, error) {
+	name := filepath.Join(m.dir, filepath.FromSlash(key))
+	if rel, err := filepath.Rel(m.dir, name); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("media key %q is outside the media dir", key)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return "", err
+	}
+
+	tmp := name + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return "", err
+	}
+	return joinURL(m.publicURL, key), nil
+}
+
+// S3Media puts files to a bucket with path-style requests signed by AWS Signature V4.
+type S3Media struct {
+	cfg       S3Config
+	publicURL string
+	client    *http.Client
+}
+
+func NewS3Media(cfg S3Config, publicURL string) (*S3Media, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("endpoint and bucket are required for s3 media")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	if publicURL == "" {
+		publicURL = cfg.Endpoint + "/" + cfg.Bucket
+	}
+	return &S3Media{
+		cfg:       cfg,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (m *S3Media) SaveMedia(key string, contentType string, content io.Reader) (string, error) {
+	// S3 потребує довжину і хеш тіла: пишемо вкладення у тимчасовий файл,
+	// рахуючи хеш, і надсилаємо з нього, щоб не тримати файл у пам'яті
+	file, err := os.CreateTemp("", "kobo-media-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), content)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequest(http.MethodPut, joinURL(m.cfg.Endpoint+"/"+m.cfg.Bucket, key), io.NopCloser(file))
+	if err != nil {
+		return "", err
+	}
+	request.ContentLength = size
+	if size == 0 {
+		request.Body = http.NoBody
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	signS3(request, hex.EncodeToString(hash.Sum(nil)), m.cfg, time.Now().UTC())
+
+	response, err := m.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return "", fmt.Errorf("unexpected status: %s %s", response.Status, message)
+	}
+	return joinURL(m.publicURL, key), nil
+}
+
+// signS3 adds AWS Signature V4 headers to the request with the hex SHA-256 of its body.
+func signS3(request *http.Request, payloadHash string, cfg S3Config, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	request.Header.Set("X-Amz-Date", amzDate)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + request.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if contentType := request.Header.Get("Content-Type"); contentType != "" {
+		signedHeaders = "content-type;" + signedHeaders
+		canonicalHeaders = "content-type:" + contentType + "\n" + canonicalHeaders
+	}
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretKey), date)
+	key = hmacSHA256(key, cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// DriveMedia uploads files to a Drive folder and shares them by link.
+type DriveMedia struct {
+	srv    *drive.Service
+	folder string
+}
+
+func NewDriveMedia(credentials string, folder string) (*DriveMedia, error) {
+	if credentials == "" || folder == "" {
+		return nil, fmt.Errorf("drive-credentials and drive-folder are required for drive media")
+	}
+	credBytes, err := os.ReadFile(credentials)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading drive credentials: %w", err)
+	}
+	ctx := context.Background()
+	config, err := google.JWTConfigFromJSON(credBytes, drive.DriveFileScope)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := drive.NewService(ctx, option.WithHTTPClient(config.Client(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	return &DriveMedia{
+		srv:    srv,
+		folder: folder,
+	}, nil
+}
+
+func (m *DriveMedia) SaveMedia(key string, contentType string, content io.Reader) (string, error) {
+	file := &drive.File{
+		// Drive не має шляхів, ключ лишається в назві файлу
+		Name:     strings.ReplaceAll(key, "/", "_"),
+		Parents:  []string{m.folder},
+		MimeType: contentType,
+	}
+	created, err := m.srv.Files.Create(file).Media(content, googleapi.ContentType(contentType)).SupportsAllDrives(true).Fields("id").Do()
+	if err != nil {
+		return "", err
+	}
+	_, err = m.srv.Permissions.Create(created.Id, &drive.Permission{Type: "anyone", Role: "reader"}).SupportsAllDrives(true).Do()
+	if err != nil {
+		return "", fmt.Errorf("error while sharing drive file: %w", err)
+	}
+	return "https://drive.google.com/uc?export=view&id=" + created.Id, nil
+}
+
+// joinURL appends the slash separated key to the base URL, escaping every part of the key.
+func joinURL(base string, key string) string {
+	parts := strings.Split(path.Clean("/" + key)[1:], "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return base + "/" + strings.Join(parts, "/")
+}
@@ -2,20 +2,60 @@ package repository
 
 import (
 	"database/sql"
+	"io"
+	"time"
+
 	"github.com/rostis232/kobo2googlesheet-db/internal/models"
 )
 
 type Database interface {
 	GetAllData() ([]models.Data, error)
+	GetDataByID(id int) (models.Data, error)
 	WriteInfo(id int, info string) error
+	AddData(data models.Data) (int, error)
+	GetIDsByLink(link string) ([]int, error)
+	UserExists(userID int) (bool, error)
+}
+
+type State interface {
+	GetJobState(id int) (models.JobState, error)
+	SaveJobState(id int, state models.JobState) error
+	GetExportState() (models.ExportState, error)
+	SaveExportState(state models.ExportState) error
+}
+
+type Snapshots interface {
+	SaveSnapshot(id int, taken time.Time, sheetRange string, records [][]string) (string, error)
+	ListSnapshots(id int) ([]string, error)
+	LoadSnapshot(id int, name string) (string, [][]string, error)
+}
+
+// Media stores attachment files by key like "asset/submission/file.jpg" and returns links to them.
+type Media interface {
+	SaveMedia(key string, contentType string, content io.Reader) (string, error)
+}
+
+// StorageConfig describes local directories used by the app and the media backend.
+type StorageConfig struct {
+	StateDir     string
+	SnapshotDir  string
+	SnapshotKeep int
+	Media        MediaConfig
 }
 
 type Repository struct {
 	Database
+	State
+	Snapshots
+	// Media is nil when no media backend is configured.
+	Media Media
 }
 
-func NewRepository(db *sql.DB) *Repository {
+func NewRepository(db *sql.DB, state State, snapshots Snapshots, media Media) *Repository {
 	return &Repository{
-		Database: NewRequests(db),
+		Database:  NewRequests(db),
+		State:     state,
+		Snapshots: snapshots,
+		Media:     media,
 	}
 }
@@ -46,6 +46,25 @@ func (r *Requests) GetAllData() ([]models.Data, error) {
 	return results, nil
 }
 
+func (r *Requests) GetDataByID(id int) (models.Data, error) {
+	result := models.Data{}
+	query := "SELECT k.id, k.userid, k.status, k.kobologin, k.kobolink, k.koboname, k.gslink, k.gsname, k.sheetname, g.ccode, k.lastresult FROM model_kobo_g_s k LEFT JOIN model_users_api_g_s g ON k.userid = g.userid WHERE k.id = ?"
+	err := r.db.QueryRow(query, id).Scan(
+		&result.Id,
+		&result.UserId,
+		&result.Status,
+		&result.KoboToken,
+		&result.CSVLink,
+		&result.FormName,
+		&result.SpreadSheetID,
+		&result.SpreadSheetName,
+		&result.SheetName,
+		&result.APIKey,
+		&result.LastResult,
+	)
+	return result, err
+}
+
 func (r *Requests) WriteInfo(id int, info string) error {
 	if len(info) > 254 {
 		info = string([]rune(info)[:254])
@@ -54,3 +73,39 @@ func (r *Requests) WriteInfo(id int, info string) error {
 	_, err := r.db.Exec(query, info, id)
 	return err
 }
+
+// AddData inserts a job and returns its id.
+func (r *Requests) AddData(data models.Data) (int, error) {
+	query := "INSERT INTO model_kobo_g_s (userid, status, kobologin, kobolink, koboname, gslink, gsname, sheetname) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	res, err := r.db.Exec(query, data.UserId, data.Status, data.KoboToken, data.CSVLink, data.FormName, data.SpreadSheetID, data.SpreadSheetName, data.SheetName)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// GetIDsByLink returns ids of jobs with the Kobo link, active or not.
+func (r *Requests) GetIDsByLink(link string) ([]int, error) {
+	var ids []int
+	rows, err := r.db.Query("SELECT id FROM model_kobo_g_s WHERE kobolink = ?", link)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// UserExists reports whether the user has Google credentials, jobs of other users cannot run.
+func (r *Requests) UserExists(userID int) (bool, error) {
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM model_users_api_g_s WHERE userid = ? AND ccode IS NOT NULL", userID).Scan(&count)
+	return count > 0, err
+}
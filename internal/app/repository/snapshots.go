@@ -0,0 +1,150 @@
+package repository
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotTime is the time format in snapshot names, with microseconds so runs
+// in the same second do not overwrite each other.
+const snapshotTime = "20060102-150405.000000"
+
+// FileSnapshots keeps gzipped CSV copies of sheet ranges, one directory per job.
+// The original A1 range is stored in the gzip header comment. keep is the number of runs.
+type FileSnapshots struct {
+	dir  string
+	keep int
+}
+
+func NewFileSnapshots(dir string, keep int) (*FileSnapshots, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error while creating snapshots dir: %w", err)
+	}
+	return &FileSnapshots{
+		dir:  dir,
+		keep: keep,
+	}, nil
+}
+
+func (s *FileSnapshots) jobDir(id int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("job-%d", id))
+}
+
+// SaveSnapshot saves the range, snapshots of one run share the taken time in their names.
+func (s *FileSnapshots) SaveSnapshot(id int, taken time.Time, sheetRange string, records [][]string) (string, error) {
+	if err := os.MkdirAll(s.jobDir(id), 0o755); err != nil {
+		return "", err
+	}
+
+	tab, _, _ := strings.Cut(sheetRange, "!")
+	name := fmt.Sprintf("%s_%s.csv.gz", taken.Format(snapshotTime), url.PathEscape(strings.Trim(tab, "'")))
+
+	file, err := os.Create(filepath.Join(s.jobDir(id), name))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	zw := gzip.NewWriter(file)
+	zw.Comment = sheetRange
+	w := csv.NewWriter(zw)
+	if err := w.WriteAll(records); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	if err := s.prune(id); err != nil {
+		return name, fmt.Errorf("error while deleting old snapshots: %w", err)
+	}
+
+	return name, nil
+}
+
+// ListSnapshots returns snapshot names of the job, oldest first.
+func (s *FileSnapshots) ListSnapshots(id int) ([]string, error) {
+	entries, err := os.ReadDir(s.jobDir(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".csv.gz") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LoadSnapshot returns the range the snapshot was taken from and its records.
+func (s *FileSnapshots) LoadSnapshot(id int, name string) (string, [][]string, error) {
+	file, err := os.Open(filepath.Join(s.jobDir(id), filepath.Base(name)))
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer zr.Close()
+
+	r := csv.NewReader(zr)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return zr.Comment, records, nil
+}
+
+// prune deletes snapshots of the oldest runs over keep, all snapshots of a run go together.
+func (s *FileSnapshots) prune(id int) error {
+	if s.keep <= 0 {
+		return nil
+	}
+	names, err := s.ListSnapshots(id)
+	if err != nil {
+		return err
+	}
+	var runs []string
+	for _, name := range names {
+		if run := snapshotRun(name); len(runs) == 0 || runs[len(runs)-1] != run {
+			runs = append(runs, run)
+		}
+	}
+	if len(runs) <= s.keep {
+		return nil
+	}
+	last := runs[len(runs)-s.keep-1]
+	for _, name := range names {
+		if snapshotRun(name) > last {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.jobDir(id), name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotRun returns the run time from the snapshot name "20060102-150405.000000_tab.csv.gz".
+func snapshotRun(name string) string {
+	run, _, _ := strings.Cut(name, "_")
+	return run
+}
@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+// FileState stores job states as JSON files, one file per job.
+type FileState struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewFileState(dir string) (*FileState, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error while creating state dir: %w", err)
+	}
+	return &FileState{
+		dir: dir,
+	}, nil
+}
+
+func (s *FileState) path(id int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("job-%d.json", id))
+}
+
+func (s *FileState) GetJobState(id int) (models.JobState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := models.JobState{Tabs: make(map[string]models.TabState)}
+	content, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return state, err
+	}
+	if state.Tabs == nil {
+		state.Tabs = make(map[string]models.TabState)
+	}
+	return state, nil
+}
+
+func (s *FileState) SaveJobState(id int, state models.JobState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Запис через тимчасовий файл, щоб не залишити пошкоджений стан
+	tmp := s.path(id) + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(id))
+}
+
+func (s *FileState) exportsPath() string {
+	return filepath.Join(s.dir, "exports.json")
+}
+
+func (s *FileState) GetExportState() (models.ExportState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := models.ExportState{Exports: make(map[string][]string)}
+	content, err := os.ReadFile(s.exportsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return state, err
+	}
+	if state.Exports == nil {
+		state.Exports = make(map[string][]string)
+	}
+	return state, nil
+}
+
+func (s *FileState) SaveExportState(state models.ExportState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.exportsPath() + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.exportsPath())
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/sheets/v4"
+)
+
+const (
+	backupLocal = "local"
+	backupTab   = "tab"
+	backupOff   = "off"
+)
+
+// backupTabTime is the time format in names of backup tabs, with microseconds so runs
+// in the same second do not collide. Names of older backup tabs have whole seconds.
+const backupTabTime = "2006-01-02 15:04:05.000000"
+
+var backupOption = regexp.MustCompile(` -backup=([^ ]+)`)
+
+// getBackupMode returns backup mode from " -backup=local|tab|off" or the default from config.
+func getBackupMode(gsName string) string {
+	matches := backupOption.FindStringSubmatch(gsName)
+	if len(matches) < 2 {
+		return config.BackupMode
+	}
+	return matches[1]
+}
+
+// backup saves current content of the range before it is overwritten.
+// run is the start of the import, backups of one run share it.
+func (e *ExpImp) backup(ctx context.Context, srv *sheets.Service, id int, run time.Time, spreadSheetName string, spreadsheetId string, sheetRange string) error {
+	switch mode := getBackupMode(spreadSheetName); mode {
+	case backupLocal:
+		current, err := readSnapshot(ctx, srv, spreadsheetId, sheetRange)
+		if err != nil {
+			return err
+		}
+		if len(current) == 0 {
+			return nil
+		}
+		name, err := e.snapshots.SaveSnapshot(id, run, sheetRange, current)
+		if err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{"form_id": id, "snapshot": name}).Info("Snapshot saved")
+	case backupTab:
+		return backupToTab(ctx, srv, spreadsheetId, getTabName(sheetRange), run)
+	case "", backupOff:
+	default:
+		logrus.WithFields(logrus.Fields{"form_id": id, "backup": mode}).Warn("Unknown backup mode")
+	}
+	return nil
+}
+
+// readSnapshot reads the range as USER_ENTERED input: formulas are kept, and text
+// starting with a formula trigger is quoted, so the snapshot is restored without sanitising.
+func readSnapshot(ctx context.Context, srv *sheets.Service, spreadsheetId string, sheetRange string) ([][]string, error) {
+	formulas, err := readRawValues(ctx, srv, spreadsheetId, sheetRange, "FORMULA")
+	if err != nil {
+		return nil, err
+	}
+	values, err := readRawValues(ctx, srv, spreadsheetId, sheetRange, "UNFORMATTED_VALUE")
+	if err != nil {
+		return nil, err
+	}
+	return quoteText(formulas, values), nil
+}
+
+// quoteText prefixes cells with "'" where the value is text with a formula trigger.
+// Text is told from formulas by the value, the result of a formula differs from it,
+// and numbers are not strings in UNFORMATTED_VALUE.
+func quoteText(formulas [][]interface{}, values [][]interface{}) [][]string {
+	result := interfaceSliceToStringSlice(formulas)
+	for r, row := range result {
+		for i, cell := range row {
+			if cell == "" || !strings.ContainsRune(formulaTriggers, rune(cell[0])) || r >= len(values) || i >= len(values[r]) {
+				continue
+			}
+			if text, ok := values[r][i].(string); ok && text == cell {
+				row[i] = "'" + cell
+			}
+		}
+	}
+	return result
+}
+
+// backupToTab duplicates the tab into a hidden "<tab> backup <time>" tab
+// and deletes the oldest backup tabs over config.BackupTabsKeep.
+func backupToTab(ctx context.Context, srv *sheets.Service, spreadsheetId string, tab string, run time.Time) error {
+	spreadSheet, err := srv.Spreadsheets.Get(spreadsheetId).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	prefix := tab + " backup "
+	var source *sheets.SheetProperties
+	var backups []*sheets.SheetProperties
+	for _, s := range spreadSheet.Sheets {
+		switch {
+		case s.Properties.Title == tab:
+			source = s.Properties
+		case strings.HasPrefix(s.Properties.Title, prefix):
+			backups = append(backups, s.Properties)
+		}
+	}
+	if source == nil {
+		return nil
+	}
+
+	// Id нової вкладки призначає Sheets, його беремо з відповіді
+	requests := []*sheets.Request{
+		{
+			DuplicateSheet: &sheets.DuplicateSheetRequest{
+				SourceSheetId:    source.SheetId,
+				InsertSheetIndex: int64(len(spreadSheet.Sheets)),
+				NewSheetName:     prefix + run.Format(backupTabTime),
+				ForceSendFields:  []string{"SourceSheetId"},
+			},
+		},
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Title < backups[j].Title
+	})
+	for config.BackupTabsKeep > 0 && len(backups)+1 > config.BackupTabsKeep {
+		requests = append(requests, &sheets.Request{
+			DeleteSheet: &sheets.DeleteSheetRequest{
+				SheetId:         backups[0].SheetId,
+				ForceSendFields: []string{"SheetId"},
+			},
+		})
+		backups = backups[1:]
+	}
+
+	response, err := srv.Spreadsheets.BatchUpdate(spreadsheetId, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: requests,
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to duplicate sheet %s: %w", tab, err)
+	}
+	if len(response.Replies) == 0 || response.Replies[0].DuplicateSheet == nil || response.Replies[0].DuplicateSheet.Properties == nil {
+		return fmt.Errorf("no reply to duplicating sheet %s", tab)
+	}
+
+	_, err = srv.Spreadsheets.BatchUpdate(spreadsheetId, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: []*sheets.Request{
+			{
+				UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+					Properties: &sheets.SheetProperties{
+						SheetId:         response.Replies[0].DuplicateSheet.Properties.SheetId,
+						Hidden:          true,
+						ForceSendFields: []string{"SheetId"},
+					},
+					Fields: "hidden",
+				},
+			},
+		},
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to hide backup of sheet %s: %w", tab, err)
+	}
+	return nil
+}
+
+// Restore clears the range and writes records of a snapshot back as they were read,
+// snapshots are already USER_ENTERED input and are not sanitised again.
+func (e *ExpImp) Restore(credentials string, spreadsheetId string, sheetRange string, records [][]string) error {
+	ctx := context.Background()
+
+	srv, err := e.getService(credentials)
+	if err != nil {
+		return err
+	}
+
+	_, err = srv.Spreadsheets.Values.Clear(spreadsheetId, sheetRange, &sheets.ClearValuesRequest{}).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	return e.writeFull(ctx, srv, spreadsheetId, sheetRange, records, writeOptions{sanitize: sanitizeOff})
+}
+
+// RestoreTabs writes the latest backup tabs of the tabs back, all tabs backed up in that run
+// are restored. It returns names of the restored backup tabs.
+func (e *ExpImp) RestoreTabs(credentials string, spreadsheetId string, tabs []string) ([]string, error) {
+	ctx := context.Background()
+
+	srv, err := e.getService(credentials)
+	if err != nil {
+		return nil, err
+	}
+	spreadSheet, err := srv.Spreadsheets.Get(spreadsheetId).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	titles := make([]string, 0, len(spreadSheet.Sheets))
+	for _, s := range spreadSheet.Sheets {
+		titles = append(titles, s.Properties.Title)
+	}
+
+	backups := latestBackupTabs(titles, tabs)
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no backup tabs of %s", strings.Join(tabs, ", "))
+	}
+	var restored []string
+	for _, tab := range tabs {
+		backup, ok := backups[tab]
+		if !ok {
+			continue
+		}
+		records, err := readSnapshot(ctx, srv, spreadsheetId, quoteTab(backup))
+		if err != nil {
+			return restored, fmt.Errorf("error while reading %s: %w", backup, err)
+		}
+		if err := e.Restore(credentials, spreadsheetId, quoteTab(tab), records); err != nil {
+			return restored, fmt.Errorf("error while restoring %s: %w", tab, err)
+		}
+		restored = append(restored, backup)
+	}
+	return restored, nil
+}
+
+// latestBackupTabs returns backup tabs of the latest run by tab, a tab without
+// a backup in that run is not in the result.
+func latestBackupTabs(titles []string, tabs []string) map[string]string {
+	var latest string
+	found := make(map[string]map[string]string)
+	for _, title := range titles {
+		for _, tab := range tabs {
+			taken, ok := strings.CutPrefix(title, tab+" backup ")
+			if !ok {
+				continue
+			}
+			// Розбір без дробової частини приймає і старі назви, і нові з мікросекундами
+			if _, err := time.Parse("2006-01-02 15:04:05", taken); err != nil {
+				continue
+			}
+			if found[taken] == nil {
+				found[taken] = make(map[string]string)
+			}
+			found[taken][tab] = title
+			if taken > latest {
+				latest = taken
+			}
+		}
+	}
+	return found[latest]
+}
+
+// interfaceSliceToStringSlice converts values read from Sheets to strings. Numbers are
+// written in full, fmt.Sprint would turn large IDs and amounts into 1.23456789e+08.
+func interfaceSliceToStringSlice(values [][]interface{}) [][]string {
+	result := make([][]string, 0, len(values))
+	for _, row := range values {
+		stringRow := make([]string, 0, len(row))
+		for _, item := range row {
+			stringRow = append(stringRow, valueString(item))
+		}
+		result = append(result, stringRow)
+	}
+	return result
+}
+
+// valueString formats a value read from Sheets as it is entered again.
+func valueString(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	}
+	return fmt.Sprint(value)
+}
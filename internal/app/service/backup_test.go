@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+)
+
+func TestGetBackupMode(t *testing.T) {
+	config.SetBackup("local", 3)
+	defer config.SetBackup("", 0)
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "task -wot", want: "local"},
+		{input: "task -backup=tab -idx", want: "tab"},
+		{input: "task -backup=off", want: "off"},
+	}
+
+	for _, tt := range tests {
+		if got := getBackupMode(tt.input); got != tt.want {
+			t.Errorf("getBackupMode(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestInterfaceSliceToStringSlice(t *testing.T) {
+	got := interfaceSliceToStringSlice([][]interface{}{{"a", 1.5, true}, {}})
+
+	if len(got) != 2 || len(got[0]) != 3 || len(got[1]) != 0 {
+		t.Fatalf("unexpected shape: %v", got)
+	}
+	if got[0][1] != "1.5" || got[0][2] != "true" {
+		t.Errorf("unexpected values: %v", got[0])
+	}
+}
+
+func TestQuoteText(t *testing.T) {
+	formulas := [][]interface{}{{"name", "=SUM(B3:B4)", -5.0, "-5", "=x"}, {"-a", `=IMAGE("https://x/1.jpg")`}}
+	values := [][]interface{}{{"name", 7.0, -5.0, "-5", "=x"}, {"-a", ""}}
+
+	got := quoteText(formulas, values)
+	want := [][]string{{"name", "=SUM(B3:B4)", "-5", "'-5", "'=x"}, {"'-a", `=IMAGE("https://x/1.jpg")`}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("quoteText() = %q, want %q", got, want)
+	}
+}
+
+func TestLatestBackupTabs(t *testing.T) {
+	titles := []string{
+		"main", "kids",
+		"main backup 2024-05-01 10:00:00", "kids backup 2024-05-01 10:00:00",
+		"main backup 2024-05-02 09:30:00",
+		"main backup 2024-05-02 09:30:00.250000", "kids backup 2024-05-02 09:30:00.250000",
+		"main backup 2024-05-02 09:30:00.125000",
+		"other backup 2024-05-03 08:00:00", "kids backup notes",
+	}
+
+	// Запуски в одну секунду розрізняються мікросекундами
+	got := latestBackupTabs(titles, []string{"main", "kids"})
+	want := map[string]string{"main": "main backup 2024-05-02 09:30:00.250000", "kids": "kids backup 2024-05-02 09:30:00.250000"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("latestBackupTabs() = %v, want %v", got, want)
+	}
+	if got := latestBackupTabs(titles, []string{"new"}); len(got) != 0 {
+		t.Errorf("latestBackupTabs() without backups = %v", got)
+	}
+}
+
+func TestRestoreRoundTrip(t *testing.T) {
+	rows := [][]string{{"id", "amount", "phone"}, {"123456789012", "1234.5", "380501234567"}, {"7", "0.25", "n/a"}}
+	fake, srv := newFakeSheets(t, []string{"kobo"}, map[string][][]string{"kobo": rows})
+	e := newTestExpImp(t, srv)
+
+	snapshot, err := readSnapshot(context.Background(), srv, "sheet", "kobo!A1:XYZ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"id", "amount", "phone"}, {"123456789012", "1234.5", "380501234567"}, {"7", "0.25", "n/a"}}
+	if !reflect.DeepEqual(snapshot, want) {
+		t.Errorf("snapshot = %q, want %q", snapshot, want)
+	}
+
+	if err := e.Restore(testCredentials, "sheet", "kobo!A1:XYZ", snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if got := trimRows(fake.tabs["kobo"]); !reflect.DeepEqual(got, rows) {
+		t.Errorf("restored = %q, want %q", got, rows)
+	}
+}
+
+func TestBackupToTab(t *testing.T) {
+	config.SetBackup("tab", 2)
+	defer config.SetBackup("", 0)
+
+	fake, srv := newFakeSheets(t, []string{"kobo", "kobo backup 2024-05-01 10:00:00", "kobo backup 2024-05-02 10:00:00.000000"}, map[string][][]string{
+		"kobo": {{"name"}, {"Frank"}},
+	})
+	run := time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC)
+	if err := backupToTab(context.Background(), srv, "sheet", "kobo", run); err != nil {
+		t.Fatal(err)
+	}
+
+	backup := "kobo backup 2024-05-03 10:00:00.000000"
+	want := []string{"kobo", "kobo backup 2024-05-02 10:00:00.000000", backup}
+	if !reflect.DeepEqual(fake.order, want) {
+		t.Errorf("tabs = %v, want %v", fake.order, want)
+	}
+	if !reflect.DeepEqual(fake.tabs[backup], [][]string{{"name"}, {"Frank"}}) {
+		t.Errorf("backup = %v", fake.tabs[backup])
+	}
+	// Вкладку ховаємо за id з відповіді на дублювання
+	last := fake.requests[len(fake.requests)-1]
+	if len(last) != 1 || last[0].UpdateSheetProperties == nil || last[0].UpdateSheetProperties.Properties.SheetId != fake.ids[backup] {
+		t.Errorf("backup tab %d is not hidden: %+v", fake.ids[backup], last)
+	}
+}
@@ -0,0 +1,276 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/sheets/v4"
+)
+
+const (
+	typeText     = "text"
+	typeNumber   = "number"
+	typeInteger  = "integer"
+	typeDate     = "date"
+	typeDateTime = "datetime"
+	typeBoolean  = "boolean"
+)
+
+var columnTypesFlag = regexp.MustCompile(`(^| )-column-types( |$)`)
+
+// koboTypes maps Kobo question types to column types.
+var koboTypes = map[string]string{
+	"integer":  typeInteger,
+	"decimal":  typeNumber,
+	"range":    typeNumber,
+	"date":     typeDate,
+	"today":    typeDate,
+	"datetime": typeDateTime,
+	"start":    typeDateTime,
+	"end":      typeDateTime,
+	"text":     typeText,
+	"barcode":  typeText,
+}
+
+// ColumnTypes returns column type hints of the job by column title.
+// Hints inferred from the form schema (" -schema-types") are overridden by
+// app.column-types from config (" -column-types"), and those by " types='col:type,...'"
+// from the title. Jobs without these options have no hints.
+func (e *ExpImp) ColumnTypes(spreadSheetName string, link string, token string, client *http.Client) map[string]string {
+	types := make(map[string]string)
+
+	if strings.Contains(spreadSheetName, " -schema-types") {
+		asset, err := e.fetchAsset(link, token, client)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"csv_link": link, "error": err}).Error("error while getting form schema, types are not inferred")
+		} else {
+			for _, q := range asset.Content.Survey {
+				if columnType, ok := koboTypes[q.Type]; ok {
+					types[q.Name] = columnType
+					if q.XPath != "" {
+						types[q.XPath] = columnType
+					}
+				}
+			}
+			types["_id"] = typeInteger
+			types["_index"] = typeInteger
+			types["_submission_time"] = typeDateTime
+		}
+	}
+
+	if columnTypesFlag.MatchString(spreadSheetName) {
+		for column, columnType := range config.ColumnTypes {
+			types[column] = columnType
+		}
+	}
+
+	for column, columnType := range getColumnTypesOption(spreadSheetName) {
+		types[column] = columnType
+	}
+
+	return types
+}
+
+// hasColumnTypes reports whether ColumnTypes can return hints for the job.
+func hasColumnTypes(spreadSheetName string) bool {
+	return strings.Contains(spreadSheetName, " -schema-types") || columnTypesFlag.MatchString(spreadSheetName) && len(config.ColumnTypes) > 0 ||
+		len(getColumnTypesOption(spreadSheetName)) > 0
+}
+
+var columnTypesOption = regexp.MustCompile(` types=["']([^"']*)["']`)
+
+// getColumnTypesOption parses " types='phone:text,age:integer'" from the title.
+func getColumnTypesOption(title string) map[string]string {
+	types := make(map[string]string)
+	matches := columnTypesOption.FindStringSubmatch(title)
+	if len(matches) < 2 {
+		return types
+	}
+	for _, pair := range strings.Split(matches[1], ",") {
+		column, columnType, found := strings.Cut(pair, ":")
+		if !found {
+			continue
+		}
+		types[strings.TrimSpace(column)] = strings.ToLower(strings.TrimSpace(columnType))
+	}
+	return types
+}
+
+// resolveColumnTypes returns types by column index for the header row.
+// It returns nil if no column has a type, then values are sent as before.
+func resolveColumnTypes(header []string, hints map[string]string) []string {
+	if len(hints) == 0 {
+		return nil
+	}
+	types := make([]string, len(header))
+	found := false
+	for i, title := range header {
+		columnType, ok := hints[title]
+		if !ok {
+			// viper lowercases keys of app.column-types
+			columnType, ok = hints[strings.ToLower(title)]
+		}
+		if ok {
+			types[i] = columnType
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return types
+}
+
+// typedValues converts records to typed values for RAW input.
+// The header row, if any, is kept as text.
+func typedValues(records [][]string, types []string, header bool) [][]interface{} {
+	result := make([][]interface{}, 0, len(records))
+	for rowNumber, row := range records {
+		typedRow := make([]interface{}, 0, len(row))
+		for i, item := range row {
+			if header && rowNumber == 0 {
+				typedRow = append(typedRow, item)
+				continue
+			}
+			columnType := ""
+			if i < len(types) {
+				columnType = types[i]
+			}
+			typedRow = append(typedRow, typedValue(item, columnType))
+		}
+		result = append(result, typedRow)
+	}
+	return result
+}
+
+// typedValue converts the value to the column type. Values which can not be
+// converted are sent as text. Columns without type get numbers only when the
+// value is a plain number without leading zeros or plus sign.
+func typedValue(value string, columnType string) interface{} {
+	if value == "" {
+		return value
+	}
+
+	switch columnType {
+	case typeText:
+		return value
+	case typeNumber:
+		if f, ok := enteredNumber(value); ok {
+			return f
+		}
+	case typeInteger:
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i
+		}
+		if f, ok := enteredNumber(value); ok {
+			return f
+		}
+	case typeBoolean:
+		switch strings.ToLower(value) {
+		case "true", "yes", "1":
+			return true
+		case "false", "no", "0":
+			return false
+		}
+	case typeDate, typeDateTime:
+		if t, ok := parseKoboTime(value); ok {
+			return serialDate(t)
+		}
+	case "":
+		if isPlainNumber(value) {
+			if f, ok := enteredNumber(value); ok {
+				return f
+			}
+		}
+	}
+
+	return value
+}
+
+var plainNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?$`)
+
+func isPlainNumber(value string) bool {
+	return len(value) < 16 && plainNumber.MatchString(value)
+}
+
+var koboTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.000-07:00",
+	"2006-01-02T15:04:05",
+	time.DateTime,
+	time.DateOnly,
+}
+
+func parseKoboTime(value string) (time.Time, bool) {
+	for _, layout := range koboTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// serialDate converts the wall clock of t to a Sheets serial number.
+func serialDate(t time.Time) float64 {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	return wall.Sub(epoch).Hours() / 24
+}
+
+// formatDateColumns sets date formats for date and datetime columns,
+// otherwise serial numbers are shown as plain numbers.
+func formatDateColumns(ctx context.Context, srv *sheets.Service, spreadsheetId string, tab string, firstRow int, rows int, types []string) error {
+	var requests []*sheets.Request
+	var sheetId *int64
+
+	for i, columnType := range types {
+		if columnType != typeDate && columnType != typeDateTime {
+			continue
+		}
+
+		if sheetId == nil {
+			id, err := getSheetId(ctx, srv, spreadsheetId, tab)
+			if err != nil {
+				return err
+			}
+			sheetId = &id
+		}
+
+		format := &sheets.NumberFormat{Type: "DATE", Pattern: "yyyy-mm-dd"}
+		if columnType == typeDateTime {
+			format = &sheets.NumberFormat{Type: "DATE_TIME", Pattern: "yyyy-mm-dd hh:mm:ss"}
+		}
+
+		requests = append(requests, &sheets.Request{
+			RepeatCell: &sheets.RepeatCellRequest{
+				Range: &sheets.GridRange{
+					SheetId:          *sheetId,
+					StartRowIndex:    int64(firstRow - 1),
+					EndRowIndex:      int64(firstRow - 1 + rows),
+					StartColumnIndex: int64(i),
+					EndColumnIndex:   int64(i + 1),
+					ForceSendFields:  []string{"SheetId", "StartRowIndex", "StartColumnIndex"},
+				},
+				Cell: &sheets.CellData{
+					UserEnteredFormat: &sheets.CellFormat{NumberFormat: format},
+				},
+				Fields: "userEnteredFormat.numberFormat",
+			},
+		})
+	}
+
+	if len(requests) == 0 {
+		return nil
+	}
+
+	_, err := srv.Spreadsheets.BatchUpdate(spreadsheetId, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: requests,
+	}).Context(ctx).Do()
+	return err
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+)
+
+func TestGetColumnTypesOption(t *testing.T) {
+	got := getColumnTypesOption("Report -wot types='phone:text, age:Integer' -idx")
+	want := map[string]string{"phone": "text", "age": "integer"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getColumnTypesOption() = %v, want %v", got, want)
+	}
+}
+
+func TestColumnTypesOptIn(t *testing.T) {
+	defer config.SetColumnTypes(config.ColumnTypes)
+	config.SetColumnTypes(map[string]string{"_id": "integer", "age": "number"})
+	e := &ExpImp{}
+
+	if got := e.ColumnTypes("Report", "", "", nil); len(got) != 0 {
+		t.Errorf("ColumnTypes() without the option = %v", got)
+	}
+	got := e.ColumnTypes("Report -column-types types='age:integer'", "", "", nil)
+	want := map[string]string{"_id": "integer", "age": "integer"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ColumnTypes() = %v, want %v", got, want)
+	}
+}
+
+func TestResolveColumnTypes(t *testing.T) {
+	header := []string{"Phone", "age", "name"}
+
+	got := resolveColumnTypes(header, map[string]string{"phone": "text", "age": "integer"})
+	want := []string{"text", "integer", ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resolveColumnTypes() = %v, want %v", got, want)
+	}
+
+	if got := resolveColumnTypes(header, map[string]string{"other": "text"}); got != nil {
+		t.Errorf("resolveColumnTypes() = %v, want nil", got)
+	}
+}
+
+func TestTypedValue(t *testing.T) {
+	tests := []struct {
+		value      string
+		columnType string
+		want       interface{}
+	}{
+		{value: "0012", columnType: "text", want: "0012"},
+		{value: "+380501234567", columnType: "", want: "+380501234567"},
+		{value: "0012", columnType: "", want: "0012"},
+		{value: "12.5", columnType: "", want: 12.5},
+		{value: "1,5", columnType: "number", want: "1,5"},
+		{value: "-5", columnType: "number", want: -5.0},
+		{value: "inf", columnType: "number", want: "inf"},
+		{value: "-Infinity", columnType: "number", want: "-Infinity"},
+		{value: "NaN", columnType: "integer", want: "NaN"},
+		{value: "0x10", columnType: "integer", want: "0x10"},
+		{value: "42", columnType: "integer", want: int64(42)},
+		{value: "yes", columnType: "boolean", want: true},
+		{value: "2024-01-11", columnType: "date", want: 45302.0},
+		{value: "2024-01-11T12:00:00.000+02:00", columnType: "datetime", want: 45302.5},
+		{value: "n/a", columnType: "date", want: "n/a"},
+		{value: "", columnType: "integer", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := typedValue(tt.value, tt.columnType); got != tt.want {
+			t.Errorf("typedValue(%q, %q) = %v (%T), want %v (%T)", tt.value, tt.columnType, got, got, tt.want, tt.want)
+		}
+	}
+}
+
+func TestSerialDate(t *testing.T) {
+	if got := serialDate(time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)); got != 2 {
+		t.Errorf("serialDate() = %v, want 2", got)
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"unicode/utf8"
+)
+
+// CSVDialect holds per-job CSV reader settings.
+// Zero Comma means the delimiter is detected from the header line, zero Comment disables comments.
+type CSVDialect struct {
+	Comma   rune
+	Comment rune
+}
+
+// delimiters are candidates for detection, the first one wins a tie.
+var delimiters = []rune{';', ',', '\t', '|'}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+var (
+	delimiterOption = regexp.MustCompile(` delimiter=["']([^"']*)["']`)
+	commentOption   = regexp.MustCompile(` comment=["']([^"']*)["']`)
+)
+
+// GetCSVDialect returns the dialect from " delimiter=';'" and " comment='#'" in the title.
+// "tab" may be used for the tab delimiter.
+func GetCSVDialect(spreadSheetName string) CSVDialect {
+	return CSVDialect{
+		Comma:   getDialectRune(spreadSheetName, delimiterOption),
+		Comment: getDialectRune(spreadSheetName, commentOption),
+	}
+}
+
+func getDialectRune(title string, option *regexp.Regexp) rune {
+	matches := option.FindStringSubmatch(title)
+	if len(matches) < 2 {
+		return 0
+	}
+	if matches[1] == "tab" || matches[1] == `\t` {
+		return '\t'
+	}
+	r, _ := utf8.DecodeRuneInString(matches[1])
+	if r == utf8.RuneError {
+		return 0
+	}
+	return r
+}
+
+// skipBOM drops the UTF-8 byte order mark at the start of the reader.
+func skipBOM(r *bufio.Reader) error {
+	start, err := r.Peek(len(utf8BOM))
+	if err == nil && bytes.Equal(start, utf8BOM) {
+		_, err = r.Discard(len(utf8BOM))
+		return err
+	}
+	return nil
+}
+
+// detectDelimiter peeks the header line and returns the candidate found there most often
+// outside quotes. Semicolon is returned when no candidate is found.
+func detectDelimiter(r *bufio.Reader) rune {
+	// Peek повертає доступні байти разом з помилкою, якщо файл коротший за буфер
+	data, _ := r.Peek(r.Size())
+
+	counts := make(map[rune]int)
+	quoted := false
+	for _, c := range string(data) {
+		if c == '"' {
+			quoted = !quoted
+			continue
+		}
+		if quoted {
+			continue
+		}
+		if c == '\n' || c == '\r' {
+			break
+		}
+		counts[c]++
+	}
+
+	best := delimiters[0]
+	for _, d := range delimiters[1:] {
+		if counts[d] > counts[best] {
+			best = d
+		}
+	}
+	return best
+}
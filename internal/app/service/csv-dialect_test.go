@@ -0,0 +1,68 @@
+package service
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestGetCSVDialect(t *testing.T) {
+	tests := []struct {
+		title string
+		want  CSVDialect
+	}{
+		{"Report -wot", CSVDialect{}},
+		{"Report delimiter=','", CSVDialect{Comma: ','}},
+		{"Report delimiter='tab' comment='#'", CSVDialect{Comma: '\t', Comment: '#'}},
+		{`Report delimiter="|"`, CSVDialect{Comma: '|'}},
+	}
+	for _, tt := range tests {
+		if got := GetCSVDialect(tt.title); got != tt.want {
+			t.Errorf("GetCSVDialect(%q) = %+v, want %+v", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestDetectDelimiter(t *testing.T) {
+	tests := []struct {
+		data string
+		want rune
+	}{
+		{"name;age;_index\nFrank;25;1\n", ';'},
+		{"name,age,_index\nFrank;25;1\n", ','},
+		{"\"a;b\",c,d\n", ','},
+		{"name\tage\n", '\t'},
+		{"name\n", ';'},
+		{"", ';'},
+	}
+	for _, tt := range tests {
+		if got := detectDelimiter(bufio.NewReader(strings.NewReader(tt.data))); got != tt.want {
+			t.Errorf("detectDelimiter(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestSkipBOM(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("\xEF\xBB\xBFname,#tag\nFrank,#1\n"))
+	if err := skipBOM(r); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := csv.NewReader(r)
+	reader.Comma = detectDelimiter(r)
+	var rows [][]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 2 || rows[0][0] != "name" || rows[1][1] != "#1" {
+		t.Errorf("rows = %q", rows)
+	}
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/sheets/v4"
+)
+
+const (
+	deletedRemove  = "remove"
+	deletedMark    = "mark"
+	deletedArchive = "archive"
+
+	uuidColumn = "_uuid"
+	// submissionUUIDColumn links rows of repeat tabs to their submission.
+	submissionUUIDColumn = "_submission__uuid"
+	deletedColumn        = "_deleted_in_kobo"
+	deletedFlag          = "TRUE"
+	// archiveSuffix is added to the tab name for the tab with archived rows.
+	archiveSuffix = " (deleted)"
+)
+
+var deletedOption = regexp.MustCompile(` deleted=(remove|mark|archive)( |$)`)
+
+// getDeletedMode parses " deleted=remove|mark|archive" from the title, empty if there is none.
+func getDeletedMode(title string) string {
+	matches := deletedOption.FindStringSubmatch(title)
+	if len(matches) < 2 {
+		return ""
+	}
+	return matches[1]
+}
+
+// deletions tracks submissions of a tab by _uuid between runs. Submissions written before
+// and missing in the export are deleted in Kobo: their rows are removed from the tab,
+// kept with the _deleted_in_kobo flag (" deleted=mark") or moved to the archive tab
+// (" deleted=archive"). Rows left below the new records are cleared.
+// Repeat tabs are tracked by _submission__uuid of their submission.
+type deletions struct {
+	mode string
+	// key is the tracked column, source its index in the export,
+	// column its index in the written records and width their number of columns
+	key      string
+	source   int
+	column   int
+	width    int
+	previous []string
+	current  map[string]bool
+	// archived are rows for the archive tab
+	archived [][]string
+}
+
+// deletionsKey returns the column submissions of the header are tracked by, empty if there is none.
+func deletionsKey(header []string) string {
+	for _, key := range []string{uuidColumn, submissionUUIDColumn} {
+		if columnIndex(header, key) >= 0 {
+			return key
+		}
+	}
+	return ""
+}
+
+// newDeletions returns nil when the job has no deleted option or the export has no _uuid
+// or _submission__uuid column. source is the header of the export, header the one
+// the options are applied to. previous are uuids of the last run.
+func newDeletions(spreadSheetName string, source []string, header []string, previous []string) *deletions {
+	mode := getDeletedMode(spreadSheetName)
+	key := deletionsKey(source)
+	if mode == "" || key == "" || columnIndex(header, key) < 0 {
+		return nil
+	}
+	d := &deletions{
+		mode:     mode,
+		key:      key,
+		source:   columnIndex(source, key),
+		column:   columnIndex(header, key),
+		width:    len(header),
+		previous: previous,
+		current:  make(map[string]bool),
+	}
+	if mode == deletedMark {
+		d.width++
+	}
+	return d
+}
+
+// seen remembers the uuid of a data row of the export. It is called before any
+// option drops rows, so filtered submissions are not taken for deleted ones.
+func (d *deletions) seen(row []string) {
+	if d.source < len(row) && row[d.source] != "" {
+		d.current[row[d.source]] = true
+	}
+}
+
+// add returns the row with the flag column for " deleted=mark". The header row
+// sets the column and width of the written records.
+func (d *deletions) add(row []string, isHeader bool) []string {
+	if isHeader {
+		if column := columnIndex(row, d.key); column >= 0 {
+			d.column = column
+		}
+		d.width = len(row)
+		if d.mode == deletedMark {
+			d.width++
+		}
+	}
+	if d.mode != deletedMark {
+		return row
+	}
+	flag := ""
+	if isHeader {
+		flag = deletedColumn
+	}
+	return append(append(make([]string, 0, len(row)+1), row...), flag)
+}
+
+// deleted returns uuids written before and missing in the export.
+func (d *deletions) deleted() map[string]bool {
+	deleted := make(map[string]bool)
+	for _, uuid := range d.previous {
+		if !d.current[uuid] {
+			deleted[uuid] = true
+		}
+	}
+	return deleted
+}
+
+// needsSheet reports whether rows of deleted submissions must be read from the sheet.
+func (d *deletions) needsSheet() bool {
+	return d.mode != deletedRemove && len(d.deleted()) > 0
+}
+
+// fromSheet returns rows of deleted submissions from the current sheet values.
+// With " deleted=mark" they are flagged and kept in the tracked uuids, with " deleted=archive"
+// they are also kept for archiveRows.
+func (d *deletions) fromSheet(values [][]string) [][]string {
+	deleted := d.deleted()
+	var rows [][]string
+	for _, value := range values {
+		if d.column >= len(value) || !deleted[value[d.column]] {
+			continue
+		}
+		row := make([]string, d.width)
+		copy(row, value)
+		if d.mode == deletedMark {
+			row[d.width-1] = deletedFlag
+			d.current[value[d.column]] = true
+		}
+		rows = append(rows, row)
+	}
+	if d.mode == deletedArchive {
+		d.archived = rows
+	}
+	return rows
+}
+
+// readDeleted reads rows of deleted submissions from the range when the mode needs them.
+func (d *deletions) readDeleted(ctx context.Context, srv *sheets.Service, spreadsheetId string, sheetRange string) ([][]string, error) {
+	if !d.needsSheet() {
+		return nil, nil
+	}
+	values, err := readValues(ctx, srv, spreadsheetId, sheetRange, "FORMATTED_VALUE")
+	if err != nil {
+		return nil, fmt.Errorf("error while reading rows of deleted submissions: %w", err)
+	}
+	rows := d.fromSheet(values)
+	logrus.WithFields(logrus.Fields{"range": sheetRange, "mode": d.mode, "rows": len(rows)}).Info("Submissions are deleted in Kobo")
+	return rows, nil
+}
+
+// tracked returns sorted uuids to remember for the next run.
+func (d *deletions) tracked() []string {
+	uuids := make([]string, 0, len(d.current))
+	for uuid := range d.current {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+// clearBelow clears rows of the tab from the row after the records to the last row written before.
+func clearBelow(ctx context.Context, srv *sheets.Service, spreadsheetId string, tab string, firstRow int, rows int, previousRows int) error {
+	if previousRows <= rows {
+		return nil
+	}
+	clearRange := fmt.Sprintf("%s!A%d:XYZ%d", quoteTab(tab), firstRow+rows, firstRow+previousRows-1)
+	if _, err := srv.Spreadsheets.Values.Clear(spreadsheetId, clearRange, &sheets.ClearValuesRequest{}).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("error while clearing rows of deleted submissions: %w", err)
+	}
+	logrus.WithFields(logrus.Fields{"range": clearRange}).Info("Rows below the records are cleared")
+	return nil
+}
+
+// archiveRows appends rows to the archive tab of the tab, creating it with the header.
+// Rows whose key in column is already in the archive tab are skipped, so rows archived
+// before a failed write are not archived again when the import is retried.
+func (e *ExpImp) archiveRows(ctx context.Context, srv *sheets.Service, spreadsheetId string, tab string, header []string, rows [][]string, column int) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	archive := tab + archiveSuffix
+	if _, err := getSheetId(ctx, srv, spreadsheetId, archive); err != nil {
+		_, err = srv.Spreadsheets.BatchUpdate(spreadsheetId, &sheets.BatchUpdateSpreadsheetRequest{
+			Requests: []*sheets.Request{{AddSheet: &sheets.AddSheetRequest{Properties: &sheets.SheetProperties{Title: archive}}}},
+		}).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("failed to add archive tab: %w", err)
+		}
+		if header != nil {
+			rows = append([][]string{header}, rows...)
+		}
+	} else {
+		keys, err := readValues(ctx, srv, spreadsheetId, fmt.Sprintf("%s!%s:%[2]s", quoteTab(archive), columnName(column)), "FORMATTED_VALUE")
+		if err != nil {
+			return fmt.Errorf("error while reading archive tab: %w", err)
+		}
+		rows = notArchived(rows, keys, column)
+		if len(rows) == 0 {
+			logrus.WithFields(logrus.Fields{"tab": archive}).Info("Rows of deleted submissions are already archived")
+			return nil
+		}
+	}
+
+	_, err := srv.Spreadsheets.Values.Append(spreadsheetId, quoteTab(archive)+"!A1", &sheets.ValueRange{
+		Values: e.StringSliceToInterfaceSliceConverter(rows),
+	}).ValueInputOption("USER_ENTERED").InsertDataOption("INSERT_ROWS").Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error while archiving rows of deleted submissions: %w", err)
+	}
+	logrus.WithFields(logrus.Fields{"tab": archive, "rows": len(rows)}).Info("Rows of deleted submissions are archived")
+	return nil
+}
+
+// notArchived returns rows whose key in column is not among keys read from the archive tab.
+func notArchived(rows [][]string, keys [][]string, column int) [][]string {
+	archived := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if len(key) > 0 && key[0] != "" {
+			archived[key[0]] = true
+		}
+	}
+	var result [][]string
+	for _, row := range rows {
+		if column >= len(row) || !archived[row[column]] {
+			result = append(result, row)
+		}
+	}
+	return result
+}
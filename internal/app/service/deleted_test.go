@@ -0,0 +1,134 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+func TestGetDeletedMode(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Report", ""},
+		{"Report deleted=mark", deletedMark},
+		{"Report deleted=archive -wot", deletedArchive},
+		{"Report deleted=hide", ""},
+	}
+	for _, tt := range tests {
+		if got := getDeletedMode(tt.title); got != tt.want {
+			t.Errorf("getDeletedMode(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestDeletionsMark(t *testing.T) {
+	header := []string{"name", "_uuid"}
+	d := newDeletions("Report deleted=mark", header, header, []string{"u1", "u2", "u3"})
+	if d == nil {
+		t.Fatal("no deletions")
+	}
+	d.seen([]string{"Frank", "u1"})
+
+	got := [][]string{d.add(header, true), d.add([]string{"Frank", "u1"}, false)}
+	want := [][]string{{"name", "_uuid", "_deleted_in_kobo"}, {"Frank", "u1", ""}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("add() = %q, want %q", got, want)
+	}
+	if !d.needsSheet() {
+		t.Error("deleted rows are not read from the sheet")
+	}
+
+	sheet := [][]string{
+		{"name", "_uuid", "_deleted_in_kobo"},
+		{"Frank", "u1", ""},
+		{"John", "u2", ""},
+		{"Anna", "u3", "TRUE"},
+	}
+	rows := d.fromSheet(sheet)
+	if want := [][]string{{"John", "u2", "TRUE"}, {"Anna", "u3", "TRUE"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("fromSheet() = %q, want %q", rows, want)
+	}
+	if want := []string{"u1", "u2", "u3"}; !reflect.DeepEqual(d.tracked(), want) {
+		t.Errorf("tracked() = %q, want %q", d.tracked(), want)
+	}
+}
+
+func TestDeletionsArchive(t *testing.T) {
+	header := []string{"name", "_uuid"}
+	d := newDeletions("Report deleted=archive", header, header, []string{"u1", "u2"})
+	d.seen([]string{"Frank", "u1"})
+
+	rows := d.fromSheet([][]string{{"name", "_uuid"}, {"Frank", "u1"}, {"John", "u2"}})
+	if want := [][]string{{"John", "u2"}}; !reflect.DeepEqual(rows, want) || !reflect.DeepEqual(d.archived, want) {
+		t.Errorf("fromSheet() = %q, archived %q", rows, d.archived)
+	}
+	if want := []string{"u1"}; !reflect.DeepEqual(d.tracked(), want) {
+		t.Errorf("tracked() = %q, want %q", d.tracked(), want)
+	}
+
+	if newDeletions("Report deleted=remove", []string{"name"}, []string{"name"}, nil) != nil {
+		t.Error("deletions without _uuid column")
+	}
+	if d := newDeletions("Report deleted=remove", []string{"_uuid"}, []string{"_uuid"}, []string{"u1"}); d.needsSheet() {
+		t.Error("sheet is read with deleted=remove")
+	}
+}
+
+func TestDeletionsFiltered(t *testing.T) {
+	// u2 is dropped by a filter, it is not deleted in Kobo
+	source := []string{"_validation_status", "_uuid"}
+	d := newDeletions("Report deleted=remove validation='approved'", source, source, []string{"u1", "u2"})
+	d.seen([]string{"approved", "u1"})
+	d.seen([]string{"on_hold", "u2"})
+	if len(d.deleted()) != 0 {
+		t.Errorf("deleted() = %v, want none", d.deleted())
+	}
+}
+
+func TestDeletionsRepeat(t *testing.T) {
+	header := []string{"kid", "_submission__uuid"}
+	d := newDeletions("Report deleted=archive", header, header, []string{"u1", "u2"})
+	if d == nil || d.key != submissionUUIDColumn {
+		t.Fatalf("deletions of a repeat tab = %+v", d)
+	}
+	d.seen([]string{"A", "u1"})
+
+	rows := d.fromSheet([][]string{header, {"A", "u1"}, {"B", "u2"}, {"C", "u2"}})
+	if want := [][]string{{"B", "u2"}, {"C", "u2"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("fromSheet() = %q, want %q", rows, want)
+	}
+}
+
+func TestImporterArchiveRetry(t *testing.T) {
+	fake, srv := newFakeSheets(t, []string{"kobo"}, map[string][][]string{
+		"kobo": {{"name", "_uuid"}, {"Frank", "u1"}, {"John", "u2"}},
+	})
+	e := newTestExpImp(t, srv)
+	err := e.updateJobState(1, func(state *models.JobState) {
+		state.Tabs["kobo"] = models.TabState{Rows: 3, UUIDs: []string{"u1", "u2"}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	title := "Report deleted=archive -allow-shrink"
+	rows := [][]string{{"name", "_uuid"}, {"Frank", "u1"}}
+
+	fake.failWrites = 1
+	if err := e.Importer(1, testCredentials, title, "sheet", "kobo", recordsOf(t, rows), nil, nil); err == nil {
+		t.Fatal("the failed write is not reported")
+	}
+	if err := e.Importer(1, testCredentials, title, "sheet", "kobo", recordsOf(t, rows), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	wantArchive := [][]string{{"name", "_uuid"}, {"John", "u2"}}
+	if got := fake.tabs["kobo"+archiveSuffix]; !reflect.DeepEqual(got, wantArchive) {
+		t.Errorf("archive tab = %v, want %v", got, wantArchive)
+	}
+	if got := trimRows(fake.tabs["kobo"]); !reflect.DeepEqual(got, rows) {
+		t.Errorf("tab = %v, want %v", got, rows)
+	}
+}
@@ -0,0 +1,388 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/sheets/v4"
+)
+
+// writeOptions describe how records are sent to Sheets.
+type writeOptions struct {
+	// types are column types by index. Without types values are sent
+	// as strings with USER_ENTERED input, with types as typed RAW values.
+	types []string
+	// header is true when the first record is a header row.
+	header bool
+	// sanitize is the formula sanitising policy for USER_ENTERED input.
+	sanitize string
+	// numeric marks columns by index where plain numbers are not sanitised,
+	// allNumeric does it for every column.
+	numeric    []bool
+	allNumeric bool
+	// formulas marks media columns by index where =IMAGE() formulas are kept.
+	formulas []bool
+	// width is the number of columns the job wrote last time. Changed rows are cleared
+	// up to it, cells to the right of it belong to users and are kept.
+	width int
+}
+
+// values converts records for Sheets, skip is the index of the first record in the range.
+func (e *ExpImp) values(records [][]string, opts writeOptions, skip int) [][]interface{} {
+	if opts.types == nil {
+		return e.convertValues(records, opts)
+	}
+	if opts.formulas != nil {
+		records = formulaLinks(records, opts.formulas)
+	}
+	return typedValues(records, opts.types, opts.header && skip == 0)
+}
+
+// hashKey describes how records are converted, it is hashed with them,
+// so a changed policy or column option rewrites the range.
+func (opts writeOptions) hashKey() string {
+	return strings.Join(opts.types, ",") + "|" + opts.sanitize + "|" + boolIndexes(opts.numeric) + "|" + boolIndexes(opts.formulas)
+}
+
+func boolIndexes(flags []bool) string {
+	var indexes []string
+	for i, ok := range flags {
+		if ok {
+			indexes = append(indexes, strconv.Itoa(i))
+		}
+	}
+	return strings.Join(indexes, ",")
+}
+
+func (opts writeOptions) inputOption() string {
+	if opts.types == nil {
+		return "USER_ENTERED"
+	}
+	return "RAW"
+}
+
+// withFormulaColumns replaces cells of formula columns in current with cells of formulas.
+func withFormulaColumns(current [][]interface{}, formulas [][]interface{}, columns []bool) [][]interface{} {
+	for r, row := range formulas {
+		if r >= len(current) {
+			current = append(current, nil)
+		}
+		for i, cell := range row {
+			if i >= len(columns) || !columns[i] {
+				continue
+			}
+			for len(current[r]) <= i {
+				current[r] = append(current[r], "")
+			}
+			current[r][i] = cell
+		}
+	}
+	return current
+}
+
+// compareCells returns both sides as comparable strings: numbers, dates and booleans
+// the way Sheets keeps them, so a cell shown in another format is not a change.
+// userEntered parses values like USER_ENTERED input does, a value is also
+// the same when Sheets kept it as text.
+func compareCells(current [][]interface{}, values [][]interface{}, userEntered bool) ([][]string, [][]string) {
+	sheet := make([][]string, len(current))
+	for r, row := range current {
+		sheet[r] = make([]string, len(row))
+		for i, cell := range row {
+			sheet[r][i] = cellKey(cell)
+		}
+	}
+	compared := make([][]string, len(values))
+	for r, row := range values {
+		compared[r] = make([]string, len(row))
+		for i, cell := range row {
+			text, ok := cell.(string)
+			switch {
+			case !ok || !userEntered:
+				compared[r][i] = cellKey(cell)
+			case r < len(sheet) && i < len(sheet[r]) && sheet[r][i] == text:
+				compared[r][i] = text
+			default:
+				compared[r][i] = enteredKey(text)
+			}
+		}
+	}
+	return sheet, compared
+}
+
+// cellKey formats a value of the sheet or a RAW value.
+func cellKey(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return numberKey(v)
+	case int:
+		return numberKey(float64(v))
+	case int64:
+		return numberKey(float64(v))
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(v))
+	case string:
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+// enteredKey formats a USER_ENTERED value like Sheets keeps it: quoted text without the quote,
+// formulas as they are, numbers, percents, booleans and dates as numbers.
+func enteredKey(value string) string {
+	switch {
+	case value == "":
+		return value
+	case value[0] == '\'':
+		return value[1:]
+	case value[0] == '=':
+		return value
+	case strings.EqualFold(value, "true") || strings.EqualFold(value, "false"):
+		return strings.ToUpper(value)
+	}
+	if number, ok := enteredNumber(strings.TrimSuffix(value, "%")); ok {
+		if strings.HasSuffix(value, "%") {
+			number /= 100
+		}
+		return numberKey(number)
+	}
+	if t, ok := parseKoboTime(value); ok {
+		return numberKey(serialDate(t))
+	}
+	return value
+}
+
+// enteredNumber parses finite decimal numbers only, ParseFloat also takes inf, nan and hex.
+func enteredNumber(value string) (float64, bool) {
+	if value == "" || !strings.ContainsRune("0123456789+-.", rune(value[0])) || strings.ContainsAny(value, "xXpP_") {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(number, 0) || math.IsNaN(number) {
+		return 0, false
+	}
+	return number, true
+}
+
+// numberKey keeps 15 significant digits like Sheets.
+func numberKey(number float64) string {
+	return strconv.FormatFloat(number, 'g', 15, 64)
+}
+
+// padRows pads rows of the block to the width of the rows in the sheet, but not over width,
+// so trailing cells left from the previous values are cleared and cells of users are kept.
+func padRows(values [][]interface{}, current [][]interface{}, first int, width int) [][]interface{} {
+	padded := make([][]interface{}, len(values))
+	for r, row := range values {
+		padded[r] = row
+		if first+r >= len(current) {
+			continue
+		}
+		end := len(current[first+r])
+		if end > width {
+			end = width
+		}
+		if end <= len(row) {
+			continue
+		}
+		padded[r] = append([]interface{}(nil), row...)
+		for len(padded[r]) < end {
+			padded[r] = append(padded[r], "")
+		}
+	}
+	return padded
+}
+
+// writtenWidth returns the number of columns the records are written to: the widest row,
+// or the width of the last write when it was wider.
+func writtenWidth(values [][]interface{}, previous int) int {
+	width := previous
+	for _, row := range values {
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+	return width
+}
+
+// cutRows returns rows cut to width, cells to the right of the written columns are not compared.
+func cutRows(rows [][]interface{}, width int) [][]interface{} {
+	cut := make([][]interface{}, len(rows))
+	for r, row := range rows {
+		if len(row) > width {
+			row = row[:width]
+		}
+		cut[r] = row
+	}
+	return cut
+}
+
+// rowsBlock is a run of changed rows, indexes are in records.
+type rowsBlock struct {
+	first int
+	last  int
+}
+
+// writeChanged writes only changed row blocks of the range, or the whole range when
+// diff writes are disabled or too many rows changed. Like the full write, it does not
+// clear rows below the new records.
+func (e *ExpImp) writeChanged(ctx context.Context, srv *sheets.Service, spreadSheetName string, spreadsheetId string, sheetRange string, firstRow int, records [][]string, opts writeOptions) error {
+	if !config.DiffWrites || strings.Contains(spreadSheetName, " -full-write") || len(records) == 0 {
+		return e.writeFull(ctx, srv, spreadsheetId, sheetRange, records, opts)
+	}
+
+	// Порівнюємо неформатовані значення з тим, що запише Sheets, а не з текстом показаних
+	current, err := readRawValues(ctx, srv, spreadsheetId, sheetRange, "UNFORMATTED_VALUE")
+	if err != nil {
+		return err
+	}
+	if opts.types == nil && opts.formulas != nil {
+		// =IMAGE() порівнюємо як формули, а не як їх порожній результат
+		formulas, err := readRawValues(ctx, srv, spreadsheetId, sheetRange, "FORMULA")
+		if err != nil {
+			return err
+		}
+		current = withFormulaColumns(current, formulas, opts.formulas)
+	}
+	values := e.values(records, opts, 0)
+	width := writtenWidth(values, opts.width)
+	current = cutRows(current, width)
+
+	blocks := changedBlocks(compareCells(current, values, opts.types == nil))
+	changedRows := 0
+	for _, block := range blocks {
+		changedRows += block.last - block.first + 1
+	}
+
+	if float64(changedRows)/float64(len(records)) > config.DiffWriteMaxRatio {
+		return e.writeFull(ctx, srv, spreadsheetId, sheetRange, records, opts)
+	}
+
+	if len(blocks) == 0 {
+		logrus.WithFields(logrus.Fields{"range": sheetRange}).Info("No changed rows")
+		return nil
+	}
+
+	tab := quoteTab(getTabName(sheetRange))
+	data := make([]*sheets.ValueRange, 0, len(blocks))
+	for _, block := range blocks {
+		data = append(data, &sheets.ValueRange{
+			Range:  fmt.Sprintf("%s!A%d", tab, firstRow+block.first),
+			Values: padRows(values[block.first:block.last+1], current, block.first, width),
+		})
+	}
+
+	_, err = srv.Spreadsheets.Values.BatchUpdate(spreadsheetId, &sheets.BatchUpdateValuesRequest{
+		ValueInputOption: opts.inputOption(),
+		Data:             data,
+	}).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{"range": sheetRange, "blocks": len(blocks), "rows": changedRows}).Info("Changed rows written")
+	return nil
+}
+
+func (e *ExpImp) writeFull(ctx context.Context, srv *sheets.Service, spreadsheetId string, sheetRange string, records [][]string, opts writeOptions) error {
+	row := &sheets.ValueRange{
+		Values: e.values(records, opts, 0),
+	}
+
+	_, err := srv.Spreadsheets.Values.Update(spreadsheetId, sheetRange, row).ValueInputOption(opts.inputOption()).Context(ctx).Do()
+	return err
+}
+
+// defaultWriteChunkRows is used when config.WriteChunkRows is not set.
+const defaultWriteChunkRows = 5000
+
+// writeChunked writes records in chunks of config.WriteChunkRows rows,
+// so only one chunk is converted to request values at a time.
+func (e *ExpImp) writeChunked(ctx context.Context, srv *sheets.Service, spreadsheetId string, sheetRange string, records *Records, opts writeOptions) error {
+	chunkRows := config.WriteChunkRows
+	if chunkRows <= 0 {
+		chunkRows = defaultWriteChunkRows
+	}
+	tab := quoteTab(getTabName(sheetRange))
+	firstRow := getStringNumber(sheetRange)
+
+	chunk := make([][]string, 0, chunkRows)
+	written, chunks := 0, 0
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		row := &sheets.ValueRange{
+			Values: e.values(chunk, opts, written),
+		}
+		_, err := srv.Spreadsheets.Values.Update(spreadsheetId, fmt.Sprintf("%s!A%d", tab, firstRow+written), row).ValueInputOption(opts.inputOption()).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		written += len(chunk)
+		chunks++
+		chunk = chunk[:0]
+		return nil
+	}
+
+	err := records.Each(func(_ int, record []string) error {
+		chunk = append(chunk, record)
+		if len(chunk) < chunkRows {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{"range": sheetRange, "rows": written, "chunks": chunks}).Info("Records written in chunks")
+	return nil
+}
+
+// changedBlocks returns runs of records that differ from the current values.
+func changedBlocks(current [][]string, records [][]string) []rowsBlock {
+	var blocks []rowsBlock
+	for i, record := range records {
+		var oldRow []string
+		if i < len(current) {
+			oldRow = trimRow(current[i])
+		}
+		if len(diffCells(oldRow, trimRow(record))) == 0 {
+			continue
+		}
+
+		if len(blocks) > 0 && blocks[len(blocks)-1].last == i-1 {
+			blocks[len(blocks)-1].last = i
+		} else {
+			blocks = append(blocks, rowsBlock{first: i, last: i})
+		}
+	}
+	return blocks
+}
+
+// quoteTab quotes the tab name for A1 notation.
+func quoteTab(tab string) string {
+	return "'" + strings.ReplaceAll(tab, "'", "''") + "'"
+}
+
+func getSheetId(ctx context.Context, srv *sheets.Service, spreadsheetId string, tab string) (int64, error) {
+	spreadSheet, err := srv.Spreadsheets.Get(spreadsheetId).Fields("sheets.properties").Context(ctx).Do()
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range spreadSheet.Sheets {
+		if s.Properties.Title == tab {
+			return s.Properties.SheetId, nil
+		}
+	}
+	return 0, fmt.Errorf("sheet %s not found", tab)
+}
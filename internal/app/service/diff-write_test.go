@@ -0,0 +1,146 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+func TestChangedBlocks(t *testing.T) {
+	current := [][]string{
+		{"name", "age"},
+		{"Frank", "25"},
+		{"John", "65"},
+		{"Lisa", "32"},
+		{"Anna", "41"},
+	}
+	records := [][]string{
+		{"name", "age", ""},
+		{"Frank", "26"},
+		{"John", "66"},
+		{"Lisa", "32"},
+		{"Anna", "41"},
+		{"Olga", "19"},
+		{"Ivan", "50"},
+	}
+
+	got := changedBlocks(current, records)
+	want := []rowsBlock{{first: 1, last: 2}, {first: 5, last: 6}}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changedBlocks() = %v, want %v", got, want)
+	}
+
+	if got := changedBlocks(current, current); len(got) != 0 {
+		t.Errorf("changedBlocks() of equal records = %v, want none", got)
+	}
+}
+
+func TestWithFormulaColumns(t *testing.T) {
+	current := [][]interface{}{{"photo", "date"}, {"", 45413.0}, {"", 45414.0}}
+	formulas := [][]interface{}{{"photo", "date"}, {`=IMAGE("https://x/1.jpg")`, 45413.0}, {}, {`=IMAGE("https://x/3.jpg")`}}
+
+	got := withFormulaColumns(current, formulas, []bool{true, false})
+	want := [][]interface{}{{"photo", "date"}, {`=IMAGE("https://x/1.jpg")`, 45413.0}, {"", 45414.0}, {`=IMAGE("https://x/3.jpg")`}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withFormulaColumns() = %v, want %v", got, want)
+	}
+}
+
+func TestCompareCells(t *testing.T) {
+	// Як Sheets зберіг значення, введені USER_ENTERED
+	current := [][]interface{}{
+		{"name", "age", "date", "ok", "share", "note", "code"},
+		{"Frank", 25.0, 45413.5, true, 0.25, "=x", "2024-05-01T12:00:00+03:00"},
+		{"John", 1000000.0, 45413.0, false, 0.5, "-a", 7.0},
+	}
+	values := [][]interface{}{
+		{"name", "age", "date", "ok", "share", "note", "code"},
+		{"Frank", "25", "2024-05-01 12:00:00", "true", "25%", "'=x", "2024-05-01T12:00:00+03:00"},
+		{"John", "1e6", "2024-05-02", "FALSE", "50%", "'-a", "007"},
+	}
+
+	sheet, compared := compareCells(current, values, true)
+	if blocks := changedBlocks(sheet, compared); len(blocks) != 1 || blocks[0] != (rowsBlock{first: 2, last: 2}) {
+		t.Errorf("changedBlocks() = %v, sheet %q, records %q", blocks, sheet[2], compared[2])
+	}
+
+	// RAW значення не розбираються
+	sheet, compared = compareCells([][]interface{}{{"25", 25.0}}, [][]interface{}{{"25", 25}}, false)
+	if !reflect.DeepEqual(sheet, compared) {
+		t.Errorf("compareCells() RAW = %q, %q", sheet, compared)
+	}
+}
+
+func TestEnteredKey(t *testing.T) {
+	tests := map[string]string{
+		"'+380":      "+380",
+		"=SUM(A1)":   "=SUM(A1)",
+		"0.10":       "0.1",
+		"inf":        "inf",
+		"-inf":       "-inf",
+		"0x10":       "0x10",
+		"2024-05-01": "45413",
+		"yes":        "yes",
+	}
+	for value, want := range tests {
+		if got := enteredKey(value); got != want {
+			t.Errorf("enteredKey(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestPadRows(t *testing.T) {
+	current := [][]interface{}{{"name", "age", "note"}, {"Frank", 25.0, "old"}}
+	values := [][]interface{}{{"Frank", "26"}, {"Olga"}}
+
+	got := padRows(values, current, 1, 3)
+	want := [][]interface{}{{"Frank", "26", ""}, {"Olga"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("padRows() = %v, want %v", got, want)
+	}
+	// Колонки правіше за записані лишаються користувачам
+	if got := padRows(values, current, 1, 2); !reflect.DeepEqual(got, values) {
+		t.Errorf("padRows() over width = %v, want %v", got, values)
+	}
+}
+
+func TestQuoteTab(t *testing.T) {
+	if got := quoteTab("Kobo data"); got != "'Kobo data'" {
+		t.Errorf("quoteTab() = %s", got)
+	}
+	if got := quoteTab("O'Neil"); got != "'O''Neil'" {
+		t.Errorf("quoteTab() = %s", got)
+	}
+}
+
+func TestImporterDiffWriteKeepsUserColumns(t *testing.T) {
+	config.SetDiffWrites(true, 1)
+	defer config.SetDiffWrites(false, 0)
+
+	// Колонка рецензента правіше за експорт
+	fake, srv := newFakeSheets(t, []string{"kobo"}, map[string][][]string{
+		"kobo": {{"name", "age", "review"}, {"Frank", "25", "ok"}, {"John", "30", "check"}},
+	})
+	e := newTestExpImp(t, srv)
+	err := e.updateJobState(1, func(state *models.JobState) {
+		state.Tabs["kobo"] = models.TabState{Rows: 3, Width: 2}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := [][]string{{"name", "age"}, {"Frank", "25"}, {"John", "31"}}
+	if err := e.Importer(1, testCredentials, "Report", "sheet", "kobo", recordsOf(t, rows), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"name", "age", "review"}, {"Frank", "25", "ok"}, {"John", "31", "check"}}
+	if got := trimRows(fake.tabs["kobo"]); !reflect.DeepEqual(got, want) {
+		t.Errorf("tab = %q, want %q", got, want)
+	}
+	if len(fake.requests) != 0 {
+		t.Errorf("unexpected spreadsheet updates: %v", fake.requests)
+	}
+}
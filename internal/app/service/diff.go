@@ -0,0 +1,206 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"google.golang.org/api/sheets/v4"
+)
+
+// DryRun prepares records like Importer does and compares them with the current sheet values.
+// Nothing is written to the sheet.
+func (e *ExpImp) DryRun(id int, credentials string, spreadSheetName string, spreadsheetId string, sheetName string, records *Records, form *models.Form) (models.SheetDiff, error) {
+	if !strings.Contains(sheetName, "!") {
+		sheetName += "!A1:XYZ"
+	}
+	tab := getTabName(sheetName)
+	state, err := e.state.GetJobState(id)
+	if err != nil {
+		return models.SheetDiff{}, fmt.Errorf("error while reading job state: %w", err)
+	}
+
+	prepared, err := prepareRange(records, rangeOptions{
+		title:      spreadSheetName,
+		options:    spreadSheetName,
+		sheetRange: sheetName,
+		form:       form,
+		previous:   state.Tabs[tab].UUIDs,
+	})
+	if err != nil {
+		return models.SheetDiff{}, err
+	}
+	defer prepared.close()
+
+	srv, err := e.getService(credentials)
+	if err != nil {
+		return models.SheetDiff{}, err
+	}
+	return diffPrepared(context.Background(), srv, spreadsheetId, sheetName, prepared, state.Tabs[tab].Rows, true)
+}
+
+// DryRunXLS prepares every selected sheet of the workbook like ImporterXLS does and compares it with its target tab.
+func (e *ExpImp) DryRunXLS(id int, credentials string, spreadSheetName string, spreadsheetId string, workbook Workbook, form *models.Form) ([]models.SheetDiff, error) {
+	ctx := context.Background()
+
+	tabs, err := prepareXLSTabs(id, spreadSheetName, workbook, nil, form)
+	if err != nil {
+		return nil, err
+	}
+	defer closeTabs(tabs)
+
+	state, err := e.state.GetJobState(id)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading job state: %w", err)
+	}
+
+	srv, err := e.getService(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	spreadSheet, err := srv.Spreadsheets.Get(spreadsheetId).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	for _, s := range spreadSheet.Sheets {
+		existing[s.Properties.Title] = true
+	}
+
+	sheetNames := make([]string, 0, len(tabs))
+	for sheetName := range tabs {
+		sheetNames = append(sheetNames, sheetName)
+	}
+	sort.Strings(sheetNames)
+
+	diffs := make([]models.SheetDiff, 0, len(sheetNames))
+	for _, sheetName := range sheetNames {
+		tab := tabs[sheetName]
+		if tab.deleted != nil {
+			tab.deleted.previous = state.Tabs[sheetName].UUIDs
+		}
+		diff, err := diffPrepared(ctx, srv, spreadsheetId, tab.sheetRange, tab.preparedRange, state.Tabs[sheetName].Rows, existing[tab.target])
+		if err != nil {
+			return nil, fmt.Errorf("sheet %s: %w", sheetName, err)
+		}
+		diffs = append(diffs, diff)
+	}
+
+	return diffs, nil
+}
+
+// diffPrepared compares prepared records with the range. Rows of deleted submissions are
+// read from the range like the importers do, and rows below the records count as removed
+// only when the write clears them: with the deleted option, up to the rows written before.
+func diffPrepared(ctx context.Context, srv *sheets.Service, spreadsheetId string, sheetRange string, prepared *preparedRange, previousRows int, existing bool) (models.SheetDiff, error) {
+	var current [][]string
+	if existing {
+		var err error
+		if prepared.deleted != nil && prepared.deleted.needsSheet() {
+			if err := prepared.addDeleted(ctx, srv, spreadsheetId, sheetRange); err != nil {
+				return models.SheetDiff{}, err
+			}
+		}
+		current, err = readValues(ctx, srv, spreadsheetId, sheetRange, "FORMATTED_VALUE")
+		if err != nil {
+			return models.SheetDiff{}, err
+		}
+	}
+
+	records, err := prepared.records.All()
+	if err != nil {
+		return models.SheetDiff{}, err
+	}
+	cleared := 0
+	if prepared.deleted != nil {
+		cleared = previousRows
+	}
+	return diffRecords(sheetRange, getStringNumber(sheetRange), current, plainRecords(records), cleared), nil
+}
+
+func readValues(ctx context.Context, srv *sheets.Service, spreadsheetId string, sheetRange string, render string) ([][]string, error) {
+	values, err := readRawValues(ctx, srv, spreadsheetId, sheetRange, render)
+	if err != nil {
+		return nil, err
+	}
+	return interfaceSliceToStringSlice(values), nil
+}
+
+func readRawValues(ctx context.Context, srv *sheets.Service, spreadsheetId string, sheetRange string, render string) ([][]interface{}, error) {
+	resp, err := srv.Spreadsheets.Values.Get(spreadsheetId, sheetRange).ValueRenderOption(render).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Values, nil
+}
+
+// diffRecords compares current sheet values with new records row by row.
+// firstRow is the sheet row number of the first record. Rows of current below the records
+// are removed up to index cleared, the write keeps rows after them.
+func diffRecords(sheetRange string, firstRow int, current [][]string, next [][]string, cleared int) models.SheetDiff {
+	diff := models.SheetDiff{Range: sheetRange}
+
+	for i := 0; i < len(next) || (i < len(current) && i < cleared); i++ {
+		var oldRow, newRow []string
+		if i < len(current) {
+			oldRow = trimRow(current[i])
+		}
+		if i < len(next) {
+			newRow = trimRow(next[i])
+		}
+
+		cells := diffCells(oldRow, newRow)
+		if len(cells) == 0 {
+			continue
+		}
+
+		rowDiff := models.RowDiff{Row: firstRow + i, Cells: cells}
+		switch {
+		case len(oldRow) == 0:
+			diff.Added = append(diff.Added, rowDiff)
+		case len(newRow) == 0:
+			diff.Removed = append(diff.Removed, rowDiff)
+		default:
+			diff.Changed = append(diff.Changed, rowDiff)
+		}
+	}
+
+	return diff
+}
+
+func diffCells(oldRow []string, newRow []string) []models.CellDiff {
+	var cells []models.CellDiff
+	for j := 0; j < len(oldRow) || j < len(newRow); j++ {
+		var oldValue, newValue string
+		if j < len(oldRow) {
+			oldValue = oldRow[j]
+		}
+		if j < len(newRow) {
+			newValue = newRow[j]
+		}
+		if oldValue != newValue {
+			cells = append(cells, models.CellDiff{Column: columnName(j), Old: oldValue, New: newValue})
+		}
+	}
+	return cells
+}
+
+// trimRow drops trailing empty cells, Sheets API does not return them.
+func trimRow(row []string) []string {
+	for len(row) > 0 && row[len(row)-1] == "" {
+		row = row[:len(row)-1]
+	}
+	return row
+}
+
+// columnName converts zero-based column index to A1 letters: 0 -> A, 26 -> AA.
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
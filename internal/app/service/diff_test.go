@@ -0,0 +1,49 @@
+package service
+
+import "testing"
+
+func TestColumnName(t *testing.T) {
+	tests := map[int]string{0: "A", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"}
+	for input, want := range tests {
+		if got := columnName(input); got != want {
+			t.Errorf("columnName(%d) = %s, want %s", input, got, want)
+		}
+	}
+}
+
+func TestDiffRecords(t *testing.T) {
+	current := [][]string{
+		{"name", "age"},
+		{"Frank", "25"},
+		{"John", "65"},
+		{"Lisa", "32"},
+	}
+	next := [][]string{
+		{"name", "age", ""},
+		{"Frank", "26"},
+		{"John", "65"},
+	}
+
+	diff := diffRecords("kobo!A10:XYZ", 10, current, next, len(current))
+
+	if len(diff.Added) != 0 || len(diff.Changed) != 1 || len(diff.Removed) != 1 {
+		t.Fatalf("unexpected diff: %+v", diff)
+	}
+	if diff.Changed[0].Row != 11 || diff.Changed[0].Cells[0].Column != "B" || diff.Changed[0].Cells[0].New != "26" {
+		t.Errorf("unexpected changed row: %+v", diff.Changed[0])
+	}
+	if diff.Removed[0].Row != 13 {
+		t.Errorf("unexpected removed row: %+v", diff.Removed[0])
+	}
+
+	// Без видалення рядки нижче записів лишаються на аркуші
+	diff = diffRecords("kobo!A10:XYZ", 10, current, next, 0)
+	if len(diff.Changed) != 1 || len(diff.Removed) != 0 {
+		t.Errorf("rows below the records are removed: %+v", diff)
+	}
+
+	diff = diffRecords("kobo", 1, nil, next, 0)
+	if len(diff.Added) != 3 {
+		t.Errorf("len(Added) = %d, want 3", len(diff.Added))
+	}
+}
@@ -0,0 +1,348 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultMainSheet is the main sheet name of a JSON export when the job has no sheet name.
+const defaultMainSheet = "main"
+
+// jsonPage is one page of the Kobo data API.
+type jsonPage struct {
+	Next    *string           `json:"next"`
+	Results []json.RawMessage `json:"results"`
+}
+
+// jsonField is a key and value of a JSON object, the order of keys is kept.
+type jsonField struct {
+	key   string
+	value json.RawMessage
+}
+
+// jsonCell is a value of a row before it is placed by column.
+type jsonCell struct {
+	column string
+	text   string
+}
+
+// jsonWorkbook collects rows by sheet. Columns keep the order of the previous export,
+// new ones are added in the order they are met.
+type jsonWorkbook struct {
+	order    []string
+	sheets   map[string]*jsonSheet
+	previous map[string][]string
+	// repeats are sheet names by repeat path, names are taken sheet names
+	repeats map[string]string
+	names   map[string]bool
+}
+
+// jsonSheet spools rows through Records, a row has the columns known when it was added.
+type jsonSheet struct {
+	columns []string
+	known   map[string]int
+	rows    *Records
+	count   int
+}
+
+// newJSONWorkbook returns a workbook with column orders and repeat sheet names of the
+// last written export. Names of repeats are taken even when they are not in this export.
+func newJSONWorkbook(previous map[string][]string, repeats map[string]string) *jsonWorkbook {
+	wb := &jsonWorkbook{sheets: make(map[string]*jsonSheet), previous: previous, repeats: make(map[string]string), names: make(map[string]bool)}
+	for path, name := range repeats {
+		wb.repeats[path] = name
+		wb.names[name] = true
+	}
+	return wb
+}
+
+// repeatParent links rows of a repeat to the row they belong to.
+type repeatParent struct {
+	table string
+	index int
+	uuid  string
+	id    string
+}
+
+// ExportJSON reads submissions from the Kobo data API (…/data/?format=json or data.json),
+// following pages. Submissions go to the main sheet named after the tab of sheetName,
+// every repeat group goes to its own sheet. Rows carry _index, and rows of a repeat also
+// _parent_index, _parent_table_name, _submission__uuid and _submission__id, like in Kobo XLS exports.
+// Column orders of the last written export are kept in the job state, so columns do not move
+// when submissions change. The caller must close the workbook.
+func (e *ExpImp) ExportJSON(id int, jsonLink string, token string, sheetName string, client *http.Client) (Workbook, error) {
+	mainSheet, _, _ := strings.Cut(sheetName, "!")
+	if mainSheet == "" {
+		mainSheet = defaultMainSheet
+	}
+
+	state, err := e.state.GetJobState(id)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading job state: %w", err)
+	}
+	wb := newJSONWorkbook(state.Columns, state.Repeats)
+	defer wb.close()
+	for link := jsonLink; link != ""; {
+		page, err := e.fetchJSONPage(link, token, client)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range page.Results {
+			submission, err := parseJSONObject(result)
+			if err != nil {
+				return nil, fmt.Errorf("error while decoding submission: %w", err)
+			}
+			if err := wb.add(mainSheet, submission, nil); err != nil {
+				return nil, err
+			}
+		}
+		link = ""
+		if page.Next != nil {
+			link = *page.Next
+		}
+	}
+
+	return wb.workbook()
+}
+
+func (e *ExpImp) fetchJSONPage(link string, token string, client *http.Client) (jsonPage, error) {
+	var page jsonPage
+	response, err := e.koboGet(link, token, client)
+	if err != nil {
+		return page, err
+	}
+	defer response.Body.Close()
+
+	if err := json.NewDecoder(response.Body).Decode(&page); err != nil {
+		return page, fmt.Errorf("error while decoding data page: %w", err)
+	}
+	return page, nil
+}
+
+// add puts the object to the sheet and its repeat groups to their own sheets.
+func (wb *jsonWorkbook) add(name string, object []jsonField, parent *repeatParent) error {
+	sheet, ok := wb.sheets[name]
+	if !ok {
+		sheet = &jsonSheet{known: make(map[string]int), rows: NewRecords()}
+		for _, column := range wb.previous[name] {
+			sheet.addColumn(column)
+		}
+		// Перший рядок Records — заголовок, його пишемо в кінці
+		if err := sheet.rows.Add(nil); err != nil {
+			return err
+		}
+		wb.sheets[name] = sheet
+		wb.order = append(wb.order, name)
+		wb.names[name] = true
+	}
+	sheet.count++
+	index := sheet.count
+
+	cells := make([]jsonCell, 0, len(object)+5)
+	var repeats []jsonField
+	uuid, id := "", ""
+	for _, field := range object {
+		if isRepeat(field) {
+			repeats = append(repeats, field)
+			continue
+		}
+		cell := jsonCell{column: field.key, text: jsonText(field.value)}
+		cells = append(cells, cell)
+		switch field.key {
+		case "_uuid":
+			uuid = cell.text
+		case "_id":
+			id = cell.text
+		}
+	}
+
+	cells = append(cells, jsonCell{column: "_index", text: strconv.Itoa(index)})
+	if parent != nil {
+		uuid, id = parent.uuid, parent.id
+		cells = append(cells,
+			jsonCell{column: "_parent_table_name", text: parent.table},
+			jsonCell{column: "_parent_index", text: strconv.Itoa(parent.index)},
+			jsonCell{column: "_submission__uuid", text: uuid})
+		if id != "" {
+			cells = append(cells, jsonCell{column: "_submission__id", text: id})
+		}
+	}
+	for _, cell := range cells {
+		sheet.addColumn(cell.column)
+	}
+	row := make([]string, len(sheet.columns))
+	for _, cell := range cells {
+		row[sheet.known[cell.column]] = cell.text
+	}
+	if err := sheet.rows.Add(row); err != nil {
+		return err
+	}
+
+	for _, repeat := range repeats {
+		var items []json.RawMessage
+		if err := json.Unmarshal(repeat.value, &items); err != nil {
+			return fmt.Errorf("error while decoding repeat %s: %w", repeat.key, err)
+		}
+		for _, item := range items {
+			fields, err := parseJSONObject(item)
+			if err != nil {
+				return fmt.Errorf("error while decoding repeat %s: %w", repeat.key, err)
+			}
+			if err := wb.add(wb.repeatSheet(repeat.key), fields, &repeatParent{table: name, index: index, uuid: uuid, id: id}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (sheet *jsonSheet) addColumn(column string) {
+	if _, ok := sheet.known[column]; !ok {
+		sheet.known[column] = len(sheet.columns)
+		sheet.columns = append(sheet.columns, column)
+	}
+}
+
+// workbook copies spooled rows of every sheet to new records after the header,
+// rows are padded to all columns. The caller must close the workbook.
+func (wb *jsonWorkbook) workbook() (Workbook, error) {
+	paths := make(map[string]string, len(wb.repeats))
+	for path, name := range wb.repeats {
+		paths[name] = path
+	}
+	workbook := make(Workbook, len(wb.sheets))
+	for _, name := range wb.order {
+		sheet := wb.sheets[name]
+		records := NewRecords()
+		workbook[name] = Sheet{Records: records, Columns: sheet.columns, Path: paths[name]}
+		err := sheet.rows.Each(func(i int, values []string) error {
+			if i == 0 {
+				return records.Add(sheet.columns)
+			}
+			row := make([]string, len(sheet.columns))
+			copy(row, values)
+			return records.Add(row)
+		})
+		if err != nil {
+			workbook.Close()
+			return nil, err
+		}
+	}
+	return workbook, nil
+}
+
+// close removes spool files of the sheets.
+func (wb *jsonWorkbook) close() {
+	for _, sheet := range wb.sheets {
+		if err := sheet.rows.Close(); err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Error("error while removing spool file")
+		}
+	}
+}
+
+// isRepeat reports whether the field is a repeat group: a list of objects that is not
+// a meta field like _attachments.
+func isRepeat(field jsonField) bool {
+	if strings.HasPrefix(field.key, "_") {
+		return false
+	}
+	value := bytes.TrimSpace(field.value)
+	if len(value) < 2 || value[0] != '[' {
+		return false
+	}
+	value = bytes.TrimSpace(value[1:])
+	return len(value) > 0 && (value[0] == '{' || value[0] == ']')
+}
+
+// repeatSheet returns the sheet name of the repeat group. It is the name from the last
+// written export, the last part of the path like in Kobo XLS exports, or the whole path
+// with "_" for "/" when another sheet has that name, so repeats with the same name
+// in different groups get their own sheets.
+func (wb *jsonWorkbook) repeatSheet(path string) string {
+	if name, ok := wb.repeats[path]; ok {
+		return name
+	}
+	name := repeatName(path)
+	if wb.names[name] {
+		name = strings.ReplaceAll(path, "/", "_")
+	}
+	for i, base := 2, name; wb.names[name]; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	wb.repeats[path] = name
+	wb.names[name] = true
+	return name
+}
+
+// repeatName returns the last part of the repeat path.
+func repeatName(key string) string {
+	if _, name, found := cutLast(key, "/"); found {
+		return name
+	}
+	return key
+}
+
+// jsonText converts a JSON value to cell text: strings as is, null as empty,
+// lists of simple values joined with spaces and other values as JSON.
+func jsonText(value json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s
+	}
+	value = bytes.TrimSpace(value)
+	if string(value) == "null" {
+		return ""
+	}
+	var list []interface{}
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	if err := dec.Decode(&list); err == nil {
+		parts := make([]string, 0, len(list))
+		for _, item := range list {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				return string(value)
+			}
+			parts = append(parts, fmt.Sprint(item))
+		}
+		return strings.Join(parts, " ")
+	}
+	return string(value)
+}
+
+// parseJSONObject decodes an object keeping the order of its keys.
+func parseJSONObject(data json.RawMessage) ([]jsonField, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return nil, fmt.Errorf("object expected")
+	}
+
+	var fields []jsonField
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return nil, fmt.Errorf("object key expected")
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, jsonField{key: key, value: value})
+	}
+	return fields, nil
+}
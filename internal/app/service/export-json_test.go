@@ -0,0 +1,173 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSONWorkbook(t *testing.T) {
+	submissions := []string{
+		`{"hh/name": "Frank", "hh/members": [{"hh/members/m_name": "Anna", "hh/members/pets": [{"hh/members/pets/kind": "cat"}]}, {"hh/members/m_name": "Ivan"}], "_uuid": "u1", "_geolocation": [50.45, 30.52], "_tags": []}`,
+		`{"hh/name": "John", "_uuid": "u2", "hh/members": [{"hh/members/m_name": "Olha", "hh/members/age": 7}], "_validation_status": {"uid": "validation_status_approved"}}`,
+	}
+
+	wb := newJSONWorkbook(nil, nil)
+	defer wb.close()
+	for _, s := range submissions {
+		fields, err := parseJSONObject(json.RawMessage(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wb.add("main", fields, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	workbook, err := wb.workbook()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer workbook.Close()
+
+	wantMain := [][]string{
+		{"hh/name", "_uuid", "_geolocation", "_tags", "_index", "_validation_status"},
+		{"Frank", "u1", "50.45 30.52", "", "1", ""},
+		{"John", "u2", "", "", "2", `{"uid": "validation_status_approved"}`},
+	}
+	if got := allRows(t, workbook["main"].Records); !reflect.DeepEqual(got, wantMain) {
+		t.Errorf("main = %q, want %q", got, wantMain)
+	}
+
+	wantMembers := [][]string{
+		{"hh/members/m_name", "_index", "_parent_table_name", "_parent_index", "_submission__uuid", "hh/members/age"},
+		{"Anna", "1", "main", "1", "u1", ""},
+		{"Ivan", "2", "main", "1", "u1", ""},
+		{"Olha", "3", "main", "2", "u2", "7"},
+	}
+	if got := allRows(t, workbook["members"].Records); !reflect.DeepEqual(got, wantMembers) {
+		t.Errorf("members = %q, want %q", got, wantMembers)
+	}
+
+	wantPets := [][]string{
+		{"hh/members/pets/kind", "_index", "_parent_table_name", "_parent_index", "_submission__uuid"},
+		{"cat", "1", "members", "1", "u1"},
+	}
+	if got := allRows(t, workbook["pets"].Records); !reflect.DeepEqual(got, wantPets) {
+		t.Errorf("pets = %q, want %q", got, wantPets)
+	}
+}
+
+func TestJSONWorkbookRepeatNames(t *testing.T) {
+	submissions := []string{
+		`{"a/items": [{"a/items/n": "1"}], "b/items": [{"b/items/n": "2"}], "_uuid": "u1"}`,
+		`{"b/items": [{"b/items/n": "3"}], "main": [{"main/x": "4"}], "_uuid": "u2"}`,
+	}
+
+	wb := newJSONWorkbook(nil, nil)
+	defer wb.close()
+	for _, s := range submissions {
+		fields, err := parseJSONObject(json.RawMessage(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wb.add("main", fields, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	workbook, err := wb.workbook()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer workbook.Close()
+
+	want := map[string][][]string{
+		"items": {
+			{"a/items/n", "_index", "_parent_table_name", "_parent_index", "_submission__uuid"},
+			{"1", "1", "main", "1", "u1"},
+		},
+		"b_items": {
+			{"b/items/n", "_index", "_parent_table_name", "_parent_index", "_submission__uuid"},
+			{"2", "1", "main", "1", "u1"},
+			{"3", "2", "main", "2", "u2"},
+		},
+		"main_2": {
+			{"main/x", "_index", "_parent_table_name", "_parent_index", "_submission__uuid"},
+			{"4", "1", "main", "2", "u2"},
+		},
+	}
+	for name, records := range want {
+		if got := allRows(t, workbook[name].Records); !reflect.DeepEqual(got, records) {
+			t.Errorf("%s = %q, want %q", name, got, records)
+		}
+	}
+}
+
+func TestJSONWorkbookPreviousColumns(t *testing.T) {
+	wb := newJSONWorkbook(map[string][]string{"main": {"_uuid", "age", "name"}}, nil)
+	defer wb.close()
+	for _, s := range []string{`{"name": "Frank", "_uuid": "u1"}`, `{"name": "John", "city": "Kyiv", "_uuid": "u2"}`} {
+		fields, err := parseJSONObject(json.RawMessage(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wb.add("main", fields, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	workbook, err := wb.workbook()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer workbook.Close()
+
+	// Колонки попереднього експорту лишаються на місці, нові — в кінці
+	want := [][]string{
+		{"_uuid", "age", "name", "_index", "city"},
+		{"u1", "", "Frank", "1", ""},
+		{"u2", "", "John", "2", "Kyiv"},
+	}
+	if got := allRows(t, workbook["main"].Records); !reflect.DeepEqual(got, want) {
+		t.Errorf("main = %q, want %q", got, want)
+	}
+}
+
+func TestJSONWorkbookRepeatNamesKept(t *testing.T) {
+	export := func(repeats map[string]string, submission string) Workbook {
+		t.Helper()
+		wb := newJSONWorkbook(nil, repeats)
+		defer wb.close()
+		fields, err := parseJSONObject(json.RawMessage(submission))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wb.add("main", fields, nil); err != nil {
+			t.Fatal(err)
+		}
+		workbook, err := wb.workbook()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return workbook
+	}
+
+	first := export(nil, `{"a/items": [{"a/items/n": "1"}], "b/items": [{"b/items/n": "2"}], "_uuid": "u1"}`)
+	defer first.Close()
+	repeats := make(map[string]string)
+	for name, sheet := range first {
+		if sheet.Path != "" {
+			repeats[sheet.Path] = name
+		}
+	}
+	if want := map[string]string{"a/items": "items", "b/items": "b_items"}; !reflect.DeepEqual(repeats, want) {
+		t.Fatalf("repeats = %v, want %v", repeats, want)
+	}
+
+	// Групи в іншому порядку лишаються на своїх аркушах
+	second := export(repeats, `{"b/items": [{"b/items/n": "3"}], "a/items": [{"a/items/n": "4"}], "_uuid": "u2"}`)
+	defer second.Close()
+	for name, column := range map[string]string{"items": "a/items/n", "b_items": "b/items/n"} {
+		if got := second[name].Records.Header(); len(got) == 0 || got[0] != column {
+			t.Errorf("%s header = %q, want %s first", name, got, column)
+		}
+	}
+}
@@ -2,40 +2,27 @@ package service
 
 import (
 	"fmt"
+	"github.com/rostis232/kobo2googlesheet-db/config"
 	"github.com/sirupsen/logrus"
 	"github.com/tealeg/xlsx/v3"
 	"io"
 	"net/http"
 	"os"
-	"strings"
+	"strconv"
+	"time"
 )
 
-func (e *ExpImp) ExportXLS(xlsLink string, token string, client *http.Client) (map[string][][]string, error) {
-	var allRecords = make(map[string][][]string)
+// ExportXLS reads every sheet of the workbook row by row into Records, so sheets over
+// config.MemoryLimit are spilled to disk. The caller must close the workbook.
+func (e *ExpImp) ExportXLS(xlsLink string, token string, client *http.Client) (Workbook, error) {
+	var allRecords = make(Workbook)
 
-	cutedLink, founded := strings.CutPrefix(xlsLink, "https://kobo.humanitarianresponse.info/")
-	if founded {
-		xlsLink = "https://eu.kobotoolbox.org/" + cutedLink
-		logrus.WithFields(logrus.Fields{"new_url": xlsLink}).Info("Founded old URL, changed to new domain")
-	}
-
-	request, err := http.NewRequest("GET", xlsLink, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	request.Header.Add("Authorization", "Token "+token)
-
-	response, err := client.Do(request)
+	response, err := e.koboGet(xlsLink, token, client)
 	if err != nil {
 		return nil, err
 	}
 	defer response.Body.Close()
 
-	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d %s", response.StatusCode, response.Status)
-	}
-
 	tempFile, err := os.CreateTemp("", "kobo-*.xlsx")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temp file: %w", err)
@@ -43,7 +30,8 @@ func (e *ExpImp) ExportXLS(xlsLink string, token string, client *http.Client) (m
 	defer os.Remove(tempFile.Name())
 	defer tempFile.Close()
 
-	if _, err := io.Copy(tempFile, response.Body); err != nil {
+	size, err := io.Copy(tempFile, response.Body)
+	if err != nil {
 		return nil, fmt.Errorf("failed to save response to temp file: %w", err)
 	}
 
@@ -51,7 +39,14 @@ func (e *ExpImp) ExportXLS(xlsLink string, token string, client *http.Client) (m
 		return nil, fmt.Errorf("failed to seek temp file: %w", err)
 	}
 
-	workbook, err := xlsx.OpenFile(tempFile.Name())
+	// Великі книги тримаємо в дисковому сховищі комірок
+	var options []xlsx.FileOption
+	if config.MemoryLimit > 0 && size > config.MemoryLimit {
+		logrus.WithFields(logrus.Fields{"size": size}).Info("Large workbook, cells are kept on disk")
+		options = append(options, xlsx.UseDiskVCellStore)
+	}
+
+	workbook, err := xlsx.OpenFile(tempFile.Name(), options...)
 	if err != nil {
 		return nil, err
 	}
@@ -64,29 +59,118 @@ func (e *ExpImp) ExportXLS(xlsLink string, token string, client *http.Client) (m
 	sheets := workbook.Sheets
 
 	for _, sheet := range sheets {
-		sheetRecords := [][]string{}
+		sheetRecords := NewRecords()
+		allRecords[sheet.Name] = Sheet{Records: sheetRecords}
+		sheetTypes := newTypeInference()
 
 		err = sheet.ForEachRow(func(row *xlsx.Row) error {
 			rowRecords := []string{}
+			rowTypes := []string{}
 
 			err = row.ForEachCell(func(cell *xlsx.Cell) error {
-				rowRecords = append(rowRecords, cell.String())
+				value, cellType := cellValue(cell, workbook.Date1904)
+				rowRecords = append(rowRecords, value)
+				rowTypes = append(rowTypes, cellType)
 				return nil
 			})
 			if err != nil {
 				return err
 			}
 
-			sheetRecords = append(sheetRecords, rowRecords)
-			return nil
+			if sheetRecords.Len() > 0 {
+				sheetTypes.add(rowTypes)
+			}
+			return sheetRecords.Add(rowRecords)
 		})
 
 		if err != nil {
-			return allRecords, err
+			allRecords.Close()
+			return nil, err
 		}
 
-		allRecords[sheet.Name] = sheetRecords
+		allRecords[sheet.Name] = Sheet{
+			Records: sheetRecords,
+			Types:   sheetTypes.types(sheetRecords.Header()),
+		}
 	}
 
 	return allRecords, nil
 }
+
+// cellValue returns the value of the cell in canonical form and its type.
+// Empty cells and cells of unknown type have no type.
+func cellValue(cell *xlsx.Cell, date1904 bool) (string, string) {
+	if cell.Value == "" {
+		return "", ""
+	}
+
+	switch cell.Type() {
+	case xlsx.CellTypeNumeric:
+		if cell.IsTime() {
+			t, err := cell.GetTime(date1904)
+			if err != nil {
+				break
+			}
+			if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+				return t.Format(time.DateOnly), typeDate
+			}
+			return t.Format("2006-01-02T15:04:05"), typeDateTime
+		}
+		if _, err := strconv.ParseFloat(cell.Value, 64); err == nil {
+			return cell.Value, typeNumber
+		}
+	case xlsx.CellTypeBool:
+		if cell.Bool() {
+			return "TRUE", typeBoolean
+		}
+		return "FALSE", typeBoolean
+	case xlsx.CellTypeString, xlsx.CellTypeInline:
+		return cell.String(), typeText
+	}
+
+	return cell.String(), ""
+}
+
+// typeInference infers column types from the types of data cells, row by row.
+type typeInference struct {
+	columns []string
+	mixed   []bool
+}
+
+func newTypeInference() *typeInference {
+	return &typeInference{}
+}
+
+// add takes cell types of a data row.
+func (t *typeInference) add(cellTypes []string) {
+	for len(t.columns) < len(cellTypes) {
+		t.columns = append(t.columns, "")
+		t.mixed = append(t.mixed, false)
+	}
+	for i, cellType := range cellTypes {
+		switch {
+		case cellType == "":
+		case t.columns[i] == "" || t.columns[i] == cellType:
+			t.columns[i] = cellType
+		case isDateType(t.columns[i]) && isDateType(cellType):
+			t.columns[i] = typeDateTime
+		default:
+			t.mixed[i] = true
+		}
+	}
+}
+
+// types returns the type of every column of the header whose data cells share one type.
+func (t *typeInference) types(header []string) map[string]string {
+	types := make(map[string]string)
+	for i, title := range header {
+		if i < len(t.columns) && t.columns[i] != "" && !t.mixed[i] {
+			types[title] = t.columns[i]
+		}
+	}
+	return types
+}
+
+func isDateType(columnType string) bool {
+	return columnType == typeDate || columnType == typeDateTime
+}
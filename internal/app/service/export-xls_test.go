@@ -0,0 +1,26 @@
+package service
+
+import "testing"
+
+func TestTypeInference(t *testing.T) {
+	header := []string{"start", "age", "name", "mixed", "empty"}
+	cellTypes := [][]string{
+		{typeDate, typeNumber, typeText, typeNumber, ""},
+		{typeDateTime, "", typeText, typeText, ""},
+	}
+
+	inference := newTypeInference()
+	for _, row := range cellTypes {
+		inference.add(row)
+	}
+	got := inference.types(header)
+	want := map[string]string{"start": typeDateTime, "age": typeNumber, "name": typeText}
+	if len(got) != len(want) {
+		t.Fatalf("types() = %v, want %v", got, want)
+	}
+	for title, columnType := range want {
+		if got[title] != columnType {
+			t.Errorf("%s: got %q, want %q", title, got[title], columnType)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"bufio"
 	"context"
 	b64 "encoding/base64"
 	"encoding/csv"
@@ -11,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/rostis232/kobo2googlesheet-db/internal/app/repository"
 	"github.com/rostis232/kobo2googlesheet-db/internal/models"
@@ -21,15 +23,31 @@ import (
 )
 
 type ExpImp struct {
-	repo     repository.Database
-	services map[string]*sheets.Service
-	mu       sync.RWMutex
+	repo      repository.Database
+	state     repository.State
+	snapshots repository.Snapshots
+	media     repository.Media
+	services  map[string]*sheets.Service
+	mu        sync.RWMutex
+	// links are Kobo links whose rewrite is already logged
+	links   map[string]bool
+	linksMu sync.Mutex
+	// assets are form schemas by asset URL
+	assets   map[string]cachedAsset
+	assetsMu sync.Mutex
+	// exportsMu guards updates of the export state shared by jobs
+	exportsMu sync.Mutex
 }
 
-func NewExpImp(repo repository.Database) *ExpImp {
+func NewExpImp(repo repository.Repository) *ExpImp {
 	return &ExpImp{
-		repo:     repo,
-		services: make(map[string]*sheets.Service),
+		repo:      repo.Database,
+		state:     repo.State,
+		snapshots: repo.Snapshots,
+		media:     repo.Media,
+		services:  make(map[string]*sheets.Service),
+		links:     make(map[string]bool),
+		assets:    make(map[string]cachedAsset),
 	}
 }
 
@@ -70,36 +88,32 @@ func (e *ExpImp) getService(credentials string) (*sheets.Service, error) {
 	return srv, nil
 }
 
-func (e *ExpImp) Export(csvLink string, token string, client *http.Client) ([][]string, error) {
-	var allRecords [][]string
+// headerBufferSize is enough for the header line of a wide form, the delimiter is detected in it.
+const headerBufferSize = 1 << 20
 
-	cutedLink, founded := strings.CutPrefix(csvLink, "https://kobo.humanitarianresponse.info/")
+// Export reads the CSV export row by row, rows over config.MemoryLimit are spilled to disk.
+// The caller must close the records.
+func (e *ExpImp) Export(csvLink string, token string, dialect CSVDialect, client *http.Client) (*Records, error) {
+	allRecords := NewRecords()
 
-	if founded {
-		csvLink = "https://eu.kobotoolbox.org/" + cutedLink
-		logrus.WithFields(logrus.Fields{"new_url": csvLink}).Info("Founded old URL, changed to new domain")
-	}
-
-	request, err := http.NewRequest("GET", csvLink, nil)
+	response, err := e.koboGet(csvLink, token, client)
 	if err != nil {
 		return nil, err
 	}
+	defer response.Body.Close()
 
-	request.Header.Add("Authorization", "Token "+token)
-
-	response, err := client.Do(request)
-	if err != nil {
+	body := bufio.NewReaderSize(response.Body, headerBufferSize)
+	if err := skipBOM(body); err != nil {
 		return nil, err
 	}
-	defer response.Body.Close()
-
-	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	if dialect.Comma == 0 {
+		dialect.Comma = detectDelimiter(body)
+		logrus.WithFields(logrus.Fields{"csv_link": csvLink, "delimiter": string(dialect.Comma)}).Debug("Detected CSV delimiter")
 	}
 
-	r := csv.NewReader(response.Body)
-	r.Comma = ';'
-	r.Comment = '#'
+	r := csv.NewReader(body)
+	r.Comma = dialect.Comma
+	r.Comment = dialect.Comment
 	r.FieldsPerRecord = -1
 
 	for {
@@ -108,31 +122,23 @@ func (e *ExpImp) Export(csvLink string, token string, client *http.Client) ([][]
 		if err == io.EOF {
 			break // Вийти з циклу, якщо файл закінчився
 		} else if err != nil {
+			allRecords.Close()
 			return nil, err // Повернути помилку, якщо сталася інша помилка
 		}
 
-		// Додати рядок до загального срізу
-		allRecords = append(allRecords, record)
+		// Додати рядок до загального набору
+		if err := allRecords.Add(record); err != nil {
+			allRecords.Close()
+			return nil, err
+		}
 	}
 
 	return allRecords, nil
 }
 
+// StringSliceToInterfaceSliceConverter converts records with the default sanitising policy.
 func (e *ExpImp) StringSliceToInterfaceSliceConverter(strs [][]string) [][]interface{} {
-	var result [][]interface{}
-	for _, row := range strs {
-		var interfaceRow []interface{}
-		for _, item := range row {
-			newItem := item
-			if strings.HasPrefix(item, "+") {
-				newItem = "'" + item
-			}
-
-			interfaceRow = append(interfaceRow, newItem)
-		}
-		result = append(result, interfaceRow)
-	}
-	return result
+	return e.convertValues(strs, writeOptions{})
 }
 
 func (e *ExpImp) StringMapToInterfaceMapConverter(strs map[string][][]string) map[string][][]interface{} {
@@ -143,56 +149,143 @@ func (e *ExpImp) StringMapToInterfaceMapConverter(strs map[string][][]string) ma
 	return result
 }
 
-func (e *ExpImp) Importer(credentials string, spreadSheetName string, spreadsheetId string, sheetName string, records [][]string) error {
-	var err error
-	var decr int = 1
-
+// Importer streams records through job options into a spool, so only the spool
+// and one chunk of request values are in memory when records are over config.MemoryLimit.
+func (e *ExpImp) Importer(id int, credentials string, spreadSheetName string, spreadsheetId string, sheetName string, records *Records, types map[string]string, form *models.Form) error {
 	if !strings.Contains(sheetName, "!") {
 		sheetName += "!A1:XYZ"
 	}
+	tab := getTabName(sheetName)
+	state, err := e.state.GetJobState(id)
+	if err != nil {
+		return fmt.Errorf("error while reading job state: %w", err)
+	}
 
-	numberOfRows := getStringNumber(sheetName)
-
-	if strings.Contains(spreadSheetName, " -wot") {
-		decr = 2
+	prepared, err := prepareRange(records, rangeOptions{
+		title:      spreadSheetName,
+		options:    spreadSheetName,
+		sheetRange: sheetName,
+		types:      types,
+		form:       form,
+		previous:   state.Tabs[tab].UUIDs,
+	})
+	if err != nil {
+		return err
 	}
+	defer prepared.close()
+	deleted := prepared.deleted
 
-	if strings.Contains(spreadSheetName, " -idx") {
-		logrus.WithFields(logrus.Fields{"spreadsheet_name": spreadSheetName}).Info("Founded -idx: changing index")
-		records, err = changingIndex(records, numberOfRows, decr)
+	ctx := context.Background()
+
+	// Рядки видалених у Kobo анкет беремо з аркуша
+	if deleted != nil && deleted.needsSheet() {
+		srv, err := e.getService(credentials)
 		if err != nil {
-			return fmt.Errorf("error while changing indexes: %s", err)
+			return err
+		}
+		if err := prepared.addDeleted(ctx, srv, spreadsheetId, sheetName); err != nil {
+			return err
 		}
 	}
 
-	if filter := getColumnFilterName(spreadSheetName); filter != "" {
-		records = filterRecords(records, filter)
+	hash, err := prepared.hash(sheetName + prepared.opts.hashKey() + getDeletedMode(spreadSheetName))
+	if err != nil {
+		return err
 	}
-
-	if strings.Contains(spreadSheetName, " -wot") {
-		records = records[1:]
-		logrus.WithFields(logrus.Fields{"spreadsheet_name": spreadSheetName}).Info("Founded -wot: deleted titles")
+	unchanged, err := e.isUnchanged(id, tab, hash)
+	if err != nil {
+		return err
+	}
+	if unchanged {
+		return ErrUnchanged
 	}
 
-	values := e.StringSliceToInterfaceSliceConverter(records)
+	if err := e.checkRowsCount(id, spreadSheetName, tab, prepared.records.Len()); err != nil {
+		return err
+	}
 
 	srv, err := e.getService(credentials)
 	if err != nil {
 		return err
 	}
 
-	row := &sheets.ValueRange{
-		Values: values,
+	if err := e.backup(ctx, srv, id, time.Now(), spreadSheetName, spreadsheetId, sheetName); err != nil {
+		return fmt.Errorf("error while making backup: %w", err)
 	}
 
-	_, err = srv.Spreadsheets.Values.Update(spreadsheetId, sheetName, row).ValueInputOption("USER_ENTERED").Context(context.Background()).Do()
-	if err != nil {
+	// Архів до запису, щоб рядки не загубились, якщо запис не вдасться;
+	// повторна спроба не архівує їх вдруге
+	if deleted != nil {
+		if err := e.archiveRows(ctx, srv, spreadsheetId, tab, prepared.header, deleted.archived, deleted.column); err != nil {
+			return err
+		}
+	}
+
+	prepared.opts.width = state.Tabs[tab].Width
+	if err := e.writePrepared(ctx, srv, spreadSheetName, spreadsheetId, sheetName, prepared, true); err != nil {
 		return err
 	}
 
+	if deleted != nil {
+		if err := clearBelow(ctx, srv, spreadsheetId, tab, getStringNumber(sheetName), prepared.records.Len(), state.Tabs[tab].Rows); err != nil {
+			return err
+		}
+	}
+
+	err = e.updateJobState(id, func(state *models.JobState) {
+		tabState := state.Tabs[tab]
+		tabState.Rows, tabState.Hash, tabState.Width = prepared.records.Len(), hash, prepared.width
+		if deleted != nil {
+			tabState.UUIDs = deleted.tracked()
+		}
+		state.Tabs[tab] = tabState
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"form_id": id, "error": err}).Error("error while saving job state")
+	}
+
 	return nil
 }
 
+// recordTransform applies -idx, filter and -wot options to the row with index i of the export.
+// The row is dropped when the second result is false.
+type recordTransform func(i int, row []string) ([]string, bool, error)
+
+// newRecordTransform returns the row by row version of prepareRecords for the normalized range.
+func newRecordTransform(spreadSheetName string, sheetRange string, header []string) recordTransform {
+	withoutTitles := strings.Contains(spreadSheetName, " -wot")
+	decr := 1
+	if withoutTitles {
+		decr = 2
+	}
+	numberOfRows := getStringNumber(sheetRange)
+
+	changeIndex := strings.Contains(spreadSheetName, " -idx")
+	if changeIndex {
+		logrus.WithFields(logrus.Fields{"spreadsheet_name": spreadSheetName}).Info("Founded -idx: changing index")
+	}
+	indexId := getIndexColumn(header)
+
+	var filterColumnID *int
+	if filter := getColumnFilterName(spreadSheetName); filter != "" {
+		filterColumnID = getFilterColumn(header, filter)
+	}
+
+	return func(i int, row []string) ([]string, bool, error) {
+		if i == 0 {
+			return row, !withoutTitles, nil
+		}
+		if changeIndex {
+			var err error
+			row, err = changeRowIndex(row, indexId, numberOfRows, decr)
+			if err != nil {
+				return nil, false, fmt.Errorf("error while changing indexes: %s", err)
+			}
+		}
+		return row, isRowSelected(row, filterColumnID), nil
+	}
+}
+
 // Sorter groups data by API Key
 func (e *ExpImp) Sorter(data []models.Data) map[string][]models.Data {
 	dataByAPIKey := make(map[string][]models.Data)
@@ -207,36 +300,50 @@ func (e *ExpImp) Sorter(data []models.Data) map[string][]models.Data {
 func changingIndex(input [][]string, numberOfRows int, decr int) ([][]string, error) {
 	inputCopy := make([][]string, len(input))
 
-	for i := range input {
-		inputCopy[i] = make([]string, len(input[i]))
-		copy(inputCopy[i], input[i])
+	indexId := 0
+	for rowId, cells := range input {
+		if rowId == 0 {
+			inputCopy[rowId] = append([]string(nil), cells...)
+			indexId = getIndexColumn(cells)
+			continue
+		}
+		row, err := changeRowIndex(cells, indexId, numberOfRows, decr)
+		if err != nil {
+			return inputCopy, err
+		}
+		inputCopy[rowId] = row
 	}
+	return inputCopy, nil
+}
 
+func getIndexColumn(header []string) int {
 	indexId := 0
-	for rowId, cells := range inputCopy {
-		for cellId, cellValue := range cells {
-			if rowId == 0 {
-				if cellValue == "_index" {
-					indexId = cellId
-				}
-			} else {
-				if indexId == 0 {
-					return inputCopy, fmt.Errorf("index column not found")
-				} else {
-					if cellId == indexId {
-						indexValueInd, err := strconv.Atoi(cellValue)
-						if err != nil {
-							return inputCopy, fmt.Errorf("error while converting string to ind")
-						}
-						strValue := strconv.Itoa(numberOfRows + indexValueInd - decr)
-
-						inputCopy[rowId][cellId] = strValue
-					}
-				}
-			}
+	for cellId, cellValue := range header {
+		if cellValue == "_index" {
+			indexId = cellId
 		}
 	}
-	return inputCopy, nil
+	return indexId
+}
+
+// changeRowIndex returns a copy of the row with _index shifted to the sheet row number.
+func changeRowIndex(row []string, indexId int, numberOfRows int, decr int) ([]string, error) {
+	if len(row) == 0 {
+		return row, nil
+	}
+	if indexId == 0 {
+		return row, fmt.Errorf("index column not found")
+	}
+
+	row = append([]string(nil), row...)
+	if indexId < len(row) {
+		indexValueInd, err := strconv.Atoi(row[indexId])
+		if err != nil {
+			return row, fmt.Errorf("error while converting string to ind")
+		}
+		row[indexId] = strconv.Itoa(numberOfRows + indexValueInd - decr)
+	}
+	return row, nil
 }
 
 func getStringNumber(sheetRange string) int {
@@ -274,24 +381,29 @@ func filterRecords(records [][]string, filter string) [][]string {
 
 	for rowNumber, row := range records {
 		if rowNumber == 0 {
-			var foundedFilterColumn int
-			for columnNumber, cell := range row {
-				if strings.Contains(cell, filter) {
-					foundedFilterColumn = columnNumber
-					filterColumnID = &foundedFilterColumn
-					break
-				}
-			}
+			filterColumnID = getFilterColumn(row, filter)
+			newRecords = append(newRecords, row)
+		} else if isRowSelected(row, filterColumnID) {
 			newRecords = append(newRecords, row)
-		} else {
-			if filterColumnID != nil {
-				if row[*filterColumnID] == "1" {
-					newRecords = append(newRecords, row)
-				}
-			} else {
-				newRecords = append(newRecords, row)
-			}
 		}
 	}
 	return newRecords
 }
+
+// getFilterColumn returns the first column whose title contains the filter, nil if there is none.
+func getFilterColumn(header []string, filter string) *int {
+	for columnNumber, cell := range header {
+		if strings.Contains(cell, filter) {
+			return &columnNumber
+		}
+	}
+	return nil
+}
+
+// isRowSelected keeps rows with "1" in the filter column, all rows without the column.
+func isRowSelected(row []string, filterColumnID *int) bool {
+	if filterColumnID == nil {
+		return true
+	}
+	return *filterColumnID < len(row) && row[*filterColumnID] == "1"
+}
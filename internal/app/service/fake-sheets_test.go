@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/app/repository"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+// testCredentials are credentials of the fake Sheets service in newTestExpImp.
+const testCredentials = "test"
+
+// fakeSheets is a Sheets API server with tabs of one spreadsheet in memory.
+type fakeSheets struct {
+	mu sync.Mutex
+	// tabs are values by tab title, order are titles in the tab order
+	tabs  map[string][][]string
+	order []string
+	ids   map[string]int64
+	// lastID is the id of the last added tab
+	lastID int64
+	// failWrites is the number of next value writes that fail
+	failWrites int
+	// requests are requests of spreadsheet batch updates
+	requests [][]*sheets.Request
+}
+
+func newFakeSheets(t *testing.T, order []string, tabs map[string][][]string) (*fakeSheets, *sheets.Service) {
+	t.Helper()
+	f := &fakeSheets{tabs: make(map[string][][]string), ids: make(map[string]int64)}
+	for _, title := range order {
+		f.addTab(title, len(f.order))
+		// Копія, щоб запис не змінював рядки, з якими тест порівнює
+		for _, row := range tabs[title] {
+			f.tabs[title] = append(f.tabs[title], append([]string(nil), row...))
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(server.Close)
+	srv, err := sheets.NewService(context.Background(), option.WithEndpoint(server.URL+"/"), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, srv
+}
+
+// newTestExpImp returns ExpImp with the service under testCredentials and job states in a temp dir.
+func newTestExpImp(t *testing.T, srv *sheets.Service) *ExpImp {
+	t.Helper()
+	state, err := repository.NewFileState(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewExpImp(repository.Repository{State: state})
+	e.services[testCredentials] = srv
+	return e
+}
+
+func (f *fakeSheets) addTab(title string, index int) {
+	f.lastID++
+	f.ids[title] = f.lastID
+	f.order = append(f.order, "")
+	copy(f.order[index+1:], f.order[index:])
+	f.order[index] = title
+}
+
+func (f *fakeSheets) moveTab(title string, index int) {
+	for i, t := range f.order {
+		if t == title {
+			f.order = append(f.order[:i], f.order[i+1:]...)
+			break
+		}
+	}
+	if index > len(f.order) {
+		index = len(f.order)
+	}
+	f.order = append(f.order, "")
+	copy(f.order[index+1:], f.order[index:])
+	f.order[index] = title
+}
+
+func (f *fakeSheets) titleOf(id int64) string {
+	for title, tabID := range f.ids {
+		if tabID == id {
+			return title
+		}
+	}
+	return ""
+}
+
+func (f *fakeSheets) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// шляхи: {id}, {id}:batchUpdate, {id}/values/{range}, {id}/values/{range}:append|:clear
+	_, rest, _ := strings.Cut(r.URL.Path, "/v4/spreadsheets/")
+	action := ""
+	for _, suffix := range []string{":batchUpdate", ":append", ":clear"} {
+		if strings.HasSuffix(rest, suffix) {
+			rest, action = strings.TrimSuffix(rest, suffix), suffix[1:]
+		}
+	}
+	_, a1, isValues := strings.Cut(rest, "/values/")
+	valuesBatch := action == "batchUpdate" && strings.HasSuffix(rest, "/values")
+
+	var response interface{} = struct{}{}
+	switch {
+	case !isValues && action == "" && r.Method == http.MethodGet:
+		spreadsheet := &sheets.Spreadsheet{}
+		for i, title := range f.order {
+			spreadsheet.Sheets = append(spreadsheet.Sheets, &sheets.Sheet{Properties: &sheets.SheetProperties{Title: title, SheetId: f.ids[title], Index: int64(i)}})
+		}
+		response = spreadsheet
+	case valuesBatch:
+		var request sheets.BatchUpdateValuesRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, data := range request.Data {
+			tab, row, _, _ := parseFakeRange(data.Range)
+			f.setCells(tab, row, interfaceSliceToStringSlice(data.Values))
+		}
+	case !isValues && action == "batchUpdate":
+		var request sheets.BatchUpdateSpreadsheetRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.requests = append(f.requests, request.Requests)
+		reply := &sheets.BatchUpdateSpreadsheetResponse{}
+		for _, req := range request.Requests {
+			reply.Replies = append(reply.Replies, &sheets.Response{})
+			switch {
+			case req.DuplicateSheet != nil:
+				title := req.DuplicateSheet.NewSheetName
+				f.addTab(title, len(f.order))
+				f.tabs[title] = append([][]string(nil), f.tabs[f.titleOf(req.DuplicateSheet.SourceSheetId)]...)
+				reply.Replies[len(reply.Replies)-1].DuplicateSheet = &sheets.DuplicateSheetResponse{
+					Properties: &sheets.SheetProperties{Title: title, SheetId: f.ids[title]},
+				}
+			case req.AddSheet != nil:
+				index := len(f.order)
+				if containsString(req.AddSheet.Properties.ForceSendFields, "Index") && int(req.AddSheet.Properties.Index) < index {
+					index = int(req.AddSheet.Properties.Index)
+				}
+				f.addTab(req.AddSheet.Properties.Title, index)
+			case req.UpdateSheetProperties != nil && strings.Contains(req.UpdateSheetProperties.Fields, "index"):
+				f.moveTab(f.titleOf(req.UpdateSheetProperties.Properties.SheetId), int(req.UpdateSheetProperties.Properties.Index))
+			case req.DeleteSheet != nil:
+				title := f.titleOf(req.DeleteSheet.SheetId)
+				f.moveTab(title, 0)
+				f.order = f.order[1:]
+				delete(f.tabs, title)
+				delete(f.ids, title)
+			}
+		}
+		response = reply
+	case isValues && action == "append":
+		var values sheets.ValueRange
+		if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tab := getTabName(a1)
+		f.tabs[tab] = append(trimRows(f.tabs[tab]), interfaceSliceToStringSlice(values.Values)...)
+	case isValues && action == "clear":
+		tab, row, _, last := parseFakeRange(a1)
+		for i := row - 1; i < last && i < len(f.tabs[tab]); i++ {
+			f.tabs[tab][i] = nil
+		}
+	case isValues && action == "" && r.Method == http.MethodPut:
+		if f.failWrites > 0 {
+			f.failWrites--
+			http.Error(w, `{"error": {"code": 400, "message": "write failed"}}`, http.StatusBadRequest)
+			return
+		}
+		var values sheets.ValueRange
+		if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tab, row, _, _ := parseFakeRange(a1)
+		f.setCells(tab, row, interfaceSliceToStringSlice(values.Values))
+	case isValues && action == "" && r.Method == http.MethodGet:
+		tab, row, column, _ := parseFakeRange(a1)
+		var values [][]interface{}
+		for i := row - 1; i < len(f.tabs[tab]); i++ {
+			cells := f.tabs[tab][i]
+			if column >= 0 {
+				cells = nil
+				if column < len(f.tabs[tab][i]) {
+					cells = f.tabs[tab][i][column : column+1]
+				}
+			}
+			row := stringsToInterfaces(cells)
+			// Без форматування числа приходять числами, як у Sheets API
+			if render := r.URL.Query().Get("valueRenderOption"); render != "" && render != "FORMATTED_VALUE" {
+				for i, cell := range cells {
+					if number, ok := enteredNumber(cell); ok {
+						row[i] = number
+					}
+				}
+			}
+			values = append(values, row)
+		}
+		response = &sheets.ValueRange{Range: a1, Values: trimValues(values)}
+	default:
+		http.Error(w, fmt.Sprintf("unexpected request %s %s", r.Method, r.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// setCells writes values from column A of the row, cells to the right of them are kept.
+func (f *fakeSheets) setCells(tab string, row int, values [][]string) {
+	for i, value := range values {
+		for len(f.tabs[tab]) < row+i {
+			f.tabs[tab] = append(f.tabs[tab], nil)
+		}
+		cells := f.tabs[tab][row-1+i]
+		if len(cells) < len(value) {
+			cells = append(cells, make([]string, len(value)-len(cells))...)
+		}
+		copy(cells, value)
+		f.tabs[tab][row-1+i] = cells
+	}
+}
+
+// parseFakeRange parses "'tab'!A10:XYZ", "tab!B:B" or "tab!A3:XYZ5" into the tab, the first row,
+// the column of a one column range or -1 and the last row.
+func parseFakeRange(a1 string) (string, int, int, int) {
+	tab := getTabName(a1)
+	_, cells, _ := strings.Cut(a1, "!")
+	start, end, _ := strings.Cut(cells, ":")
+	startColumn, row := splitCell(start)
+	endColumn, last := splitCell(end)
+	if row == 0 {
+		row = 1
+	}
+	if last == 0 {
+		last = 1 << 30
+	}
+	column := -1
+	if endColumn != "" && endColumn == startColumn {
+		column = 0
+		for _, letter := range startColumn {
+			column = column*26 + int(letter-'A') + 1
+		}
+		column--
+	}
+	return tab, row, column, last
+}
+
+func splitCell(cell string) (string, int) {
+	i := strings.IndexAny(cell, "0123456789")
+	if i < 0 {
+		return cell, 0
+	}
+	var row int
+	fmt.Sscan(cell[i:], &row)
+	return cell[:i], row
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return result
+}
+
+// trimValues drops trailing empty rows, Sheets API does not return them.
+func trimValues(values [][]interface{}) [][]interface{} {
+	for len(values) > 0 && len(values[len(values)-1]) == 0 {
+		values = values[:len(values)-1]
+	}
+	return values
+}
+
+func trimRows(rows [][]string) [][]string {
+	for len(rows) > 0 && len(trimRow(rows[len(rows)-1])) == 0 {
+		rows = rows[:len(rows)-1]
+	}
+	return rows
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+const (
+	selectOne      = "select_one"
+	selectMultiple = "select_multiple"
+)
+
+// formLabels replaces column titles with question labels (" -labels") and choice codes
+// with choice labels (" -choice-labels") in the language from " lang='uk'".
+// Columns are found by index in the export header, so it is applied after -idx and filter.
+type formLabels struct {
+	headers map[int]string
+	choices map[int]choiceLabels
+}
+
+type choiceLabels struct {
+	multiple bool
+	labels   map[string]string
+}
+
+// newFormLabels returns nil when the job has no label options or there is no form.
+func newFormLabels(spreadSheetName string, header []string, form *models.Form) *formLabels {
+	withHeaders := strings.Contains(spreadSheetName, " -labels")
+	withChoices := strings.Contains(spreadSheetName, " -choice-labels")
+	if form == nil || (!withHeaders && !withChoices) {
+		return nil
+	}
+
+	lang := getFormLanguage(spreadSheetName, form.Languages)
+	questions := questionsByColumn(form)
+	l := &formLabels{
+		headers: make(map[int]string),
+		choices: make(map[int]choiceLabels),
+	}
+
+	for i, title := range header {
+		q, ok := questions[title]
+		if !ok {
+			// Стовпці select_multiple виду "q/choice" від самого Kobo
+			parent, choice, found := cutLast(title, "/")
+			if p, isParent := questions[parent]; withHeaders && found && isParent && p.Type == selectMultiple {
+				l.headers[i] = labelOf(p.Name, p.Labels, lang) + "/" + choiceLabel(form.Choices[p.List], choice, lang)
+			}
+			continue
+		}
+
+		if withHeaders {
+			l.headers[i] = labelOf(q.Name, q.Labels, lang)
+		}
+		if withChoices && q.List != "" && (q.Type == selectOne || q.Type == selectMultiple) {
+			labels := make(map[string]string)
+			for _, c := range form.Choices[q.List] {
+				labels[c.Name] = labelOf(c.Name, c.Labels, lang)
+			}
+			l.choices[i] = choiceLabels{multiple: q.Type == selectMultiple, labels: labels}
+		}
+	}
+	return l
+}
+
+// apply returns a copy of the row with labels.
+func (l *formLabels) apply(row []string, isHeader bool) []string {
+	row = append([]string(nil), row...)
+	if isHeader {
+		for i, label := range l.headers {
+			if i < len(row) {
+				row[i] = label
+			}
+		}
+		return row
+	}
+
+	for i, choices := range l.choices {
+		if i >= len(row) || row[i] == "" {
+			continue
+		}
+		if !choices.multiple {
+			if label, ok := choices.labels[row[i]]; ok {
+				row[i] = label
+			}
+			continue
+		}
+		codes := strings.Fields(row[i])
+		for j, code := range codes {
+			if label, ok := choices.labels[code]; ok {
+				codes[j] = label
+			}
+		}
+		row[i] = strings.Join(codes, ", ")
+	}
+	return row
+}
+
+var langOption = regexp.MustCompile(` lang=["']([^"']*)["']`)
+
+// getFormLanguage returns the index of the language from " lang='uk'" in form languages.
+// The language matches by full name like "Ukrainian (uk)" or by the code in brackets.
+// It is 0, the default language, if not found.
+func getFormLanguage(spreadSheetName string, languages []string) int {
+	matches := langOption.FindStringSubmatch(spreadSheetName)
+	if len(matches) < 2 {
+		return 0
+	}
+	for i, language := range languages {
+		if strings.EqualFold(language, matches[1]) || strings.HasSuffix(strings.ToLower(language), "("+strings.ToLower(matches[1])+")") {
+			return i
+		}
+	}
+	return 0
+}
+
+// questionsByColumn indexes questions by $xpath and by name.
+func questionsByColumn(form *models.Form) map[string]models.Question {
+	questions := make(map[string]models.Question, 2*len(form.Questions))
+	for _, q := range form.Questions {
+		if _, ok := questions[q.Name]; !ok {
+			questions[q.Name] = q
+		}
+	}
+	for _, q := range form.Questions {
+		if q.XPath != "" {
+			questions[q.XPath] = q
+		}
+	}
+	return questions
+}
+
+func choiceLabel(choices []models.Choice, name string, lang int) string {
+	for _, c := range choices {
+		if c.Name == name {
+			return labelOf(c.Name, c.Labels, lang)
+		}
+	}
+	return name
+}
+
+// labelOf returns the label in the language, the name if there is none.
+func labelOf(name string, labels []string, lang int) string {
+	if lang < len(labels) && labels[lang] != "" {
+		return labels[lang]
+	}
+	return name
+}
+
+func cutLast(s string, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testAsset = `{"content": {
+	"translations": ["English (en)", "Ukrainian (uk)"],
+	"survey": [
+		{"type": "begin_group", "name": "grp_hh", "$xpath": "grp_hh"},
+		{"type": "select_one", "name": "q_12", "$xpath": "grp_hh/q_12", "select_from_list_name": "yes_no", "label": ["Has water?", "Є вода?"]},
+		{"type": "select_multiple yes_no", "name": "q_13", "$xpath": "grp_hh/q_13", "label": ["Sources", null]},
+		{"type": "calculate", "name": "score", "$xpath": "score"}
+	],
+	"choices": [
+		{"list_name": "yes_no", "name": "opt_1", "label": ["Yes", "Так"]},
+		{"list_name": "yes_no", "name": "opt_3", "label": ["No", "Ні"]}
+	]
+}}`
+
+func TestFormLabels(t *testing.T) {
+	var asset koboAsset
+	if err := json.Unmarshal([]byte(testAsset), &asset); err != nil {
+		t.Fatal(err)
+	}
+	form := asset.form()
+	if form.Questions[2].Type != selectMultiple || form.Questions[2].List != "yes_no" {
+		t.Errorf("old select type is not split: %+v", form.Questions[2])
+	}
+
+	records := [][]string{
+		{"grp_hh/q_12", "grp_hh/q_13", "grp_hh/q_13/opt_1", "score", "_id"},
+		{"opt_1", "opt_1 opt_3", "1", "5", "10"},
+	}
+
+	labels := newFormLabels("Report -labels -choice-labels lang='uk'", records[0], form)
+	got := [][]string{labels.apply(records[0], true), labels.apply(records[1], false)}
+	want := [][]string{
+		{"Є вода?", "q_13", "q_13/Так", "score", "_id"},
+		{"Так", "Так, Ні", "1", "5", "10"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("apply() = %q, want %q", got, want)
+	}
+	if records[1][0] != "opt_1" {
+		t.Error("labels changed the source records")
+	}
+
+	labels = newFormLabels("Report -labels", records[0], form)
+	if got := labels.apply(records[1], false); !reflect.DeepEqual(got, records[1]) {
+		t.Errorf("values are changed without -choice-labels: %q", got)
+	}
+
+	if newFormLabels("Report", records[0], form) != nil || newFormLabels("Report -labels", records[0], nil) != nil {
+		t.Error("labels without options or form")
+	}
+}
+
+func TestGetFormLanguage(t *testing.T) {
+	languages := []string{"English (en)", "Ukrainian (uk)"}
+	tests := []struct {
+		title string
+		want  int
+	}{
+		{"Report", 0},
+		{"Report lang='uk'", 1},
+		{"Report lang='Ukrainian (uk)'", 1},
+		{"Report lang='fr'", 0},
+	}
+	for _, tt := range tests {
+		if got := getFormLanguage(tt.title, languages); got != tt.want {
+			t.Errorf("getFormLanguage(%q) = %d, want %d", tt.title, got, tt.want)
+		}
+	}
+}
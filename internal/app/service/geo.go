@@ -0,0 +1,204 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+const (
+	geoPoint = "geopoint"
+	geoTrace = "geotrace"
+	geoShape = "geoshape"
+
+	shapesWKT   = "wkt"
+	shapesCount = "count"
+)
+
+// geoSuffixes are columns a geopoint is split into, like Kobo names them in CSV exports.
+var geoSuffixes = []string{"_latitude", "_longitude", "_altitude", "_precision"}
+
+var geoFlag = regexp.MustCompile(`(^| )-geo( |$)`)
+
+// geoColumns splits geopoint columns into latitude, longitude, altitude and precision
+// and replaces geotrace and geoshape values with WKT or the number of points
+// (" geo-shapes=wkt|count"). " -geo" takes columns from the form, " geo='loc,route:geotrace'"
+// lists them with the kind, geopoint if it is not set. " -keep-geo" keeps the source geopoint column.
+type geoColumns struct {
+	kinds  map[int]string
+	keep   bool
+	shapes string
+	// numeric are titles of columns with numbers only
+	numeric []string
+}
+
+var geoOption = regexp.MustCompile(` geo=["']([^"']*)["']`)
+
+// getGeoColumns parses " geo='loc,route:geotrace'" from the title into kinds by column.
+func getGeoColumns(title string) map[string]string {
+	matches := geoOption.FindStringSubmatch(title)
+	if len(matches) < 2 {
+		return nil
+	}
+	columns := make(map[string]string)
+	for _, pair := range strings.Split(matches[1], ",") {
+		column, kind, found := strings.Cut(pair, ":")
+		if column = strings.TrimSpace(column); column == "" {
+			continue
+		}
+		columns[column] = geoPoint
+		if found {
+			columns[column] = strings.TrimSpace(kind)
+		}
+	}
+	return columns
+}
+
+var geoShapesOption = regexp.MustCompile(` geo-shapes=([^ ]+)`)
+
+func getShapesOption(title string) string {
+	matches := geoShapesOption.FindStringSubmatch(title)
+	if len(matches) < 2 || matches[1] != shapesCount {
+		return shapesWKT
+	}
+	return shapesCount
+}
+
+// koboGeoColumn returns the name of a split geopoint column in Kobo exports:
+// "grp/loc" has "grp/_loc_latitude".
+func koboGeoColumn(title string, suffix string) string {
+	if group, name, found := cutLast(title, "/"); found {
+		return group + "/_" + name + suffix
+	}
+	return "_" + title + suffix
+}
+
+// newGeoColumns returns nil when the job has no geo options or no geo column.
+func newGeoColumns(spreadSheetName string, header []string, form *models.Form) *geoColumns {
+	listed := getGeoColumns(spreadSheetName)
+	if listed == nil && (form == nil || !geoFlag.MatchString(spreadSheetName)) {
+		return nil
+	}
+
+	var questions map[string]models.Question
+	if form != nil {
+		questions = questionsByColumn(form)
+	}
+	existing := make(map[string]bool, len(header))
+	for _, title := range header {
+		existing[title] = true
+	}
+
+	g := &geoColumns{
+		kinds:  make(map[int]string),
+		keep:   strings.Contains(spreadSheetName, " -keep-geo"),
+		shapes: getShapesOption(spreadSheetName),
+	}
+	for i, title := range header {
+		kind := listed[title]
+		if listed == nil {
+			kind = questions[title].Type
+		}
+		switch {
+		case kind == geoPoint:
+			// Kobo вже може мати стовпці з координатами в експорті
+			if existing[title+geoSuffixes[0]] || existing[koboGeoColumn(title, geoSuffixes[0])] {
+				continue
+			}
+			g.kinds[i] = kind
+			for _, suffix := range geoSuffixes {
+				g.numeric = append(g.numeric, title+suffix)
+			}
+		case kind == geoTrace || kind == geoShape:
+			g.kinds[i] = kind
+			if g.shapes == shapesCount {
+				g.numeric = append(g.numeric, title)
+			}
+		}
+	}
+	if len(g.kinds) == 0 {
+		return nil
+	}
+	return g
+}
+
+// expand returns the row with split geopoints and converted shapes.
+func (g *geoColumns) expand(row []string, isHeader bool) []string {
+	result := make([]string, 0, len(row)+3*len(g.kinds))
+	for i, value := range row {
+		kind, ok := g.kinds[i]
+		if !ok {
+			result = append(result, value)
+			continue
+		}
+
+		switch {
+		case kind == geoTrace || kind == geoShape:
+			if !isHeader {
+				value = g.convertShape(kind, value)
+			}
+			result = append(result, value)
+		case isHeader:
+			if g.keep {
+				result = append(result, value)
+			}
+			for _, suffix := range geoSuffixes {
+				result = append(result, value+suffix)
+			}
+		default:
+			if g.keep {
+				result = append(result, value)
+			}
+			result = append(result, splitGeopoint(value)...)
+		}
+	}
+	return result
+}
+
+// splitGeopoint splits "lat lon alt acc", missing or invalid parts are empty.
+func splitGeopoint(value string) []string {
+	parts := make([]string, len(geoSuffixes))
+	for i, field := range strings.Fields(value) {
+		if i >= len(parts) {
+			break
+		}
+		if _, err := strconv.ParseFloat(field, 64); err == nil {
+			parts[i] = field
+		}
+	}
+	return parts
+}
+
+func (g *geoColumns) convertShape(kind string, value string) string {
+	if value == "" {
+		return value
+	}
+	var points [][]string
+	for _, point := range strings.Split(value, ";") {
+		if fields := strings.Fields(point); len(fields) >= 2 {
+			points = append(points, fields[:2])
+		}
+	}
+	if g.shapes == shapesCount {
+		return strconv.Itoa(len(points))
+	}
+	if len(points) == 0 {
+		return ""
+	}
+
+	coordinates := make([]string, 0, len(points))
+	for _, p := range points {
+		// WKT має порядок "довгота широта"
+		coordinates = append(coordinates, p[1]+" "+p[0])
+	}
+	if kind == geoShape {
+		if coordinates[0] != coordinates[len(coordinates)-1] {
+			coordinates = append(coordinates, coordinates[0])
+		}
+		return fmt.Sprintf("POLYGON ((%s))", strings.Join(coordinates, ", "))
+	}
+	return fmt.Sprintf("LINESTRING (%s)", strings.Join(coordinates, ", "))
+}
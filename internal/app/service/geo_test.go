@@ -0,0 +1,58 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+func TestExpandGeo(t *testing.T) {
+	records := [][]string{
+		{"name", "loc", "route"},
+		{"Frank", "50.45 30.52 180 5", "50.1 30.1 0 0;50.2 30.2 0 0"},
+		{"John", "", ""},
+	}
+
+	got, opts := prepareRows(t, "Report geo='loc,route:geotrace'", records, nil)
+	want := [][]string{
+		{"name", "loc_latitude", "loc_longitude", "loc_altitude", "loc_precision", "route"},
+		{"Frank", "50.45", "30.52", "180", "5", "LINESTRING (30.1 50.1, 30.2 50.2)"},
+		{"John", "", "", "", "", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("prepared records = %q, want %q", got, want)
+	}
+	if numeric := boolIndexes(opts.numeric); numeric != "1,2,3,4" {
+		t.Errorf("numeric = %v", numeric)
+	}
+
+	got, opts = prepareRows(t, "Report geo='loc,route:geotrace' geo-shapes=count -keep-geo", records, nil)
+	if numeric := boolIndexes(opts.numeric); got[0][1] != "loc" || got[1][1] != records[1][1] || got[1][6] != "2" || numeric != "2,3,4,5,6" {
+		t.Errorf("prepared records with count and -keep-geo = %q, numeric %v", got, numeric)
+	}
+}
+
+func TestExpandGeoFromForm(t *testing.T) {
+	form := &models.Form{Questions: []models.Question{
+		{Type: geoPoint, Name: "loc", XPath: "grp/loc"},
+		{Type: geoShape, Name: "area", XPath: "grp/area"},
+	}}
+	records := [][]string{
+		{"grp/loc", "grp/_loc_latitude", "grp/area"},
+		{"50 30", "50", "1 2 0 0;1 3 0 0;2 3 0 0"},
+	}
+
+	got, _ := prepareRows(t, "Report -geo", records, form)
+	want := [][]string{
+		{"grp/loc", "grp/_loc_latitude", "grp/area"},
+		{"50 30", "50", "POLYGON ((2 1, 3 1, 3 2, 2 1))"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("prepared records = %q, want %q", got, want)
+	}
+
+	if got := koboGeoColumn("loc", "_longitude"); got != "_loc_longitude" {
+		t.Errorf("koboGeoColumn() = %q", got)
+	}
+}
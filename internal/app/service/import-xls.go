@@ -3,16 +3,63 @@ package service
 import (
 	"context"
 	"fmt"
+	"time"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"github.com/sirupsen/logrus"
 	"google.golang.org/api/sheets/v4"
 )
 
-func (e *ExpImp) ImporterXLS(credentials string, spreadsheetId string, records map[string][][]string) error {
-	var err error
+func (e *ExpImp) ImporterXLS(id int, credentials string, spreadSheetName string, spreadsheetId string, workbook Workbook, types map[string]string, form *models.Form) error {
+	tabs, err := prepareXLSTabs(id, spreadSheetName, workbook, types, form)
+	if err != nil {
+		return err
+	}
+	defer closeTabs(tabs)
 
-	values := e.StringMapToInterfaceMapConverter(records)
+	state, err := e.state.GetJobState(id)
+	if err != nil {
+		return fmt.Errorf("error while reading job state: %w", err)
+	}
 
 	ctx := context.Background()
 
+	// Аркуші без змін не оновлюємо
+	changed := make(map[string]xlsTab)
+	hashes := make(map[string]string)
+	for sheetName, tab := range tabs {
+		if tab.deleted != nil {
+			tab.deleted.previous = state.Tabs[sheetName].UUIDs
+			if tab.deleted.needsSheet() {
+				srv, err := e.getService(credentials)
+				if err != nil {
+					return err
+				}
+				if err := tab.addDeleted(ctx, srv, spreadsheetId, tab.sheetRange); err != nil {
+					return fmt.Errorf("sheet %s: %w", sheetName, err)
+				}
+			}
+		}
+		hash, err := tab.hash(tab.hashKey())
+		if err != nil {
+			return fmt.Errorf("sheet %s: %w", sheetName, err)
+		}
+		if state.Tabs[sheetName].Hash == hash {
+			continue
+		}
+		if err := e.checkRowsCount(id, spreadSheetName, sheetName, tab.records.Len()); err != nil {
+			return fmt.Errorf("sheet %s: %w", sheetName, err)
+		}
+		changed[sheetName] = tab
+		hashes[sheetName] = hash
+	}
+
+	vanished := getVanishedTabs(id, state, workbook)
+	if len(changed) == 0 && len(vanished) == 0 {
+		return ErrUnchanged
+	}
+
 	srv, err := e.getService(credentials)
 	if err != nil {
 		return err
@@ -23,25 +70,32 @@ func (e *ExpImp) ImporterXLS(credentials string, spreadsheetId string, records m
 		return err
 	}
 
-	for sheetName, sheetData := range values {
+	if err := removeTabs(ctx, srv, spreadSheet, vanished); err != nil {
+		return err
+	}
+
+	// Знімки всіх вкладок одного запуску мають спільний час
+	run := time.Now()
+	created := make(map[string]bool)
+	for sheetName, tab := range changed {
 		// Перевіряємо, чи існує аркуш
-		exists := false
+		var existing *sheets.SheetProperties
 		for _, s := range spreadSheet.Sheets {
-			if s.Properties.Title == sheetName {
-				exists = true
+			if s.Properties.Title == tab.target {
+				existing = s.Properties
 				break
 			}
 		}
 
+		properties, fields := tab.properties()
+
 		// Якщо аркуш не існує, створюємо новий
-		if !exists {
+		if existing == nil {
 			_, err = srv.Spreadsheets.BatchUpdate(spreadsheetId, &sheets.BatchUpdateSpreadsheetRequest{
 				Requests: []*sheets.Request{
 					{
 						AddSheet: &sheets.AddSheetRequest{
-							Properties: &sheets.SheetProperties{
-								Title: sheetName,
-							},
+							Properties: properties,
 						},
 					},
 				},
@@ -49,23 +103,147 @@ func (e *ExpImp) ImporterXLS(credentials string, spreadsheetId string, records m
 			if err != nil {
 				return fmt.Errorf("failed to add new spreadSheet: %s", err)
 			}
+			created[sheetName] = true
 			// Оновлюємо інформацію про таблицю після додавання аркуша
 			spreadSheet, err = srv.Spreadsheets.Get(spreadsheetId).Context(ctx).Do()
 			if err != nil {
 				return err
 			}
+		} else {
+			if err := e.backup(ctx, srv, id, run, spreadSheetName, spreadsheetId, tab.sheetRange); err != nil {
+				return fmt.Errorf("error while making backup of sheet %s: %w", sheetName, err)
+			}
+			if fields != "" {
+				properties.SheetId = existing.SheetId
+				properties.ForceSendFields = append(properties.ForceSendFields, "SheetId")
+				_, err = srv.Spreadsheets.BatchUpdate(spreadsheetId, &sheets.BatchUpdateSpreadsheetRequest{
+					Requests: []*sheets.Request{
+						{
+							UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+								Properties: properties,
+								Fields:     fields,
+							},
+						},
+					},
+				}).Context(ctx).Do()
+				if err != nil {
+					return fmt.Errorf("failed to update properties of sheet %s: %s", tab.target, err)
+				}
+			}
+		}
+
+		if tab.deleted != nil {
+			if err := e.archiveRows(ctx, srv, spreadsheetId, tab.target, tab.header, tab.deleted.archived, tab.deleted.column); err != nil {
+				return err
+			}
 		}
 
 		// Оновлюємо значення у визначеному діапазоні
-		row := &sheets.ValueRange{
-			Values: sheetData,
+		tab.opts.width = state.Tabs[sheetName].Width
+		if err := e.writePrepared(ctx, srv, spreadSheetName, spreadsheetId, tab.sheetRange, tab.preparedRange, existing != nil); err != nil {
+			return err
+		}
+		if tab.deleted != nil {
+			if err := clearBelow(ctx, srv, spreadsheetId, tab.target, getStringNumber(tab.sheetRange), tab.records.Len(), state.Tabs[sheetName].Rows); err != nil {
+				return err
+			}
 		}
+	}
 
-		_, err = srv.Spreadsheets.Values.Update(spreadsheetId, sheetName, row).ValueInputOption("USER_ENTERED").Context(ctx).Do()
+	// Порядок вкладок виставляємо одним запитом, вкладки без змін теж беруть участь
+	spreadSheet, err = srv.Spreadsheets.Get(spreadsheetId).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	if requests := orderTabs(spreadSheet, tabs); len(requests) > 0 {
+		_, err = srv.Spreadsheets.BatchUpdate(spreadsheetId, &sheets.BatchUpdateSpreadsheetRequest{Requests: requests}).Context(ctx).Do()
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to order tabs: %s", err)
 		}
 	}
 
+	err = e.updateJobState(id, func(state *models.JobState) {
+		for sheetName := range vanished {
+			delete(state.Tabs, sheetName)
+		}
+		for sheetName, tab := range changed {
+			tabState := state.Tabs[sheetName]
+			tabState.Rows, tabState.Hash, tabState.Width = tab.records.Len(), hashes[sheetName], tab.width
+			tabState.Target = tab.target
+			tabState.Created = tabState.Created || created[sheetName]
+			if tab.deleted != nil {
+				tabState.UUIDs = tab.deleted.tracked()
+			}
+			state.Tabs[sheetName] = tabState
+		}
+		// Порядок колонок і назви аркушів повторів JSON-експорту зберігаємо лише після запису
+		for sheetName := range tabs {
+			sheet := workbook[sheetName]
+			if sheet.Columns != nil {
+				if state.Columns == nil {
+					state.Columns = make(map[string][]string)
+				}
+				state.Columns[sheetName] = sheet.Columns
+			}
+			if sheet.Path != "" {
+				if state.Repeats == nil {
+					state.Repeats = make(map[string]string)
+				}
+				state.Repeats[sheet.Path] = sheetName
+			}
+		}
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"form_id": id, "error": err}).Error("error while saving job state")
+	}
+
+	if len(changed) == 0 {
+		return ErrUnchanged
+	}
+	return nil
+}
+
+// getVanishedTabs returns tabs created by the app whose source sheet is gone from the export,
+// when the job has remove-vanished in config. Keys are source sheet names, values are tab names.
+func getVanishedTabs(id int, state models.JobState, workbook Workbook) map[string]string {
+	vanished := make(map[string]string)
+	if !config.Jobs[id].RemoveVanished {
+		return vanished
+	}
+	for sheetName, tabState := range state.Tabs {
+		if _, ok := workbook[sheetName]; ok || !tabState.Created || tabState.Target == "" {
+			continue
+		}
+		vanished[sheetName] = tabState.Target
+	}
+	return vanished
+}
+
+func removeTabs(ctx context.Context, srv *sheets.Service, spreadSheet *sheets.Spreadsheet, tabs map[string]string) error {
+	var requests []*sheets.Request
+	for sheetName, target := range tabs {
+		for _, s := range spreadSheet.Sheets {
+			if s.Properties.Title != target {
+				continue
+			}
+			requests = append(requests, &sheets.Request{
+				DeleteSheet: &sheets.DeleteSheetRequest{
+					SheetId:         s.Properties.SheetId,
+					ForceSendFields: []string{"SheetId"},
+				},
+			})
+			logrus.WithFields(logrus.Fields{"sheet": sheetName, "tab": target}).Info("Source sheet is gone, removing tab")
+		}
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+
+	_, err := srv.Spreadsheets.BatchUpdate(spreadSheet.SpreadsheetId, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: requests,
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to remove tabs: %s", err)
+	}
 	return nil
 }
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+)
+
+func TestImporterXLSSavesColumnsAfterWrite(t *testing.T) {
+	fake, srv := newFakeSheets(t, []string{"main"}, map[string][][]string{"main": {{"a"}}})
+	e := newTestExpImp(t, srv)
+	workbook := workbookOf(t, map[string][][]string{"main": {{"b", "a"}, {"2", "1"}}})
+	defer workbook.Close()
+	sheet := workbook["main"]
+	sheet.Columns, sheet.Path = []string{"b", "a"}, "grp/main"
+	workbook["main"] = sheet
+
+	fake.failWrites = 1
+	if err := e.ImporterXLS(1, testCredentials, "Report", "sheet", workbook, nil, nil); err == nil {
+		t.Fatal("the failed write is not reported")
+	}
+	state, err := e.state.GetJobState(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Columns != nil || state.Repeats != nil {
+		t.Errorf("columns %v and repeats %v are saved after the failed write", state.Columns, state.Repeats)
+	}
+
+	if err := e.ImporterXLS(1, testCredentials, "Report", "sheet", workbook, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = e.state.GetJobState(1); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{"main": {"b", "a"}}; !reflect.DeepEqual(state.Columns, want) {
+		t.Errorf("columns = %v, want %v", state.Columns, want)
+	}
+	if want := map[string]string{"grp/main": "main"}; !reflect.DeepEqual(state.Repeats, want) {
+		t.Errorf("repeats = %v, want %v", state.Repeats, want)
+	}
+}
+
+func TestImporterXLSOrdersTabs(t *testing.T) {
+	first, second, third := 0, 1, 2
+	config.SetJobs([]config.JobConfig{
+		{
+			ID: 1,
+			Tabs: []config.TabConfig{
+				{Sheet: "a", Index: &first},
+				{Sheet: "b", Index: &second},
+				{Sheet: "c", Index: &third},
+			},
+		},
+	})
+	defer config.SetJobs(nil)
+
+	fake, srv := newFakeSheets(t, []string{"Notes", "c"}, map[string][][]string{"c": {{"c"}}})
+	e := newTestExpImp(t, srv)
+	rows := map[string][][]string{"a": {{"a"}, {"1"}}, "b": {{"b"}, {"1"}}, "c": {{"c"}, {"1"}}}
+	importWorkbook := func() {
+		t.Helper()
+		workbook := workbookOf(t, rows)
+		defer workbook.Close()
+		fake.requests = nil
+		if err := e.ImporterXLS(1, testCredentials, "Report", "sheet", workbook, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"a", "b", "c", "Notes"}; !reflect.DeepEqual(fake.order, want) {
+			t.Errorf("order = %v, want %v", fake.order, want)
+		}
+		batches := 0
+		for _, requests := range fake.requests {
+			for _, request := range requests {
+				if request.UpdateSheetProperties != nil && strings.Contains(request.UpdateSheetProperties.Fields, "index") {
+					batches++
+					break
+				}
+			}
+		}
+		if batches != 1 {
+			t.Errorf("index changes are sent in %d batches, want 1", batches)
+		}
+	}
+	importWorkbook()
+
+	// Змінюється лише "a", незмінені "b" і "c" теж повертаються на місце
+	fake.order = []string{"c", "Notes", "b", "a"}
+	rows["a"] = [][]string{{"a"}, {"2"}}
+	importWorkbook()
+}
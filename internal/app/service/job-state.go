@@ -0,0 +1,66 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+// ErrUnchanged is returned when records are the same as on the last successful write.
+// Nothing is written to the sheet in this case.
+var ErrUnchanged = errors.New("records are unchanged")
+
+// updateJobState reads the job state, applies update and saves it.
+func (e *ExpImp) updateJobState(id int, update func(state *models.JobState)) error {
+	state, err := e.state.GetJobState(id)
+	if err != nil {
+		return err
+	}
+	update(&state)
+	return e.state.SaveJobState(id, state)
+}
+
+// isUnchanged reports whether the hash is the same as on the last successful write to the tab.
+func (e *ExpImp) isUnchanged(id int, tab string, hash string) (bool, error) {
+	state, err := e.state.GetJobState(id)
+	if err != nil {
+		return false, fmt.Errorf("error while reading job state: %w", err)
+	}
+	return state.Tabs[tab].Hash == hash, nil
+}
+
+// hashRecords returns sha256 of the target range and records.
+func hashRecords(sheetRange string, records [][]string) string {
+	h := newRecordsHasher(sheetRange)
+	for _, record := range records {
+		h.add(record)
+	}
+	return h.sum()
+}
+
+// recordsHasher hashes records row by row, the result is the same as of hashRecords.
+type recordsHasher struct {
+	h hash.Hash
+	w *csv.Writer
+}
+
+func newRecordsHasher(sheetRange string) *recordsHasher {
+	h := sha256.New()
+	w := csv.NewWriter(h)
+	_ = w.Write([]string{sheetRange})
+	return &recordsHasher{h: h, w: w}
+}
+
+func (h *recordsHasher) add(record []string) {
+	_ = h.w.Write(record)
+}
+
+func (h *recordsHasher) sum() string {
+	h.w.Flush()
+	return hex.EncodeToString(h.h.Sum(nil))
+}
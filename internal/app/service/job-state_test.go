@@ -0,0 +1,17 @@
+package service
+
+import "testing"
+
+func TestHashRecords(t *testing.T) {
+	records := [][]string{{"name", "age"}, {"Frank", "25"}}
+
+	if hashRecords("kobo!A1:XYZ", records) != hashRecords("kobo!A1:XYZ", [][]string{{"name", "age"}, {"Frank", "25"}}) {
+		t.Error("hashes of equal records differ")
+	}
+	if hashRecords("kobo!A1:XYZ", records) == hashRecords("kobo!A2:XYZ", records) {
+		t.Error("hashes of different ranges are equal")
+	}
+	if hashRecords("kobo", [][]string{{"a,b"}}) == hashRecords("kobo", [][]string{{"a", "b"}}) {
+		t.Error("hashes of different records are equal")
+	}
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+type koboAsset struct {
+	Content koboContent `json:"content"`
+}
+
+type koboContent struct {
+	Survey  []koboQuestion `json:"survey"`
+	Choices []koboChoice   `json:"choices"`
+	// Translations are null for a form without languages.
+	Translations []*string `json:"translations"`
+}
+
+type koboQuestion struct {
+	Type               string    `json:"type"`
+	Name               string    `json:"name"`
+	XPath              string    `json:"$xpath"`
+	SelectFromListName string    `json:"select_from_list_name"`
+	Label              []*string `json:"label"`
+}
+
+type koboChoice struct {
+	ListName string    `json:"list_name"`
+	Name     string    `json:"name"`
+	Label    []*string `json:"label"`
+}
+
+// cachedAsset is a fetched asset with the time it was fetched.
+type cachedAsset struct {
+	asset   koboAsset
+	fetched time.Time
+}
+
+// getAssetURL returns the asset API URL from an export link like
+// https://eu.kobotoolbox.org/api/v2/assets/{uid}/export-settings/{es}/data.csv
+func getAssetURL(link string) (string, error) {
+	before, after, found := strings.Cut(link, "/api/v2/assets/")
+	if !found {
+		return "", fmt.Errorf("asset uid not found in link %s", link)
+	}
+	uid, _, _ := strings.Cut(after, "/")
+	if uid == "" {
+		return "", fmt.Errorf("asset uid not found in link %s", link)
+	}
+	return before + "/api/v2/assets/" + uid + "/", nil
+}
+
+// assetCacheKey keys cached assets by URL and token hash, so a token that cannot read
+// the asset does not get the schema fetched with another token.
+func assetCacheKey(assetURL string, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return assetURL + " " + hex.EncodeToString(sum[:])
+}
+
+// fetchAsset returns the asset of the export link. Assets are reused for config.AssetCacheTTL.
+func (e *ExpImp) fetchAsset(link string, token string, client *http.Client) (koboAsset, error) {
+	var asset koboAsset
+
+	assetURL, err := getAssetURL(link)
+	if err != nil {
+		return asset, err
+	}
+	key := assetCacheKey(assetURL, token)
+
+	e.assetsMu.Lock()
+	cached, ok := e.assets[key]
+	e.assetsMu.Unlock()
+	if ok && time.Since(cached.fetched) < config.AssetCacheTTL {
+		return cached.asset, nil
+	}
+
+	response, err := e.koboGet(assetURL+"?format=json", token, client)
+	if err != nil {
+		return asset, err
+	}
+	defer response.Body.Close()
+
+	if err := json.NewDecoder(response.Body).Decode(&asset); err != nil {
+		return asset, fmt.Errorf("error while decoding asset: %w", err)
+	}
+
+	e.assetsMu.Lock()
+	e.assets[key] = cachedAsset{asset: asset, fetched: time.Now()}
+	e.assetsMu.Unlock()
+
+	return asset, nil
+}
+
+// needsForm reports whether job options of the title use the form schema.
+func needsForm(spreadSheetName string) bool {
+	return strings.Contains(spreadSheetName, " -labels") || strings.Contains(spreadSheetName, " -choice-labels") ||
+		oneHotFlag.MatchString(spreadSheetName) || getOneHotColumns(spreadSheetName) != nil ||
+		geoFlag.MatchString(spreadSheetName) || mediaFlag.MatchString(spreadSheetName)
+}
+
+// Form returns the schema of the form when job options need it, nil otherwise
+// or when the schema cannot be fetched.
+func (e *ExpImp) Form(spreadSheetName string, link string, token string, client *http.Client) *models.Form {
+	if !needsForm(spreadSheetName) {
+		return nil
+	}
+	asset, err := e.fetchAsset(link, token, client)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"csv_link": link, "error": err}).Error("error while getting form schema, options using it are not applied")
+		return nil
+	}
+	return asset.form()
+}
+
+func (asset koboAsset) form() *models.Form {
+	form := &models.Form{
+		Languages: stringValues(asset.Content.Translations),
+		Choices:   make(map[string][]models.Choice),
+	}
+	for _, q := range asset.Content.Survey {
+		if q.Name == "" {
+			continue
+		}
+		// Старі форми мають список у типі: "select_one yes_no"
+		questionType, list := q.Type, q.SelectFromListName
+		if t, l, found := strings.Cut(q.Type, " "); found && list == "" {
+			questionType, list = t, l
+		}
+		form.Questions = append(form.Questions, models.Question{
+			Type:   questionType,
+			Name:   q.Name,
+			XPath:  q.XPath,
+			List:   list,
+			Labels: stringValues(q.Label),
+		})
+	}
+	for _, c := range asset.Content.Choices {
+		form.Choices[c.ListName] = append(form.Choices[c.ListName], models.Choice{
+			Name:   c.Name,
+			Labels: stringValues(c.Label),
+		})
+	}
+	return form
+}
+
+// stringValues replaces nulls of a JSON list with empty strings.
+func stringValues(values []*string) []string {
+	result := make([]string, len(values))
+	for i, value := range values {
+		if value != nil {
+			result[i] = *value
+		}
+	}
+	return result
+}
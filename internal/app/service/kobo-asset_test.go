@@ -0,0 +1,53 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/app/repository"
+)
+
+func TestGetAssetURL(t *testing.T) {
+	got, err := getAssetURL("https://eu.kobotoolbox.org/api/v2/assets/aHdZtSDEkewFXdwkPbkkEx/export-settings/esCXWYsrMLbkHjskiAYBehE/data.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://eu.kobotoolbox.org/api/v2/assets/aHdZtSDEkewFXdwkPbkkEx/"; got != want {
+		t.Errorf("getAssetURL() = %s, want %s", got, want)
+	}
+
+	if _, err := getAssetURL("https://example.com/data.csv"); err == nil {
+		t.Error("getAssetURL() without asset uid should fail")
+	}
+}
+
+func TestFetchAssetCachedByToken(t *testing.T) {
+	config.SetAssetCacheTTL(time.Hour)
+	defer config.SetAssetCacheTTL(0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token owner" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"content": {"survey": [{"type": "text", "name": "name", "$xpath": "name"}]}}`))
+	}))
+	defer server.Close()
+
+	e := NewExpImp(repository.Repository{})
+	link := server.URL + "/api/v2/assets/aBc123/export-settings/es1/data.csv"
+	asset, err := e.fetchAsset(link, "owner", server.Client())
+	if err != nil || len(asset.Content.Survey) != 1 {
+		t.Fatalf("fetchAsset() = %+v, %v", asset, err)
+	}
+	// Схема іншого користувача не видається з кешу
+	if _, err := e.fetchAsset(link, "stranger", server.Client()); err == nil {
+		t.Error("fetchAsset() returns the cached asset to a token that cannot read it")
+	}
+	if _, err := e.fetchAsset(link, "owner", server.Client()); err != nil {
+		t.Error(err)
+	}
+}
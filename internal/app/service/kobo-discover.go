@@ -0,0 +1,199 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	exportFormatCSV = "csv"
+	exportFormatXLS = "xls"
+
+	// exportSettingName is the name of export settings created by the app.
+	exportSettingName = "kobo2gs"
+)
+
+// koboList is one page of a Kobo API list.
+type koboList struct {
+	Next    *string           `json:"next"`
+	Results []json.RawMessage `json:"results"`
+}
+
+type koboAssetItem struct {
+	UID         string `json:"uid"`
+	Name        string `json:"name"`
+	AssetType   string `json:"asset_type"`
+	Active      bool   `json:"deployment__active"`
+	Submissions int    `json:"deployment__submission_count"`
+}
+
+type koboExportSetting struct {
+	UID            string `json:"uid"`
+	Name           string `json:"name"`
+	DataURLCSV     string `json:"data_url_csv"`
+	DataURLXLSX    string `json:"data_url_xlsx"`
+	ExportSettings struct {
+		Type string `json:"type"`
+	} `json:"export_settings"`
+}
+
+// newExportSettingRequest is the body of a new export setting, like the ones
+// the jobs expect: XML names, "/" group separator and all form versions.
+type newExportSettingRequest struct {
+	Name           string `json:"name"`
+	ExportSettings struct {
+		Type                  string   `json:"type"`
+		Lang                  string   `json:"lang"`
+		GroupSep              string   `json:"group_sep"`
+		HierarchyInLabels     bool     `json:"hierarchy_in_labels"`
+		MultipleSelect        string   `json:"multiple_select"`
+		FieldsFromAllVersions bool     `json:"fields_from_all_versions"`
+		Fields                []string `json:"fields"`
+	} `json:"export_settings"`
+}
+
+// koboServerURL returns the base URL of a Kobo server given as a host or a URL.
+func koboServerURL(server string) string {
+	server = strings.TrimRight(server, "/")
+	if !strings.Contains(server, "://") {
+		server = "https://" + server
+	}
+	return server
+}
+
+func toExportSetting(s koboExportSetting) models.ExportSetting {
+	return models.ExportSetting{
+		UID:     s.UID,
+		Name:    s.Name,
+		Type:    s.ExportSettings.Type,
+		CSVLink: s.DataURLCSV,
+		XLSLink: s.DataURLXLSX,
+	}
+}
+
+// ExportLink returns the link of the first export setting of the format, csv or xls.
+func ExportLink(settings []models.ExportSetting, format string) (string, bool) {
+	for _, s := range settings {
+		if s.Type != format {
+			continue
+		}
+		if format == exportFormatCSV && s.CSVLink != "" {
+			return s.CSVLink, true
+		}
+		if format == exportFormatXLS && s.XLSLink != "" {
+			return s.XLSLink, true
+		}
+	}
+	return "", false
+}
+
+// koboList reads all pages of a Kobo API list, decoding every result with decode.
+func (e *ExpImp) koboList(link string, token string, client *http.Client, decode func(json.RawMessage) error) error {
+	for link != "" {
+		response, err := e.koboGet(link, token, client)
+		if err != nil {
+			return err
+		}
+		var page koboList
+		err = json.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if err != nil {
+			return fmt.Errorf("error while decoding %s: %w", link, err)
+		}
+		for _, result := range page.Results {
+			if err := decode(result); err != nil {
+				return err
+			}
+		}
+		link = ""
+		if page.Next != nil {
+			link = *page.Next
+		}
+	}
+	return nil
+}
+
+// DiscoverAssets lists surveys of the token on the server with their export settings.
+// Only deployed surveys are listed unless all is true.
+func (e *ExpImp) DiscoverAssets(server string, token string, all bool, client *http.Client) ([]models.KoboAsset, error) {
+	base := koboServerURL(server)
+	var assets []models.KoboAsset
+	err := e.koboList(base+"/api/v2/assets/?format=json&limit=100&q="+url.QueryEscape("asset_type:survey"), token, client, func(raw json.RawMessage) error {
+		var item koboAssetItem
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return fmt.Errorf("error while decoding asset: %w", err)
+		}
+		if item.AssetType != "survey" || (!item.Active && !all) {
+			return nil
+		}
+		assets = append(assets, models.KoboAsset{UID: item.UID, Name: item.Name, Deployed: item.Active, Submissions: item.Submissions})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while listing assets: %w", err)
+	}
+
+	for i := range assets {
+		settings, err := e.exportSettings(base, assets[i].UID, token, client)
+		if err != nil {
+			return nil, err
+		}
+		assets[i].ExportSettings = settings
+	}
+	return assets, nil
+}
+
+func (e *ExpImp) exportSettings(base string, uid string, token string, client *http.Client) ([]models.ExportSetting, error) {
+	var settings []models.ExportSetting
+	err := e.koboList(base+"/api/v2/assets/"+uid+"/export-settings/?format=json", token, client, func(raw json.RawMessage) error {
+		var s koboExportSetting
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return fmt.Errorf("error while decoding export setting: %w", err)
+		}
+		settings = append(settings, toExportSetting(s))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while listing export settings of %s: %w", uid, err)
+	}
+	return settings, nil
+}
+
+// CreateExportSetting saves a new export setting of the format, csv or xls, for the asset.
+func (e *ExpImp) CreateExportSetting(server string, uid string, token string, format string, client *http.Client) (models.ExportSetting, error) {
+	if format != exportFormatCSV && format != exportFormatXLS {
+		return models.ExportSetting{}, fmt.Errorf("unknown export format %q", format)
+	}
+	var request newExportSettingRequest
+	request.Name = exportSettingName + " " + format
+	request.ExportSettings.Type = format
+	request.ExportSettings.Lang = "_xml"
+	request.ExportSettings.GroupSep = "/"
+	request.ExportSettings.MultipleSelect = "both"
+	request.ExportSettings.FieldsFromAllVersions = true
+	request.ExportSettings.Fields = []string{}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return models.ExportSetting{}, err
+	}
+
+	response, err := e.koboRequest(http.MethodPost, koboServerURL(server)+"/api/v2/assets/"+uid+"/export-settings/?format=json", token, bytes.NewReader(body), client)
+	if err != nil {
+		return models.ExportSetting{}, fmt.Errorf("error while creating export setting of %s: %w", uid, err)
+	}
+	defer response.Body.Close()
+
+	var created koboExportSetting
+	if err := json.NewDecoder(response.Body).Decode(&created); err != nil {
+		return models.ExportSetting{}, fmt.Errorf("error while decoding export setting: %w", err)
+	}
+	logrus.WithFields(logrus.Fields{"asset": uid, "export_setting": created.UID, "format": format}).Info("Export setting is created")
+	return toExportSetting(created), nil
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+func TestKoboServerURL(t *testing.T) {
+	tests := map[string]string{
+		"eu.kobotoolbox.org":          "https://eu.kobotoolbox.org",
+		"http://127.0.0.1:8000/":      "http://127.0.0.1:8000",
+		"https://kf.kobotoolbox.org/": "https://kf.kobotoolbox.org",
+	}
+	for server, want := range tests {
+		if got := koboServerURL(server); got != want {
+			t.Errorf("koboServerURL(%q) = %q, want %q", server, got, want)
+		}
+	}
+}
+
+func TestExportLink(t *testing.T) {
+	var s koboExportSetting
+	raw := `{"uid": "es1", "name": "Main", "data_url_csv": "https://x/api/v2/assets/a1/export-settings/es1/data.csv",
+		"data_url_xlsx": "https://x/api/v2/assets/a1/export-settings/es1/data.xlsx", "export_settings": {"type": "xls"}}`
+	if err := json.Unmarshal([]byte(raw), &s); err != nil {
+		t.Fatal(err)
+	}
+	settings := []models.ExportSetting{toExportSetting(s)}
+
+	if link, ok := ExportLink(settings, exportFormatXLS); !ok || link != s.DataURLXLSX {
+		t.Errorf("ExportLink(xls) = %q, %v", link, ok)
+	}
+	if _, ok := ExportLink(settings, exportFormatCSV); ok {
+		t.Error("ExportLink(csv) returns the link of an xls setting")
+	}
+}
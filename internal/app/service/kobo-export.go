@@ -0,0 +1,272 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	exportComplete = "complete"
+	exportError    = "error"
+
+	exportPollFirst = 2 * time.Second
+	exportPollMax   = 30 * time.Second
+)
+
+// koboExport is an export task of the Kobo API.
+type koboExport struct {
+	UID      string          `json:"uid"`
+	URL      string          `json:"url"`
+	Status   string          `json:"status"`
+	Result   string          `json:"result"`
+	Messages json.RawMessage `json:"messages"`
+}
+
+// exportTaskRequest is the body of a new export task.
+type exportTaskRequest struct {
+	Type                  string   `json:"type"`
+	Lang                  string   `json:"lang"`
+	GroupSep              string   `json:"group_sep"`
+	HierarchyInLabels     bool     `json:"hierarchy_in_labels"`
+	MultipleSelect        string   `json:"multiple_select"`
+	FieldsFromAllVersions bool     `json:"fields_from_all_versions"`
+	Fields                []string `json:"fields"`
+}
+
+// newExportTaskRequest fills the request from the job config with defaults for empty values.
+func newExportTaskRequest(cfg config.ExportTask) exportTaskRequest {
+	request := exportTaskRequest{
+		Type:                  cfg.Type,
+		Lang:                  cfg.Lang,
+		GroupSep:              cfg.GroupSep,
+		HierarchyInLabels:     cfg.HierarchyInLabels,
+		MultipleSelect:        cfg.MultipleSelect,
+		FieldsFromAllVersions: !cfg.LatestVersion,
+		Fields:                cfg.Fields,
+	}
+	switch request.Type {
+	case "":
+		request.Type = exportFormatCSV
+	case "xlsx":
+		request.Type = exportFormatXLS
+	}
+	if request.Lang == "" {
+		request.Lang = "_xml"
+	}
+	if request.GroupSep == "" {
+		request.GroupSep = "/"
+	}
+	if request.MultipleSelect == "" {
+		request.MultipleSelect = "both"
+	}
+	if request.Fields == nil {
+		request.Fields = []string{}
+	}
+	return request
+}
+
+// ExportTaskType returns the type of the export created on demand for the job, empty if there is none.
+func ExportTaskType(id int) string {
+	cfg := config.Jobs[id].Export
+	if cfg == nil {
+		return ""
+	}
+	return newExportTaskRequest(*cfg).Type
+}
+
+// ExportTaskKey identifies parameters of the export of the job, jobs with the same key
+// can share the export. It is empty when the job has no export task.
+func ExportTaskKey(id int) string {
+	cfg := config.Jobs[id].Export
+	if cfg == nil {
+		return ""
+	}
+	key, _ := json.Marshal(newExportTaskRequest(*cfg))
+	return string(key)
+}
+
+// exportPollDelay doubles the delay between status requests up to exportPollMax.
+func exportPollDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > exportPollMax {
+		return exportPollMax
+	}
+	return delay
+}
+
+// withJSONFormat adds format=json to the link.
+func withJSONFormat(link string) string {
+	if strings.Contains(link, "format=") {
+		return link
+	}
+	if strings.Contains(link, "?") {
+		return link + "&format=json"
+	}
+	return link + "?format=json"
+}
+
+// CreateExport creates a Kobo export of the asset of the link with parameters of the job config,
+// waits until it is complete and returns the link of the file. Exports are kept in the export
+// state by asset and parameters as soon as they are created, so jobs sharing them track them too.
+// The ones over config.ExportKeep are deleted, a failed export is deleted at once.
+func (e *ExpImp) CreateExport(id int, link string, token string, client *http.Client) (string, error) {
+	cfg := config.Jobs[id].Export
+	if cfg == nil {
+		return "", fmt.Errorf("export task of form %d is not configured", id)
+	}
+	assetURL, err := getAssetURL(link)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(newExportTaskRequest(*cfg))
+	if err != nil {
+		return "", err
+	}
+
+	response, err := e.koboRequest(http.MethodPost, assetURL+"exports/?format=json", token, bytes.NewReader(body), client)
+	if err != nil {
+		return "", fmt.Errorf("error while creating export: %w", err)
+	}
+	var export koboExport
+	err = json.NewDecoder(response.Body).Decode(&export)
+	response.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("error while decoding export: %w", err)
+	}
+	if export.URL == "" {
+		export.URL = assetURL + "exports/" + export.UID + "/"
+	}
+	logrus.WithFields(logrus.Fields{"form_id": id, "export": export.URL}).Info("Export is created")
+
+	// Зберігається до очікування, щоб експорт видалився і після зупинки процесу
+	key := exportStateKey(assetURL, ExportTaskKey(id))
+	err = e.updateExportState(func(state *models.ExportState) {
+		state.Exports[key] = append(state.Exports[key], export.URL)
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"form_id": id, "error": err}).Error("error while saving export state")
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = config.ExportTimeout
+	}
+	export, err = e.waitExport(export, token, timeout, client)
+	if err != nil {
+		e.deleteExport(export.URL, token, client)
+		e.forgetExport(key, export.URL)
+		return "", err
+	}
+
+	var stale []string
+	err = e.updateExportState(func(state *models.ExportState) {
+		if over := len(state.Exports[key]) - config.ExportKeep; over > 0 {
+			stale = append(stale, state.Exports[key][:over]...)
+			state.Exports[key] = append([]string(nil), state.Exports[key][over:]...)
+		}
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"form_id": id, "error": err}).Error("error while saving export state")
+	}
+	for _, old := range stale {
+		e.deleteExport(old, token, client)
+	}
+	return export.Result, nil
+}
+
+// exportStateKey identifies exports of the asset with the same parameters in the export state.
+func exportStateKey(assetURL string, taskKey string) string {
+	sum := sha256.Sum256([]byte(taskKey))
+	return assetURL + " " + hex.EncodeToString(sum[:])
+}
+
+// updateExportState reads the export state, applies update and saves it.
+func (e *ExpImp) updateExportState(update func(state *models.ExportState)) error {
+	e.exportsMu.Lock()
+	defer e.exportsMu.Unlock()
+
+	state, err := e.state.GetExportState()
+	if err != nil {
+		return err
+	}
+	update(&state)
+	return e.state.SaveExportState(state)
+}
+
+// forgetExport removes a deleted export from the export state.
+func (e *ExpImp) forgetExport(key string, link string) {
+	err := e.updateExportState(func(state *models.ExportState) {
+		var kept []string
+		for _, tracked := range state.Exports[key] {
+			if tracked != link {
+				kept = append(kept, tracked)
+			}
+		}
+		if len(kept) == 0 {
+			delete(state.Exports, key)
+			return
+		}
+		state.Exports[key] = kept
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Error("error while saving export state")
+	}
+}
+
+// waitExport polls the export until it is complete, failed or the timeout is over.
+func (e *ExpImp) waitExport(export koboExport, token string, timeout time.Duration, client *http.Client) (koboExport, error) {
+	deadline := time.Now().Add(timeout)
+	for delay := exportPollFirst; ; delay = exportPollDelay(delay) {
+		switch export.Status {
+		case exportComplete:
+			if export.Result == "" {
+				return export, fmt.Errorf("export %s is complete without result", export.UID)
+			}
+			return export, nil
+		case exportError:
+			return export, fmt.Errorf("export %s failed: %s", export.UID, export.Messages)
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return export, fmt.Errorf("export %s is not complete after %s, status %q", export.UID, timeout, export.Status)
+		}
+		if delay > left {
+			delay = left
+		}
+		time.Sleep(delay)
+
+		response, err := e.koboGet(withJSONFormat(export.URL), token, client)
+		if err != nil {
+			return export, fmt.Errorf("error while checking export: %w", err)
+		}
+		var current koboExport
+		err = json.NewDecoder(response.Body).Decode(&current)
+		response.Body.Close()
+		if err != nil {
+			return export, fmt.Errorf("error while decoding export: %w", err)
+		}
+		current.URL = export.URL
+		export = current
+	}
+}
+
+// deleteExport removes the export from Kobo, errors are only logged.
+func (e *ExpImp) deleteExport(link string, token string, client *http.Client) {
+	response, err := e.koboRequest(http.MethodDelete, link, token, nil, client)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"export": link, "error": err}).Warn("error while deleting export")
+		return
+	}
+	response.Body.Close()
+	logrus.WithFields(logrus.Fields{"export": link}).Debug("Export is deleted")
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/app/repository"
+)
+
+func TestNewExportTaskRequest(t *testing.T) {
+	got := newExportTaskRequest(config.ExportTask{})
+	want := exportTaskRequest{Type: "csv", Lang: "_xml", GroupSep: "/", MultipleSelect: "both", FieldsFromAllVersions: true, Fields: []string{}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("newExportTaskRequest() = %+v, want %+v", got, want)
+	}
+
+	got = newExportTaskRequest(config.ExportTask{Type: "xlsx", Lang: "English (en)", GroupSep: ".", LatestVersion: true, Fields: []string{"grp/name"}})
+	want = exportTaskRequest{Type: "xls", Lang: "English (en)", GroupSep: ".", MultipleSelect: "both", Fields: []string{"grp/name"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("newExportTaskRequest() = %+v, want %+v", got, want)
+	}
+}
+
+func TestExportPollDelay(t *testing.T) {
+	delay := exportPollFirst
+	for i := 0; i < 10; i++ {
+		delay = exportPollDelay(delay)
+	}
+	if delay != exportPollMax {
+		t.Errorf("exportPollDelay() = %s, want %s", delay, exportPollMax)
+	}
+	if got := exportPollDelay(2 * time.Second); got != 4*time.Second {
+		t.Errorf("exportPollDelay(2s) = %s", got)
+	}
+}
+
+func TestWithJSONFormat(t *testing.T) {
+	tests := map[string]string{
+		"https://x/api/v2/assets/a1/exports/e1/":          "https://x/api/v2/assets/a1/exports/e1/?format=json",
+		"https://x/api/v2/assets/a1/exports/e1/?a=b":      "https://x/api/v2/assets/a1/exports/e1/?a=b&format=json",
+		"https://x/api/v2/assets/a1/exports/?format=json": "https://x/api/v2/assets/a1/exports/?format=json",
+	}
+	for link, want := range tests {
+		if got := withJSONFormat(link); got != want {
+			t.Errorf("withJSONFormat(%q) = %q, want %q", link, got, want)
+		}
+	}
+}
+
+func TestCreateExportTrackedByTask(t *testing.T) {
+	config.SetJobs([]config.JobConfig{
+		{ID: 1, Export: &config.ExportTask{Type: "csv"}},
+		{ID: 2, Export: &config.ExportTask{Type: "csv"}},
+		{ID: 3, Export: &config.ExportTask{Type: "csv", Timeout: 10 * time.Millisecond}},
+	})
+	defer config.SetJobs(nil)
+	config.SetExports(time.Minute, 1)
+	defer config.SetExports(0, 0)
+
+	state, err := repository.NewFileState(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewExpImp(repository.Repository{State: state})
+	tracked := func() []string {
+		exports, err := state.GetExportState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, links := range exports.Exports {
+			return links
+		}
+		return nil
+	}
+	var (
+		created       int
+		status        = exportComplete
+		trackedOnWait bool
+		deleted       []string
+		server        *httptest.Server
+	)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			created++
+			fmt.Fprintf(w, `{"uid": "e%d", "url": "%s/api/v2/assets/aBc123/exports/e%d/", "status": %q, "result": "%s/e%d.csv"}`,
+				created, server.URL, created, status, server.URL, created)
+		case http.MethodGet:
+			// Експорт уже в стані, поки його чекають
+			trackedOnWait = containsString(tracked(), server.URL+r.URL.Path)
+			fmt.Fprint(w, `{"status": "processing"}`)
+		case http.MethodDelete:
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/api/v2/assets/aBc123/exports/"))
+		}
+	}))
+	defer server.Close()
+	link := server.URL + "/api/v2/assets/aBc123/export-settings/es1/data.csv"
+	exportURL := func(n int) string { return fmt.Sprintf("%s/api/v2/assets/aBc123/exports/e%d/", server.URL, n) }
+
+	if _, err := e.CreateExport(1, link, "token", server.Client()); err != nil {
+		t.Fatal(err)
+	}
+	// Експорт іншого завдання з тими ж параметрами замінює експорт першого
+	if _, err := e.CreateExport(2, link, "token", server.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{exportURL(2)}; !reflect.DeepEqual(tracked(), want) {
+		t.Errorf("exports = %v, want %v", tracked(), want)
+	}
+	if want := []string{"e1/"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted = %v, want %v", deleted, want)
+	}
+
+	status = "processing"
+	if _, err := e.CreateExport(3, link, "token", server.Client()); err == nil {
+		t.Fatal("an incomplete export is not reported")
+	}
+	if !trackedOnWait {
+		t.Error("the export is not in the export state while it is waited for")
+	}
+	if want := []string{exportURL(2)}; !reflect.DeepEqual(tracked(), want) {
+		t.Errorf("exports = %v, want %v", tracked(), want)
+	}
+	if want := []string{"e1/", "e3/"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted = %v, want %v", deleted, want)
+	}
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/sirupsen/logrus"
+)
+
+// rewriteKoboLink replaces the host of the link by the first matching rule.
+func rewriteKoboLink(link string, rules []config.KoboRewrite) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", fmt.Errorf("invalid kobo link %s: %w", link, err)
+	}
+	for _, rule := range rules {
+		if strings.EqualFold(u.Host, rule.From) {
+			u.Host = rule.To
+			return u.String(), nil
+		}
+	}
+	return link, nil
+}
+
+// isKoboServerAllowed checks the host of the link against the allowed servers, any host is allowed if there are none.
+func isKoboServerAllowed(link string, servers []string) bool {
+	if len(servers) == 0 {
+		return true
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	for _, server := range servers {
+		if strings.EqualFold(u.Host, server) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveKoboLink applies host rewrites from config and checks the server.
+// A rewrite is logged only the first time the link is seen.
+func (e *ExpImp) resolveKoboLink(link string) (string, error) {
+	resolved, err := rewriteKoboLink(link, config.KoboRewrites)
+	if err != nil {
+		return "", err
+	}
+	if !isKoboServerAllowed(resolved, config.KoboServers) {
+		return "", fmt.Errorf("kobo server of %s is not allowed", resolved)
+	}
+
+	if resolved != link {
+		e.linksMu.Lock()
+		logged := e.links[link]
+		e.links[link] = true
+		e.linksMu.Unlock()
+		if !logged {
+			logrus.WithFields(logrus.Fields{"old_url": link, "new_url": resolved}).Info("Kobo link is rewritten")
+		}
+	}
+	return resolved, nil
+}
+
+// koboGet requests the Kobo link with the token. The caller must close the body.
+func (e *ExpImp) koboGet(link string, token string, client *http.Client) (*http.Response, error) {
+	return e.koboRequest(http.MethodGet, link, token, nil, client)
+}
+
+// koboRequest sends the request with the token, body is JSON if it is not nil.
+// The caller must close the body of the response.
+func (e *ExpImp) koboRequest(method string, link string, token string, body io.Reader, client *http.Client) (*http.Response, error) {
+	link, err := e.resolveKoboLink(link)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(method, link, body)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Add("Authorization", "Token "+token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		response.Body.Close()
+		return nil, fmt.Errorf("unexpected status: %s", response.Status)
+	}
+	return response, nil
+}
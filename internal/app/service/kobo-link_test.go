@@ -0,0 +1,53 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+)
+
+func TestRewriteKoboLink(t *testing.T) {
+	rules := []config.KoboRewrite{
+		{From: "kobo.humanitarianresponse.info", To: "eu.kobotoolbox.org"},
+		{From: "kobo.old.example.org", To: "kobo.example.org"},
+	}
+	tests := []struct {
+		link string
+		want string
+	}{
+		{
+			"https://kobo.humanitarianresponse.info/api/v2/assets/a1/export-settings/es1/data.csv",
+			"https://eu.kobotoolbox.org/api/v2/assets/a1/export-settings/es1/data.csv",
+		},
+		{
+			"https://kobo.old.example.org/api/v2/assets/a1/export-settings/es1/data.xlsx",
+			"https://kobo.example.org/api/v2/assets/a1/export-settings/es1/data.xlsx",
+		},
+		{
+			"https://kf.kobotoolbox.org/api/v2/assets/a1/export-settings/es1/data.csv",
+			"https://kf.kobotoolbox.org/api/v2/assets/a1/export-settings/es1/data.csv",
+		},
+	}
+	for _, tt := range tests {
+		got, err := rewriteKoboLink(tt.link, rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("rewriteKoboLink(%s) = %s, want %s", tt.link, got, tt.want)
+		}
+	}
+}
+
+func TestIsKoboServerAllowed(t *testing.T) {
+	servers := []string{"eu.kobotoolbox.org", "kf.kobotoolbox.org"}
+	if !isKoboServerAllowed("https://kf.kobotoolbox.org/api/v2/assets/a1/", servers) {
+		t.Error("kf.kobotoolbox.org is not allowed")
+	}
+	if isKoboServerAllowed("https://evil.example.org/api/v2/assets/a1/", servers) {
+		t.Error("evil.example.org is allowed")
+	}
+	if !isKoboServerAllowed("https://kobo.example.org/", nil) {
+		t.Error("any server must be allowed without the list")
+	}
+}
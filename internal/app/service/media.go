@@ -0,0 +1,491 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// mediaTypes are question types whose answers are attachment file names.
+var mediaTypes = []string{"image", "audio", "video", "file", "background-audio"}
+
+// mediaIDColumns hold the submission id: _id in submissions, _submission__id in repeats.
+var mediaIDColumns = []string{"_id", "_submission__id"}
+
+var mediaFlag = regexp.MustCompile(`(^| )-media( |$)`)
+
+// unsafeKeyChars are replaced in file names of media keys, unsafeSegmentChars
+// in the other key segments, so no segment is ".." or holds "/".
+var (
+	unsafeKeyChars     = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+	unsafeSegmentChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+)
+
+// mediaColumns replaces attachment file names with links to files in the media backend.
+// " -media" takes photo, audio, video, file and signature columns from the form,
+// " media='photo,grp/sign'" lists them. " media-cells=image" writes =IMAGE() formulas
+// instead of links.
+type mediaColumns struct {
+	columns  map[int]bool
+	idColumn int
+	image    bool
+}
+
+type koboSubmission struct {
+	Attachments []koboAttachment `json:"_attachments"`
+}
+
+type koboAttachment struct {
+	DownloadURL       string `json:"download_url"`
+	Filename          string `json:"filename"`
+	Mimetype          string `json:"mimetype"`
+	MediaFileBasename string `json:"media_file_basename"`
+}
+
+var mediaOption = regexp.MustCompile(` media=["']([^"']*)["']`)
+
+// getMediaColumns parses " media='col1,col2'" from the title.
+func getMediaColumns(title string) []string {
+	matches := mediaOption.FindStringSubmatch(title)
+	if len(matches) < 2 {
+		return nil
+	}
+	var columns []string
+	for _, column := range strings.Split(matches[1], ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// needsMedia reports whether the title has media options.
+func needsMedia(spreadSheetName string) bool {
+	return mediaFlag.MatchString(spreadSheetName) || getMediaColumns(spreadSheetName) != nil
+}
+
+// newMediaColumns returns nil when the job has no media options, no media column
+// or no submission id column.
+func newMediaColumns(spreadSheetName string, header []string, form *models.Form) *mediaColumns {
+	listed := getMediaColumns(spreadSheetName)
+	if listed == nil && (form == nil || !mediaFlag.MatchString(spreadSheetName)) {
+		return nil
+	}
+
+	var questions map[string]models.Question
+	if form != nil {
+		questions = questionsByColumn(form)
+	}
+	m := &mediaColumns{
+		columns:  make(map[int]bool),
+		idColumn: -1,
+		image:    strings.Contains(spreadSheetName, " media-cells=image"),
+	}
+	for i, title := range header {
+		if containsString(mediaIDColumns, title) && m.idColumn < 0 {
+			m.idColumn = i
+		}
+		if listed != nil && containsString(listed, title) || listed == nil && containsString(mediaTypes, questions[title].Type) {
+			m.columns[i] = true
+		}
+	}
+	if len(m.columns) == 0 || m.idColumn < 0 {
+		return nil
+	}
+	return m
+}
+
+// mediaKey returns the storage key of the attachment: "asset/submission/token/file".
+// The token is an HMAC of the other parts with the secret of the job, so a link
+// to one file does not lead to files of other submissions.
+func mediaKey(secret string, uid string, submission string, fileName string) string {
+	name := unsafeKeyChars.ReplaceAllString(path.Base(fileName), "_")
+	if strings.Trim(name, ".") == "" {
+		name = "_" + name
+	}
+	uid, submission = keySegment(uid), keySegment(submission)
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(uid + "/" + submission + "/" + name))
+	return uid + "/" + submission + "/" + hex.EncodeToString(h.Sum(nil))[:32] + "/" + name
+}
+
+// keySegment returns the value with only letters, digits, "_" and "-".
+func keySegment(value string) string {
+	if value = unsafeSegmentChars.ReplaceAllString(value, "_"); value == "" {
+		return "_"
+	}
+	return value
+}
+
+// newMediaSecret returns a random secret for media keys of a job.
+func newMediaSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("error while generating media secret: %w", err)
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// mediaMarker starts cells the media step replaced with =IMAGE() formulas. Kobo data
+// cannot hold it, XML does not allow NUL, so a submitted value never passes for a formula
+// of a stored file. The marker is removed when values are sent to Sheets.
+const mediaMarker = "\x00"
+
+// mediaCell returns the link or the marked =IMAGE() formula for it.
+func mediaCell(link string, image bool) string {
+	if !image {
+		return link
+	}
+	return mediaMarker + `=IMAGE("` + strings.ReplaceAll(link, `"`, `""`) + `")`
+}
+
+// imageFormula returns the formula of a cell made by mediaCell, other cells are not formulas.
+func imageFormula(value string) (string, bool) {
+	formula, ok := strings.CutPrefix(value, mediaMarker)
+	if !ok || !strings.HasPrefix(formula, `=IMAGE("`) || !strings.HasSuffix(formula, `")`) {
+		return "", false
+	}
+	return formula, true
+}
+
+// imageLink returns the link of a formula made by mediaCell.
+func imageLink(value string) (string, bool) {
+	formula, ok := imageFormula(value)
+	if !ok {
+		return "", false
+	}
+	return strings.ReplaceAll(formula[len(`=IMAGE("`):len(formula)-len(`")`)], `""`, `"`), true
+}
+
+// plainCell returns the cell without the media marker, as it is shown in the sheet.
+func plainCell(value string) string {
+	return strings.TrimPrefix(value, mediaMarker)
+}
+
+// plainRecords returns records without media markers, rows are copied only when they have one.
+func plainRecords(records [][]string) [][]string {
+	result := make([][]string, len(records))
+	for r, row := range records {
+		result[r] = row
+		copied := false
+		for i, value := range row {
+			if !strings.HasPrefix(value, mediaMarker) {
+				continue
+			}
+			if !copied {
+				result[r] = append([]string(nil), row...)
+				copied = true
+			}
+			result[r][i] = plainCell(value)
+		}
+	}
+	return result
+}
+
+// resolveFormulaColumns marks media columns with =IMAGE() formulas by index, formulas of
+// stored files in them are not sanitised.
+// Formulas need USER_ENTERED input, so with column types links are written instead.
+func resolveFormulaColumns(spreadSheetName string, header []string, form *models.Form, types []string) []bool {
+	if !strings.Contains(spreadSheetName, " media-cells=image") {
+		return nil
+	}
+	m := newMediaColumns(spreadSheetName, header, form)
+	if m == nil {
+		return nil
+	}
+	if types != nil {
+		logrus.WithFields(logrus.Fields{"spreadsheet_name": spreadSheetName}).Warn("=IMAGE() formulas are written as links, the job has column types")
+	}
+	formulas := make([]bool, len(header))
+	for i := range m.columns {
+		formulas[i] = true
+	}
+	return formulas
+}
+
+// findAttachment returns the attachment of the submission with the file name from the cell.
+// Kobo replaces spaces in names of stored files, so both variants are compared.
+func findAttachment(attachments []koboAttachment, fileName string) (koboAttachment, bool) {
+	stored := strings.ReplaceAll(fileName, " ", "_")
+	for _, a := range attachments {
+		name := a.MediaFileBasename
+		if name == "" {
+			name = path.Base(a.Filename)
+		}
+		if name == fileName || name == stored {
+			return a, true
+		}
+	}
+	return koboAttachment{}, false
+}
+
+// mediaRun stores attachments of one export. Links are kept in the job state, so every
+// file is downloaded once. With cachedOnly only known links are used, like in dry runs.
+type mediaRun struct {
+	e           *ExpImp
+	assetURL    string
+	uid         string
+	secret      string
+	token       string
+	client      *http.Client
+	cachedOnly  bool
+	links       map[string]string
+	added       map[string]string
+	submissions map[string][]koboAttachment
+}
+
+func (e *ExpImp) newMediaRun(id int, link string, token string, client *http.Client, cachedOnly bool) (*mediaRun, error) {
+	assetURL, err := getAssetURL(link)
+	if err != nil {
+		return nil, err
+	}
+	state, err := e.state.GetJobState(id)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading job state: %w", err)
+	}
+	secret := state.MediaSecret
+	if secret == "" {
+		if secret, err = newMediaSecret(); err != nil {
+			return nil, err
+		}
+		// Без збережених посилань секрет сухого запуску не потрібен наступним запускам
+		if !cachedOnly {
+			err = e.updateJobState(id, func(state *models.JobState) {
+				if state.MediaSecret == "" {
+					state.MediaSecret = secret
+				}
+				secret = state.MediaSecret
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error while saving media secret: %w", err)
+			}
+		}
+	}
+	return &mediaRun{
+		e:           e,
+		assetURL:    assetURL,
+		uid:         path.Base(strings.TrimSuffix(assetURL, "/")),
+		secret:      secret,
+		token:       token,
+		client:      client,
+		cachedOnly:  cachedOnly,
+		links:       state.Media,
+		added:       make(map[string]string),
+		submissions: make(map[string][]koboAttachment),
+	}, nil
+}
+
+// apply returns a copy of the data row with links, file names are kept when the file cannot be stored.
+func (r *mediaRun) apply(m *mediaColumns, row []string) []string {
+	if m.idColumn >= len(row) || row[m.idColumn] == "" {
+		return row
+	}
+	submission := row[m.idColumn]
+	row = append([]string(nil), row...)
+	for i := range m.columns {
+		if i >= len(row) || row[i] == "" {
+			continue
+		}
+		link, err := r.link(submission, row[i])
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"asset": r.uid, "submission": submission, "file": row[i], "error": err}).Warn("Attachment is not stored")
+			continue
+		}
+		if link != "" {
+			row[i] = mediaCell(link, m.image)
+		}
+	}
+	return row
+}
+
+// link returns the stored link of the attachment, storing it first if needed.
+// It is empty for unknown attachments with cachedOnly.
+func (r *mediaRun) link(submission string, fileName string) (string, error) {
+	key := mediaKey(r.secret, r.uid, submission, fileName)
+	if link, ok := r.links[key]; ok {
+		return link, nil
+	}
+	if link, ok := r.added[key]; ok {
+		return link, nil
+	}
+	if r.cachedOnly {
+		return "", nil
+	}
+
+	attachments, ok := r.submissions[submission]
+	if !ok {
+		var err error
+		if attachments, err = r.fetchAttachments(submission); err != nil {
+			return "", err
+		}
+		r.submissions[submission] = attachments
+	}
+	attachment, ok := findAttachment(attachments, fileName)
+	if !ok {
+		return "", fmt.Errorf("attachment not found in submission")
+	}
+
+	response, err := r.e.koboGet(attachment.DownloadURL, r.token, r.client)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	contentType := attachment.Mimetype
+	if contentType == "" {
+		contentType = response.Header.Get("Content-Type")
+	}
+	link, err := r.e.media.SaveMedia(key, contentType, response.Body)
+	if err != nil {
+		return "", fmt.Errorf("error while saving attachment: %w", err)
+	}
+	r.added[key] = link
+	return link, nil
+}
+
+func (r *mediaRun) fetchAttachments(submission string) ([]koboAttachment, error) {
+	response, err := r.e.koboGet(r.assetURL+"data/"+submission+"/?format=json", r.token, r.client)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var s koboSubmission
+	if err := json.NewDecoder(response.Body).Decode(&s); err != nil {
+		return nil, fmt.Errorf("error while decoding submission: %w", err)
+	}
+	return s.Attachments, nil
+}
+
+// save adds links of stored attachments to the job state.
+func (r *mediaRun) save(id int) {
+	if len(r.added) == 0 {
+		return
+	}
+	err := r.e.updateJobState(id, func(state *models.JobState) {
+		if state.Media == nil {
+			state.Media = make(map[string]string)
+		}
+		for key, link := range r.added {
+			state.Media[key] = link
+		}
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"form_id": id, "error": err}).Error("error while saving media links")
+	}
+	logrus.WithFields(logrus.Fields{"form_id": id, "stored": len(r.added)}).Info("Attachments are stored")
+}
+
+// mediaEnabled reports whether media options of the job can be applied, logging why not.
+func (e *ExpImp) mediaEnabled(id int, spreadSheetName string) bool {
+	if !needsMedia(spreadSheetName) {
+		return false
+	}
+	if e.media == nil {
+		logrus.WithFields(logrus.Fields{"form_id": id}).Warn("Media options are skipped, no media backend in config")
+		return false
+	}
+	return true
+}
+
+// Media replaces attachment file names in the export with links to stored files.
+// The records are returned as is when the job has no media options, otherwise they are
+// new records the caller must close. Files which cannot be stored keep their names.
+func (e *ExpImp) Media(id int, spreadSheetName string, link string, token string, client *http.Client, records *Records, form *models.Form, cachedOnly bool) (*Records, error) {
+	if !e.mediaEnabled(id, spreadSheetName) {
+		return records, nil
+	}
+	m := newMediaColumns(spreadSheetName, records.Header(), form)
+	if m == nil {
+		return records, nil
+	}
+	run, err := e.newMediaRun(id, link, token, client, cachedOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	result := NewRecords()
+	err = records.Each(func(i int, row []string) error {
+		if i > 0 {
+			row = run.apply(m, row)
+		}
+		return result.Add(row)
+	})
+	run.save(id)
+	if err != nil {
+		result.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+// MediaXLS is Media for every sheet of the workbook with options of the sheet.
+// The workbook is not changed, sheets with links are new records in the returned one,
+// the caller must close them with CloseNew.
+func (e *ExpImp) MediaXLS(id int, spreadSheetName string, link string, token string, client *http.Client, workbook Workbook, form *models.Form, cachedOnly bool) (Workbook, error) {
+	if !e.mediaEnabled(id, spreadSheetName) {
+		return workbook, nil
+	}
+	run, err := e.newMediaRun(id, link, token, client, cachedOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer run.save(id)
+
+	result := make(Workbook, len(workbook))
+	for sheetName, sheet := range workbook {
+		result[sheetName] = sheet
+		if sheet.Records.Len() == 0 {
+			continue
+		}
+		options, _ := getTabOptions(id, spreadSheetName, sheetName)
+		m := newMediaColumns(options, sheet.Records.Header(), form)
+		if m == nil {
+			continue
+		}
+		records := NewRecords()
+		result[sheetName] = Sheet{Records: records, Types: sheet.Types, Columns: sheet.Columns, Path: sheet.Path}
+		err := sheet.Records.Each(func(i int, row []string) error {
+			if i > 0 {
+				row = run.apply(m, row)
+			}
+			return records.Add(row)
+		})
+		if err != nil {
+			result.CloseNew(workbook)
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// formulaLinks replaces =IMAGE() formulas of the columns with their links for RAW input.
+func formulaLinks(records [][]string, formulas []bool) [][]string {
+	result := make([][]string, len(records))
+	for r, row := range records {
+		result[r] = row
+		copied := false
+		for i, value := range row {
+			link, ok := imageLink(value)
+			if !ok || i >= len(formulas) || !formulas[i] {
+				continue
+			}
+			if !copied {
+				result[r] = append([]string(nil), row...)
+				copied = true
+			}
+			result[r][i] = link
+		}
+	}
+	return result
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+func TestNewMediaColumns(t *testing.T) {
+	form := &models.Form{Questions: []models.Question{
+		{Type: "image", Name: "photo", XPath: "grp/photo"},
+		{Type: "text", Name: "note", XPath: "note"},
+		{Type: "audio", Name: "voice", XPath: "voice"},
+	}}
+	header := []string{"grp/photo", "note", "voice", "_id"}
+
+	m := newMediaColumns("Report -media media-cells=image", header, form)
+	if m == nil {
+		t.Fatal("no media columns")
+	}
+	if !reflect.DeepEqual(m.columns, map[int]bool{0: true, 2: true}) || m.idColumn != 3 || !m.image {
+		t.Errorf("newMediaColumns() = %+v", m)
+	}
+
+	m = newMediaColumns("Report media='note'", header, nil)
+	if m == nil || !reflect.DeepEqual(m.columns, map[int]bool{1: true}) || m.image {
+		t.Errorf("listed columns = %+v", m)
+	}
+
+	if newMediaColumns("Report -media", header, nil) != nil {
+		t.Error("media columns without form")
+	}
+	if newMediaColumns("Report -media", header[:3], form) != nil {
+		t.Error("media columns without submission id")
+	}
+	if newMediaColumns("Report", header, form) != nil {
+		t.Error("media columns without options")
+	}
+}
+
+func TestMediaKey(t *testing.T) {
+	got := mediaKey("secret", "aBc123", "42", "user/attachments/x/IMG 01(1).jpg")
+	parts := strings.Split(got, "/")
+	if len(parts) != 4 || parts[0] != "aBc123" || parts[1] != "42" || len(parts[2]) != 32 || parts[3] != "IMG_01_1_.jpg" {
+		t.Errorf("mediaKey() = %q, want aBc123/42/<token>/IMG_01_1_.jpg", got)
+	}
+	if mediaKey("secret", "aBc123", "42", "IMG 01(1).jpg") != got {
+		t.Error("mediaKey() is not stable")
+	}
+	// Токен не вгадати без секрету і не перенести на іншу анкету
+	if mediaKey("other", "aBc123", "42", "IMG 01(1).jpg") == got {
+		t.Error("mediaKey() does not depend on the secret")
+	}
+	if token := strings.Split(mediaKey("secret", "aBc123", "43", "IMG 01(1).jpg"), "/")[2]; token == parts[2] {
+		t.Error("mediaKey() gives the same token to another submission")
+	}
+
+	// Жоден сегмент не виходить за каталог
+	parts = strings.Split(mediaKey("secret", "..", "../1", ".."), "/")
+	if len(parts) != 4 || parts[0] != "__" || parts[1] != "___1" || parts[3] != "_.." {
+		t.Errorf("mediaKey() of unsafe segments = %q", parts)
+	}
+}
+
+func TestMediaCell(t *testing.T) {
+	link := `https://files.example.org/a/1/photo "1".jpg`
+	if got := mediaCell(link, false); got != link {
+		t.Errorf("mediaCell() = %q, want link", got)
+	}
+	formula := mediaCell(link, true)
+	if want := mediaMarker + `=IMAGE("https://files.example.org/a/1/photo ""1"".jpg")`; formula != want {
+		t.Errorf("mediaCell() = %q, want %q", formula, want)
+	}
+	if got, ok := imageLink(formula); !ok || got != link {
+		t.Errorf("imageLink() = %q, %v", got, ok)
+	}
+	if _, ok := imageLink(mediaMarker + "=SUM(A1)"); ok {
+		t.Error("imageLink() accepts another formula")
+	}
+	if _, ok := imageLink(plainCell(formula)); ok {
+		t.Error("imageLink() accepts a formula without the marker")
+	}
+}
+
+func TestFindAttachment(t *testing.T) {
+	attachments := []koboAttachment{
+		{Filename: "user/attachments/uuid/sign.png", DownloadURL: "sign"},
+		{Filename: "user/attachments/uuid/my_photo.jpg", MediaFileBasename: "my_photo.jpg", DownloadURL: "photo"},
+	}
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"sign.png", "sign", true},
+		{"my photo.jpg", "photo", true},
+		{"other.jpg", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := findAttachment(attachments, tt.name)
+		if ok != tt.ok || got.DownloadURL != tt.want {
+			t.Errorf("findAttachment(%q) = %q, %v", tt.name, got.DownloadURL, ok)
+		}
+	}
+}
+
+func TestFormulaColumns(t *testing.T) {
+	// Друга колонка медійна, але формулу ввели в анкету, а не збережено файл
+	records := [][]string{
+		{"photo", "note"},
+		{mediaCell("https://x/1.jpg", true), `=IMAGE("https://x/2.jpg")`},
+		{`=IMAGE("https://evil/x.jpg")`, ""},
+	}
+	opts := writeOptions{sanitize: sanitizeQuote, formulas: []bool{true, true}}
+
+	got := (&ExpImp{}).convertValues(records[1:], opts)
+	want := [][]interface{}{
+		{`=IMAGE("https://x/1.jpg")`, `'=IMAGE("https://x/2.jpg")`},
+		{`'=IMAGE("https://evil/x.jpg")`, ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("convertValues() = %q, want %q", got, want)
+	}
+
+	links := formulaLinks(records, opts.formulas)
+	if links[1][0] != "https://x/1.jpg" || links[1][1] != records[1][1] || links[2][0] != records[2][0] {
+		t.Errorf("formulaLinks() = %q", links)
+	}
+	if records[1][0] != mediaCell("https://x/1.jpg", true) {
+		t.Error("formulaLinks changed the source records")
+	}
+
+	plain := plainRecords(records)
+	if plain[1][0] != `=IMAGE("https://x/1.jpg")` || records[1][0] == plain[1][0] {
+		t.Errorf("plainRecords() = %q", plain)
+	}
+}
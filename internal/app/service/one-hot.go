@@ -0,0 +1,150 @@
+package service
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+// oneHot expands select_multiple columns into one 0/1 column per choice, named "column/choice".
+// " -one-hot" expands every select_multiple question of the form, " one-hot='col1,col2'" the listed
+// columns, their choices are taken from the form or, without it, from the values.
+// " -keep-multiple" keeps the source column. It is applied to the export before other options.
+type oneHot struct {
+	columns map[int][]string
+	// fromValues are columns whose choices are collected from the values
+	fromValues map[int]map[string]bool
+	keep       bool
+}
+
+var oneHotFlag = regexp.MustCompile(`(^| )-one-hot( |$)`)
+
+var oneHotOption = regexp.MustCompile(` one-hot=["']([^"']*)["']`)
+
+// getOneHotColumns parses " one-hot='col1,col2'" from the title.
+func getOneHotColumns(title string) []string {
+	matches := oneHotOption.FindStringSubmatch(title)
+	if len(matches) < 2 {
+		return nil
+	}
+	var columns []string
+	for _, column := range strings.Split(matches[1], ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// newOneHot returns nil when the job has no one-hot options or no column to expand.
+// Choices of columns without the form must be collected with collect before use.
+func newOneHot(spreadSheetName string, header []string, form *models.Form) *oneHot {
+	listed := getOneHotColumns(spreadSheetName)
+	if listed == nil && (form == nil || !oneHotFlag.MatchString(spreadSheetName)) {
+		return nil
+	}
+
+	existing := make(map[string]bool, len(header))
+	for _, title := range header {
+		existing[title] = true
+	}
+	var questions map[string]models.Question
+	if form != nil {
+		questions = questionsByColumn(form)
+	}
+
+	h := &oneHot{
+		columns:    make(map[int][]string),
+		fromValues: make(map[int]map[string]bool),
+		keep:       strings.Contains(spreadSheetName, " -keep-multiple"),
+	}
+	for i, title := range header {
+		if listed != nil && !containsString(listed, title) {
+			continue
+		}
+		q, ok := questions[title]
+		switch {
+		case ok && q.Type == selectMultiple:
+			var choices []string
+			for _, c := range form.Choices[q.List] {
+				// Kobo вже може мати стовпці "q/choice" в експорті
+				if !existing[title+"/"+c.Name] {
+					choices = append(choices, c.Name)
+				}
+			}
+			if len(choices) > 0 {
+				h.columns[i] = choices
+			}
+		case listed != nil:
+			h.fromValues[i] = make(map[string]bool)
+		}
+	}
+	if len(h.columns) == 0 && len(h.fromValues) == 0 {
+		return nil
+	}
+	return h
+}
+
+// needsValues reports whether choices of some columns are collected from the values.
+func (h *oneHot) needsValues() bool {
+	return len(h.fromValues) > 0
+}
+
+// collect adds choices of the data row.
+func (h *oneHot) collect(row []string) {
+	for i, choices := range h.fromValues {
+		if i < len(row) {
+			for _, choice := range strings.Fields(row[i]) {
+				choices[choice] = true
+			}
+		}
+	}
+}
+
+// finish sorts collected choices, the expander is ready after it.
+func (h *oneHot) finish() {
+	for i, values := range h.fromValues {
+		choices := make([]string, 0, len(values))
+		for choice := range values {
+			choices = append(choices, choice)
+		}
+		sort.Strings(choices)
+		h.columns[i] = choices
+	}
+	h.fromValues = nil
+}
+
+// expand returns the row with choice columns after every expanded column.
+func (h *oneHot) expand(row []string, isHeader bool) []string {
+	result := make([]string, 0, len(row)+len(h.columns))
+	for i, value := range row {
+		choices, ok := h.columns[i]
+		if !ok || h.keep {
+			result = append(result, value)
+		}
+		if !ok {
+			continue
+		}
+
+		if isHeader {
+			for _, choice := range choices {
+				result = append(result, value+"/"+choice)
+			}
+			continue
+		}
+		selected := strings.Fields(value)
+		for _, choice := range choices {
+			switch {
+			case value == "":
+				result = append(result, "")
+			case containsString(selected, choice):
+				result = append(result, "1")
+			default:
+				result = append(result, "0")
+			}
+		}
+	}
+	return result
+}
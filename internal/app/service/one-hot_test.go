@@ -0,0 +1,66 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestExpandOneHotFromValues(t *testing.T) {
+	records := [][]string{
+		{"name", "sources", "_index"},
+		{"Frank", "well river", "1"},
+		{"John", "", "2"},
+		{"Lisa", "tap", "3"},
+	}
+
+	got, _ := prepareRows(t, "Report one-hot='sources'", records, nil)
+	want := [][]string{
+		{"name", "sources/river", "sources/tap", "sources/well", "_index"},
+		{"Frank", "1", "0", "1", "1"},
+		{"John", "", "", "", "2"},
+		{"Lisa", "0", "1", "0", "3"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("prepared records = %q, want %q", got, want)
+	}
+
+	got, _ = prepareRows(t, "Report one-hot='sources' -keep-multiple", records, nil)
+	if got[0][1] != "sources" || got[0][2] != "sources/river" || got[1][1] != "well river" {
+		t.Errorf("source column is not kept: %q", got)
+	}
+
+	if got, _ := prepareRows(t, "Report", records, nil); !reflect.DeepEqual(got, records) {
+		t.Errorf("records are changed without options: %q", got)
+	}
+}
+
+func TestExpandOneHotFromForm(t *testing.T) {
+	var asset koboAsset
+	if err := json.Unmarshal([]byte(testAsset), &asset); err != nil {
+		t.Fatal(err)
+	}
+	form := asset.form()
+
+	records := [][]string{
+		{"grp_hh/q_12", "grp_hh/q_13"},
+		{"opt_1", "opt_3"},
+	}
+	got, _ := prepareRows(t, "Report -one-hot", records, form)
+	want := [][]string{
+		{"grp_hh/q_12", "grp_hh/q_13/opt_1", "grp_hh/q_13/opt_3"},
+		{"opt_1", "0", "1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("prepared records = %q, want %q", got, want)
+	}
+
+	// Стовпці, які Kobo вже розгорнув, не дублюються
+	records = [][]string{
+		{"grp_hh/q_13", "grp_hh/q_13/opt_1", "grp_hh/q_13/opt_3"},
+		{"opt_3", "0", "1"},
+	}
+	if got, _ := prepareRows(t, "Report -one-hot", records, form); !reflect.DeepEqual(got, records) {
+		t.Errorf("prepared records = %q, want %q", got, records)
+	}
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"google.golang.org/api/sheets/v4"
+)
+
+// rangeOptions are what prepareRange needs to apply job options to the records of one range.
+type rangeOptions struct {
+	// title is the job title, options are options of the range: the title, or options
+	// of the XLS sheet from config
+	title   string
+	options string
+	// sheetRange is the normalized range like "kobo!A1:XYZ"
+	sheetRange string
+	types      map[string]string
+	form       *models.Form
+	// previous are uuids of the last write to the range
+	previous []string
+	// dropped are submissions dropped by validation options of another sheet
+	dropped map[string]bool
+}
+
+// preparedRange is the records of a range after job options and how they are written.
+// The caller must close it.
+type preparedRange struct {
+	records *Records
+	// header is the first record when it is a header row
+	header  []string
+	opts    writeOptions
+	deleted *deletions
+	// width is the number of columns of the widest record
+	width int
+}
+
+// prepareRange streams records through validation, one-hot, geo, -idx, filter, -wot, label
+// and deleted options into a spool, so only the spool is in memory when records are over
+// config.MemoryLimit. Importers and dry runs share it, so a dry run shows what is written.
+func prepareRange(records *Records, ro rangeOptions) (*preparedRange, error) {
+	header := records.Header()
+	validation := newValidationFilter(ro.options, header)
+	dropColumn := -1
+	if len(ro.dropped) > 0 && getValidationStatuses(ro.options) != nil {
+		dropColumn = columnIndex(header, submissionUUIDColumn)
+	}
+	// filter drops rows of the export by validation, the header row is always kept
+	filter := func(i int, row []string) ([]string, bool) {
+		if i > 0 && dropColumn >= 0 && dropColumn < len(row) && ro.dropped[row[dropColumn]] {
+			return nil, false
+		}
+		if validation == nil {
+			return row, true
+		}
+		return validation.apply(row, i == 0)
+	}
+	header, _ = filter(0, header)
+
+	expand := newOneHot(ro.options, header, ro.form)
+	if expand != nil {
+		if expand.needsValues() {
+			err := records.Each(func(i int, row []string) error {
+				if i == 0 {
+					return nil
+				}
+				if row, keep := filter(i, row); keep {
+					expand.collect(row)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		expand.finish()
+		header = expand.expand(header, true)
+	}
+	geo := newGeoColumns(ro.options, header, ro.form)
+	var numeric []string
+	if geo != nil {
+		header, numeric = geo.expand(header, true), geo.numeric
+	}
+
+	p := &preparedRange{
+		records: NewRecords(),
+		opts: writeOptions{
+			header:   !strings.Contains(ro.options, " -wot"),
+			sanitize: getSanitizePolicy(ro.title),
+		},
+	}
+	if records.Len() > 0 {
+		p.opts.types = resolveColumnTypes(header, ro.types)
+		p.opts.numeric = resolveNumericColumns(header, append(getNumericColumns(ro.title), numeric...))
+		p.opts.formulas = resolveFormulaColumns(ro.options, header, ro.form, p.opts.types)
+	}
+
+	transform := newRecordTransform(ro.options, ro.sheetRange, header)
+	labels := newFormLabels(ro.title, header, ro.form)
+	p.deleted = newDeletions(ro.options, records.Header(), header, ro.previous)
+
+	err := records.Each(func(i int, row []string) error {
+		if p.deleted != nil && i > 0 {
+			p.deleted.seen(row)
+		}
+		row, keep := filter(i, row)
+		if !keep {
+			return nil
+		}
+		if expand != nil {
+			row = expand.expand(row, i == 0)
+		}
+		if geo != nil {
+			row = geo.expand(row, i == 0)
+		}
+		row, keep, err := transform(i, row)
+		if err != nil || !keep {
+			return err
+		}
+		if labels != nil {
+			row = labels.apply(row, i == 0)
+		}
+		if p.deleted != nil {
+			row = p.deleted.add(row, i == 0)
+		}
+		if i == 0 {
+			p.header = row
+		}
+		return p.add(row)
+	})
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// addDeleted reads rows of submissions deleted in Kobo from the range when the deleted
+// mode needs them, with " deleted=mark" they are added to the records.
+func (p *preparedRange) addDeleted(ctx context.Context, srv *sheets.Service, spreadsheetId string, sheetRange string) error {
+	rows, err := p.deleted.readDeleted(ctx, srv, spreadsheetId, sheetRange)
+	if err != nil || p.deleted.mode != deletedMark {
+		return err
+	}
+	for _, row := range rows {
+		if err := p.add(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *preparedRange) add(row []string) error {
+	if len(row) > p.width {
+		p.width = len(row)
+	}
+	return p.records.Add(row)
+}
+
+// hash returns the hash of the records with the key that describes where and how they are written.
+func (p *preparedRange) hash(key string) (string, error) {
+	hasher := newRecordsHasher(key)
+	err := p.records.Each(func(_ int, row []string) error {
+		hasher.add(row)
+		return nil
+	})
+	return hasher.sum(), err
+}
+
+// writePrepared writes the records to the range. Records on disk are written in chunks,
+// records in memory only by changed rows when changed is true.
+func (e *ExpImp) writePrepared(ctx context.Context, srv *sheets.Service, spreadSheetName string, spreadsheetId string, sheetRange string, p *preparedRange, changed bool) error {
+	firstRow := getStringNumber(sheetRange)
+	var err error
+	switch {
+	case p.records.Spilled():
+		err = e.writeChunked(ctx, srv, spreadsheetId, sheetRange, p.records, p.opts)
+	case changed:
+		var rows [][]string
+		if rows, err = p.records.All(); err == nil {
+			err = e.writeChanged(ctx, srv, spreadSheetName, spreadsheetId, sheetRange, firstRow, rows, p.opts)
+		}
+	default:
+		var rows [][]string
+		if rows, err = p.records.All(); err == nil {
+			err = e.writeFull(ctx, srv, spreadsheetId, sheetRange, rows, p.opts)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return formatDateColumns(ctx, srv, spreadsheetId, getTabName(sheetRange), firstRow, p.records.Len(), p.opts.types)
+}
+
+// close removes the spool of the records.
+func (p *preparedRange) close() {
+	p.records.Close()
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+// prepareRows applies options of the title to rows like the importers do.
+func prepareRows(t *testing.T, title string, rows [][]string, form *models.Form) ([][]string, writeOptions) {
+	t.Helper()
+	prepared, err := prepareRange(recordsOf(t, rows), rangeOptions{title: title, options: title, sheetRange: "kobo!A10:XYZ", form: form})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prepared.close()
+	return allRows(t, prepared.records), prepared.opts
+}
+
+func TestPrepareRange(t *testing.T) {
+	rows := [][]string{
+		{"name", "sources", "_validation_status", "_uuid", "_index"},
+		{"Frank", "well river", "Approved", "u1", "1"},
+		{"John", "tap", "On Hold", "u2", "2"},
+		{"Lisa", "tap", "Approved", "u3", "3"},
+	}
+
+	prepared, err := prepareRange(recordsOf(t, rows), rangeOptions{
+		title:      "Report -idx validation='approved' one-hot='sources' deleted=mark",
+		options:    "Report -idx validation='approved' one-hot='sources' deleted=mark",
+		sheetRange: "kobo!A10:XYZ",
+		previous:   []string{"u0", "u1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prepared.close()
+
+	want := [][]string{
+		{"name", "sources/river", "sources/tap", "sources/well", "_validation_status", "_uuid", "_index", "_deleted_in_kobo"},
+		{"Frank", "1", "0", "1", "Approved", "u1", "10", ""},
+		{"Lisa", "0", "1", "0", "Approved", "u3", "12", ""},
+	}
+	if got := allRows(t, prepared.records); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+	if !reflect.DeepEqual(prepared.header, want[0]) {
+		t.Errorf("header = %q", prepared.header)
+	}
+	// Анкети, відкинуті фільтром, не вважаються видаленими
+	if deleted := prepared.deleted.deleted(); len(deleted) != 1 || !deleted["u0"] {
+		t.Errorf("deleted = %v, want u0", deleted)
+	}
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Records is an export read row by row. Rows are kept in memory up to config.MemoryLimit,
+// all rows are moved to a temp file when it is exceeded. The header row is always in memory.
+type Records struct {
+	header []string
+	rows   [][]string
+	count  int
+	size   int64
+
+	file *os.File
+	buf  *bufio.Writer
+	enc  *gob.Encoder
+}
+
+func NewRecords() *Records {
+	return &Records{}
+}
+
+// RecordsFrom wraps rows that are already in memory.
+func RecordsFrom(rows [][]string) (*Records, error) {
+	r := NewRecords()
+	for _, row := range rows {
+		if err := r.Add(row); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Add appends the row, the first row is the header.
+func (r *Records) Add(row []string) error {
+	if r.count == 0 {
+		r.header = row
+	}
+	r.count++
+
+	if r.file != nil {
+		return r.enc.Encode(row)
+	}
+
+	r.rows = append(r.rows, row)
+	r.size += rowSize(row)
+	if config.MemoryLimit > 0 && r.size > config.MemoryLimit {
+		return r.spill()
+	}
+	return nil
+}
+
+// rowSize estimates memory used by the row: slice and string headers and the values.
+func rowSize(row []string) int64 {
+	size := int64(24 + 16*len(row))
+	for _, value := range row {
+		size += int64(len(value))
+	}
+	return size
+}
+
+func (r *Records) spill() error {
+	file, err := os.CreateTemp(config.SpoolDir, "kobo-records-*.gob")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+	r.file = file
+	r.buf = bufio.NewWriter(file)
+	r.enc = gob.NewEncoder(r.buf)
+
+	for _, row := range r.rows {
+		if err := r.enc.Encode(row); err != nil {
+			return fmt.Errorf("failed to spill records: %w", err)
+		}
+	}
+	r.rows, r.size = nil, 0
+	return nil
+}
+
+// Len returns the number of rows including the header.
+func (r *Records) Len() int {
+	return r.count
+}
+
+// Header returns the first row.
+func (r *Records) Header() []string {
+	return r.header
+}
+
+// Spilled reports whether rows are in the temp file.
+func (r *Records) Spilled() bool {
+	return r.file != nil
+}
+
+// Each calls fn for every row in order, i is the row index. Rows must not be changed by fn.
+func (r *Records) Each(fn func(i int, row []string) error) error {
+	if r.file == nil {
+		for i, row := range r.rows {
+			if err := fn(i, row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := r.buf.Flush(); err != nil {
+		return fmt.Errorf("failed to flush spool file: %w", err)
+	}
+	file, err := os.Open(r.file.Name())
+	if err != nil {
+		return fmt.Errorf("failed to open spool file: %w", err)
+	}
+	defer file.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(file))
+	for i := 0; ; i++ {
+		var row []string
+		if err := dec.Decode(&row); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read spool file: %w", err)
+		}
+		if err := fn(i, row); err != nil {
+			return err
+		}
+	}
+}
+
+// All returns all rows in memory. It is for stages that need the whole dataset at once.
+func (r *Records) All() ([][]string, error) {
+	if r.file == nil {
+		return r.rows, nil
+	}
+	rows := make([][]string, 0, r.count)
+	err := r.Each(func(_ int, row []string) error {
+		rows = append(rows, row)
+		return nil
+	})
+	return rows, err
+}
+
+// Close removes the temp file.
+func (r *Records) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	name := r.file.Name()
+	r.file.Close()
+	r.file = nil
+	return os.Remove(name)
+}
+
+// Sheet is one sheet of an XLS export or of JSON data with repeat groups. Values of typed
+// columns are kept in canonical form: numbers as plain decimals, dates as 2006-01-02 or 2006-01-02T15:04:05.
+type Sheet struct {
+	Records *Records
+	// Types are column types inferred from xlsx cells, by column title.
+	Types map[string]string
+	// Columns are the column order of a JSON export sheet, kept in the job state once it is written.
+	Columns []string
+	// Path is the repeat group of a JSON export sheet, its sheet name is kept in the job state.
+	Path string
+}
+
+// Workbook is sheets by name.
+type Workbook map[string]Sheet
+
+// Close removes temp files of the sheets.
+func (w Workbook) Close() {
+	w.CloseNew(nil)
+}
+
+// CloseNew removes temp files of sheets whose records are not from the source workbook.
+func (w Workbook) CloseNew(source Workbook) {
+	for name, sheet := range w {
+		if s, ok := source[name]; ok && s.Records == sheet.Records {
+			continue
+		}
+		if err := sheet.Records.Close(); err != nil {
+			logrus.WithFields(logrus.Fields{"sheet": name, "error": err}).Error("error while removing spool file")
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+)
+
+func TestRecordsSpill(t *testing.T) {
+	config.SetStreaming(100, t.TempDir(), 0)
+	defer config.SetStreaming(0, "", 0)
+
+	rows := [][]string{
+		{"name", "comment", "_index"},
+		{"Frank", "line 1\r\nline 2", "1"},
+		{"John", "", "2"},
+		{"Lisa", "=1+1", "3"},
+	}
+	records, err := RecordsFrom(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer records.Close()
+
+	if !records.Spilled() {
+		t.Fatal("records are not spilled over the memory limit")
+	}
+	if records.Len() != len(rows) || !reflect.DeepEqual(records.Header(), rows[0]) {
+		t.Errorf("Len() = %d, Header() = %v", records.Len(), records.Header())
+	}
+
+	// Записи можна читати кілька разів
+	for n := 0; n < 2; n++ {
+		got, err := records.All()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, rows) {
+			t.Errorf("All() = %q, want %q", got, rows)
+		}
+	}
+
+	if err := records.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestRecordsInMemory(t *testing.T) {
+	config.SetStreaming(0, "", 0)
+
+	records, err := RecordsFrom([][]string{{"name"}, {"Frank"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records.Spilled() {
+		t.Error("records are spilled without the memory limit")
+	}
+	if err := records.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestRecordTransform(t *testing.T) {
+	rows := [][]string{
+		{"name", "consent", "_index"},
+		{"Frank", "1", "1"},
+		{"John", "0", "2"},
+		{"Lisa", "1", "3"},
+	}
+	tests := map[string][][]string{
+		"Report": rows,
+		"Report -wot -idx": {
+			{"Frank", "1", "9"},
+			{"John", "0", "10"},
+			{"Lisa", "1", "11"},
+		},
+		"Report -idx filter='consent'": {
+			{"name", "consent", "_index"},
+			{"Frank", "1", "10"},
+			{"Lisa", "1", "12"},
+		},
+		"Report -wot filter='consent'": {
+			{"Frank", "1", "1"},
+			{"Lisa", "1", "3"},
+		},
+	}
+
+	for title, want := range tests {
+		transform := newRecordTransform(title, "kobo!A10:XYZ", rows[0])
+		var got [][]string
+		for i, row := range rows {
+			row, keep, err := transform(i, row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keep {
+				got = append(got, row)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", title, got, want)
+		}
+	}
+
+	if rows[1][2] != "1" {
+		t.Error("transform changed the source row")
+	}
+}
+
+func TestRecordsHasher(t *testing.T) {
+	rows := [][]string{{"name"}, {"Frank"}, {"John"}}
+	h := newRecordsHasher("kobo!A1:XYZ")
+	for _, row := range rows {
+		h.add(row)
+	}
+	if got, want := h.sum(), hashRecords("kobo!A1:XYZ", rows); got != want {
+		t.Errorf("sum() = %s, want %s", got, want)
+	}
+}
+
+// allRows returns all rows of the records.
+func allRows(t *testing.T, records *Records) [][]string {
+	t.Helper()
+	rows, err := records.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// recordsOf wraps rows in records closed after the test.
+func recordsOf(t *testing.T, rows [][]string) *Records {
+	t.Helper()
+	records, err := RecordsFrom(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { records.Close() })
+	return records
+}
+
+// workbookOf wraps sheets in a workbook closed after the test.
+func workbookOf(t *testing.T, sheets map[string][][]string) Workbook {
+	t.Helper()
+	workbook := make(Workbook, len(sheets))
+	for name, rows := range sheets {
+		workbook[name] = Sheet{Records: recordsOf(t, rows)}
+	}
+	return workbook
+}
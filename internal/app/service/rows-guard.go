@@ -0,0 +1,78 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+)
+
+// ErrBlocked is returned when the write is stopped by the rows guard.
+var ErrBlocked = errors.New("blocked by rows guard")
+
+var maxDropOption = regexp.MustCompile(` -max-drop=([0-9.]+)(%?)`)
+
+// getRowsGuard returns the guard for the job. Global limits from config can be
+// replaced by " -max-drop=N" (rows) or " -max-drop=N%" (percent) in the title.
+func getRowsGuard(gsName string) config.RowsGuardConfig {
+	guard := config.RowsGuard
+	matches := maxDropOption.FindStringSubmatch(gsName)
+	if len(matches) < 3 {
+		return guard
+	}
+
+	if matches[2] == "%" {
+		percent, err := strconv.ParseFloat(matches[1], 64)
+		if err != nil {
+			return guard
+		}
+		return config.RowsGuardConfig{MaxDropPercent: percent}
+	}
+
+	rows, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return guard
+	}
+	return config.RowsGuardConfig{MaxDropRows: rows}
+}
+
+func checkRowsDrop(guard config.RowsGuardConfig, previous, current int) error {
+	if previous == 0 || current >= previous {
+		return nil
+	}
+
+	drop := previous - current
+	if guard.MaxDropRows > 0 && drop > guard.MaxDropRows {
+		return fmt.Errorf("%w: rows count dropped from %d to %d (limit %d rows)", ErrBlocked, previous, current, guard.MaxDropRows)
+	}
+
+	percent := float64(drop) * 100 / float64(previous)
+	if guard.MaxDropPercent > 0 && percent > guard.MaxDropPercent {
+		return fmt.Errorf("%w: rows count dropped from %d to %d (limit %.0f%%)", ErrBlocked, previous, current, guard.MaxDropPercent)
+	}
+
+	return nil
+}
+
+// checkRowsCount compares the new rows count of the tab with the last successful run.
+func (e *ExpImp) checkRowsCount(id int, spreadSheetName string, tab string, rows int) error {
+	if strings.Contains(spreadSheetName, " -allow-shrink") {
+		return nil
+	}
+
+	state, err := e.state.GetJobState(id)
+	if err != nil {
+		return fmt.Errorf("error while reading job state: %w", err)
+	}
+
+	return checkRowsDrop(getRowsGuard(spreadSheetName), state.Tabs[tab].Rows, rows)
+}
+
+// getTabName returns the sheet title from an A1 range.
+func getTabName(sheetRange string) string {
+	tab, _, _ := strings.Cut(sheetRange, "!")
+	return strings.Trim(tab, "'")
+}
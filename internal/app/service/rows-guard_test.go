@@ -0,0 +1,101 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+)
+
+func TestGetRowsGuard(t *testing.T) {
+	config.SetRowsGuard(config.RowsGuardConfig{MaxDropPercent: 50})
+
+	tests := []struct {
+		name  string
+		input string
+		want  config.RowsGuardConfig
+	}{
+		{
+			name:  "default",
+			input: "task -wot",
+			want:  config.RowsGuardConfig{MaxDropPercent: 50},
+		},
+		{
+			name:  "percent",
+			input: "task -max-drop=10% -idx",
+			want:  config.RowsGuardConfig{MaxDropPercent: 10},
+		},
+		{
+			name:  "rows",
+			input: "task -max-drop=200",
+			want:  config.RowsGuardConfig{MaxDropRows: 200},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := getRowsGuard(tt.input)
+			if got != tt.want {
+				t.Errorf("getRowsGuard() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRowsDrop(t *testing.T) {
+	tests := []struct {
+		name     string
+		guard    config.RowsGuardConfig
+		previous int
+		current  int
+		blocked  bool
+	}{
+		{
+			name:     "first run",
+			guard:    config.RowsGuardConfig{MaxDropPercent: 50},
+			previous: 0,
+			current:  1,
+		},
+		{
+			name:     "growth",
+			guard:    config.RowsGuardConfig{MaxDropPercent: 50},
+			previous: 100,
+			current:  120,
+		},
+		{
+			name:     "drop within percent",
+			guard:    config.RowsGuardConfig{MaxDropPercent: 50},
+			previous: 100,
+			current:  60,
+		},
+		{
+			name:     "drop over percent",
+			guard:    config.RowsGuardConfig{MaxDropPercent: 50},
+			previous: 1000,
+			current:  5,
+			blocked:  true,
+		},
+		{
+			name:     "drop over rows",
+			guard:    config.RowsGuardConfig{MaxDropRows: 10},
+			previous: 1000,
+			current:  980,
+			blocked:  true,
+		},
+		{
+			name:     "guard disabled",
+			guard:    config.RowsGuardConfig{},
+			previous: 1000,
+			current:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRowsDrop(tt.guard, tt.previous, tt.current)
+			if errors.Is(err, ErrBlocked) != tt.blocked {
+				t.Errorf("checkRowsDrop() = %v, blocked %v", err, tt.blocked)
+			}
+		})
+	}
+}
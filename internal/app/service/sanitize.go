@@ -0,0 +1,109 @@
+package service
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+)
+
+const (
+	sanitizeQuote = "quote"
+	sanitizeStrip = "strip"
+	sanitizeOff   = "off"
+)
+
+// formulaTriggers start a formula in USER_ENTERED input.
+const formulaTriggers = "=+-@\t\r"
+
+var sanitizeOption = regexp.MustCompile(` -sanitize=([^ ]+)`)
+
+// getSanitizePolicy returns the policy from " -sanitize=quote|strip|off" or the default from config.
+func getSanitizePolicy(gsName string) string {
+	matches := sanitizeOption.FindStringSubmatch(gsName)
+	if len(matches) < 2 {
+		if config.Sanitize == "" {
+			return sanitizeQuote
+		}
+		return config.Sanitize
+	}
+	return matches[1]
+}
+
+var numericOption = regexp.MustCompile(` numeric=["']([^"']*)["']`)
+
+// getNumericColumns returns columns from config and " numeric='col1,col2'" in the title.
+func getNumericColumns(title string) []string {
+	columns := append([]string{}, config.SanitizeNumericColumns...)
+	matches := numericOption.FindStringSubmatch(title)
+	if len(matches) < 2 {
+		return columns
+	}
+	for _, column := range strings.Split(matches[1], ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// resolveNumericColumns marks numeric columns of the header row by index.
+func resolveNumericColumns(header []string, columns []string) []bool {
+	if len(columns) == 0 {
+		return nil
+	}
+	numeric := make([]bool, len(header))
+	for i, title := range header {
+		for _, column := range columns {
+			if strings.EqualFold(title, column) {
+				numeric[i] = true
+			}
+		}
+	}
+	return numeric
+}
+
+// sanitizeValue neutralises formula triggers at the start of the value.
+// Numbers, as enteredKey compares them, are kept when allowNumber is true.
+func sanitizeValue(value string, policy string, allowNumber bool) string {
+	if value == "" || !strings.ContainsRune(formulaTriggers, rune(value[0])) {
+		return value
+	}
+	if allowNumber {
+		if _, ok := enteredNumber(value); ok {
+			return value
+		}
+	}
+
+	switch policy {
+	case sanitizeOff:
+		return value
+	case sanitizeStrip:
+		return strings.TrimLeft(value, formulaTriggers)
+	default:
+		return "'" + value
+	}
+}
+
+// convertValues converts records to strings for USER_ENTERED input.
+func (e *ExpImp) convertValues(records [][]string, opts writeOptions) [][]interface{} {
+	policy := opts.sanitize
+	if policy == "" {
+		policy = getSanitizePolicy("")
+	}
+
+	var result [][]interface{}
+	for _, row := range records {
+		var interfaceRow []interface{}
+		for i, item := range row {
+			allowNumber := opts.allNumeric || (i < len(opts.numeric) && opts.numeric[i])
+			if formula, ok := imageFormula(item); ok && i < len(opts.formulas) && opts.formulas[i] {
+				interfaceRow = append(interfaceRow, formula)
+				continue
+			}
+			interfaceRow = append(interfaceRow, sanitizeValue(plainCell(item), policy, allowNumber))
+		}
+		result = append(result, interfaceRow)
+	}
+	return result
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSanitizeValue(t *testing.T) {
+	tests := []struct {
+		value       string
+		policy      string
+		allowNumber bool
+		want        string
+	}{
+		{value: "=HYPERLINK(\"http://x\")", policy: "quote", want: "'=HYPERLINK(\"http://x\")"},
+		{value: "+380501234567", policy: "quote", want: "'+380501234567"},
+		{value: "-5", policy: "quote", want: "'-5"},
+		{value: "-5", policy: "quote", allowNumber: true, want: "-5"},
+		{value: "-1+cmd|' /C calc'!A0", policy: "quote", allowNumber: true, want: "'-1+cmd|' /C calc'!A0"},
+		{value: "-Infinity", policy: "quote", allowNumber: true, want: "'-Infinity"},
+		{value: "+inf", policy: "quote", allowNumber: true, want: "'+inf"},
+		{value: "-0x1p3", policy: "quote", allowNumber: true, want: "'-0x1p3"},
+		{value: "@SUM(A1)", policy: "strip", want: "SUM(A1)"},
+		{value: "\t=1+1", policy: "strip", want: "1+1"},
+		{value: "=1+1", policy: "off", want: "=1+1"},
+		{value: "plain text", policy: "quote", want: "plain text"},
+		{value: "", policy: "quote", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeValue(tt.value, tt.policy, tt.allowNumber); got != tt.want {
+			t.Errorf("sanitizeValue(%q, %q, %v) = %q, want %q", tt.value, tt.policy, tt.allowNumber, got, tt.want)
+		}
+	}
+}
+
+func TestConvertValues(t *testing.T) {
+	e := &ExpImp{}
+	records := [][]string{{"name", "balance"}, {"=cmd", "-5"}}
+	opts := writeOptions{
+		sanitize: "quote",
+		numeric:  resolveNumericColumns(records[0], getNumericColumns(" numeric='Balance'")),
+	}
+
+	got := e.convertValues(records, opts)
+	want := [][]interface{}{{"name", "balance"}, {"'=cmd", "-5"}}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("convertValues() = %v, want %v", got, want)
+	}
+}
@@ -7,12 +7,26 @@ import (
 )
 
 type ExportImport interface {
-	Export(csvLink, token string, client *http.Client) ([][]string, error)
+	Export(csvLink, token string, dialect CSVDialect, client *http.Client) (*Records, error)
 	StringSliceToInterfaceSliceConverter(strs [][]string) [][]interface{}
-	Importer(credentials string, spreadSheetName string, spreadsheetId string, sheetName string, values [][]string) error
+	Importer(id int, credentials string, spreadSheetName string, spreadsheetId string, sheetName string, records *Records, types map[string]string, form *models.Form) error
 	Sorter(data []models.Data) map[string][]models.Data
-	ExportXLS(xlsLink string, token string, client *http.Client) (map[string][][]string, error)
-	ImporterXLS(credentials string, spreadsheetId string, records map[string][][]string) error
+	ExportXLS(xlsLink string, token string, client *http.Client) (Workbook, error)
+	ExportJSON(id int, jsonLink string, token string, sheetName string, client *http.Client) (Workbook, error)
+	ImporterXLS(id int, credentials string, spreadSheetName string, spreadsheetId string, workbook Workbook, types map[string]string, form *models.Form) error
+	ColumnTypes(spreadSheetName string, link string, token string, client *http.Client) map[string]string
+	Form(spreadSheetName string, link string, token string, client *http.Client) *models.Form
+	Media(id int, spreadSheetName string, link string, token string, client *http.Client, records *Records, form *models.Form, cachedOnly bool) (*Records, error)
+	MediaXLS(id int, spreadSheetName string, link string, token string, client *http.Client, workbook Workbook, form *models.Form, cachedOnly bool) (Workbook, error)
+	WriteBackValidation(id int, credentials string, spreadSheetName string, spreadsheetId string, sheetName string, link string, token string, client *http.Client, dryRun bool) error
+	AppendSubmission(id int, credentials string, spreadSheetName string, spreadsheetId string, sheetName string, submission []byte) error
+	DiscoverAssets(server string, token string, all bool, client *http.Client) ([]models.KoboAsset, error)
+	CreateExportSetting(server string, uid string, token string, format string, client *http.Client) (models.ExportSetting, error)
+	CreateExport(id int, link string, token string, client *http.Client) (string, error)
+	DryRun(id int, credentials string, spreadSheetName string, spreadsheetId string, sheetName string, records *Records, form *models.Form) (models.SheetDiff, error)
+	DryRunXLS(id int, credentials string, spreadSheetName string, spreadsheetId string, workbook Workbook, form *models.Form) ([]models.SheetDiff, error)
+	Restore(credentials string, spreadsheetId string, sheetRange string, records [][]string) error
+	RestoreTabs(credentials string, spreadsheetId string, tabs []string) ([]string, error)
 }
 
 type Service struct {
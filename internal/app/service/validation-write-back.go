@@ -0,0 +1,225 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// validationDecision is a validation status a reviewer put into a sheet row.
+type validationDecision struct {
+	row        int
+	submission string
+	status     string
+}
+
+// validationPayload is the body of the Kobo bulk validation status request.
+type validationPayload struct {
+	Payload struct {
+		SubmissionIDs []int  `json:"submission_ids"`
+		Status        string `json:"validation_status.uid"`
+	} `json:"payload"`
+}
+
+// parseDecision maps the sheet value to a status with the values from config,
+// then as a Kobo label or uid. It is empty for blank and unknown values.
+func parseDecision(value string, values map[string]string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	status, ok := values[strings.ToLower(value)]
+	if !ok {
+		status = parseValidationStatus(value)
+	}
+	if _, known := validationLabels[status]; !known {
+		return ""
+	}
+	return status
+}
+
+// getValidationDecisions finds the header row with the column and _id and returns
+// decisions of the rows below it. Rows where the _validation_status column already shows
+// the decision are skipped. Row numbers start from 1, like in the sheet.
+// cells are decision cells of the last run by row: a value seen next to another _id
+// was moved under this submission by an import and is skipped. The cells of this
+// run are returned for the next one.
+func getValidationDecisions(values [][]string, cfg config.ValidationWriteBack, cells map[int]models.ValidationCell) ([]validationDecision, map[int]models.ValidationCell, error) {
+	for h, header := range values {
+		column, idColumn := columnIndex(header, cfg.Column), columnIndex(header, "_id")
+		if column < 0 || idColumn < 0 {
+			continue
+		}
+		statusColumn := columnIndex(header, validationColumn)
+
+		var decisions []validationDecision
+		seen := make(map[int]models.ValidationCell)
+		for i, row := range values[h+1:] {
+			number := h + i + 2
+			if column >= len(row) || idColumn >= len(row) || row[idColumn] == "" || strings.TrimSpace(row[column]) == "" {
+				continue
+			}
+			cell := models.ValidationCell{ID: row[idColumn], Value: strings.TrimSpace(row[column])}
+			if previous, ok := cells[number]; ok && previous.Value == cell.Value && previous.ID != cell.ID {
+				// Значення лишилось у рядку, а анкета під ним змінилась
+				logrus.WithFields(logrus.Fields{"row": number, "value": cell.Value, "_id": cell.ID, "first_id": previous.ID}).Warn("Validation decision of another submission is skipped")
+				seen[number] = previous
+				continue
+			}
+			seen[number] = cell
+
+			status := parseDecision(cell.Value, cfg.Values)
+			if status == "" {
+				logrus.WithFields(logrus.Fields{"row": number, "value": cell.Value}).Warn("Unknown validation decision is skipped")
+				continue
+			}
+			if statusColumn >= 0 && statusColumn < len(row) && parseValidationStatus(row[statusColumn]) == status {
+				continue
+			}
+			decisions = append(decisions, validationDecision{row: number, submission: cell.ID, status: status})
+		}
+		return decisions, seen, nil
+	}
+	return nil, nil, fmt.Errorf("header with %q and _id columns not found", cfg.Column)
+}
+
+// rowsOption returns the job option that drops or moves rows between runs, empty if there is none.
+// Decisions of such jobs could be taken for other submissions, so they are not written back.
+func rowsOption(spreadSheetName string) string {
+	switch {
+	case getDeletedMode(spreadSheetName) != "":
+		return "deleted"
+	case getValidationStatuses(spreadSheetName) != nil:
+		return "validation"
+	case strings.Contains(spreadSheetName, " filter='"):
+		return "filter"
+	}
+	return ""
+}
+
+// WriteBackValidation sends validation decisions from the sheet column of the job config to Kobo.
+// Decisions sent before are kept in the job state with their rows and are not sent again.
+// In a dry run decisions are only logged.
+func (e *ExpImp) WriteBackValidation(id int, credentials string, spreadSheetName string, spreadsheetId string, sheetName string, link string, token string, client *http.Client, dryRun bool) error {
+	cfg := config.Jobs[id].ValidationWriteBack
+	if cfg == nil || cfg.Column == "" {
+		return nil
+	}
+	if option := rowsOption(spreadSheetName); option != "" {
+		return fmt.Errorf("validation write-back is not supported with the %s option, it moves rows", option)
+	}
+	tab := cfg.Tab
+	if tab == "" {
+		tab = getTabName(sheetName)
+	}
+	if tab == "" {
+		return fmt.Errorf("tab of the validation column is not set")
+	}
+	assetURL, err := getAssetURL(link)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	srv, err := e.getService(credentials)
+	if err != nil {
+		return err
+	}
+	values, err := readValues(ctx, srv, spreadsheetId, quoteTab(tab), "FORMATTED_VALUE")
+	if err != nil {
+		return fmt.Errorf("error while reading validation column: %w", err)
+	}
+	state, err := e.state.GetJobState(id)
+	if err != nil {
+		return fmt.Errorf("error while reading job state: %w", err)
+	}
+	decisions, cells, err := getValidationDecisions(values, *cfg, state.ValidationCells)
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		err := e.updateJobState(id, func(state *models.JobState) {
+			state.ValidationCells = cells
+		})
+		if err != nil {
+			return fmt.Errorf("error while saving job state: %w", err)
+		}
+	}
+	byStatus := make(map[string][]validationDecision)
+	for _, d := range decisions {
+		if sent, ok := state.Validation[d.submission]; ok && sent.Status == d.status {
+			continue
+		}
+		byStatus[d.status] = append(byStatus[d.status], d)
+	}
+
+	statuses := make([]string, 0, len(byStatus))
+	for status := range byStatus {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	for _, status := range statuses {
+		decisions := byStatus[status]
+		rows := make([]int, 0, len(decisions))
+		for _, d := range decisions {
+			rows = append(rows, d.row)
+		}
+		fields := logrus.Fields{"form_id": id, "tab": tab, "status": status, "rows": rows}
+		if dryRun {
+			logrus.WithFields(fields).Info("Dry run: validation statuses would be sent to Kobo")
+			continue
+		}
+
+		if err := e.patchValidation(assetURL, token, client, status, decisions); err != nil {
+			return fmt.Errorf("error while sending validation statuses: %w", err)
+		}
+		logrus.WithFields(fields).Info("Validation statuses are sent to Kobo")
+
+		sent := time.Now().Format(time.DateTime)
+		err := e.updateJobState(id, func(state *models.JobState) {
+			if state.Validation == nil {
+				state.Validation = make(map[string]models.ValidationWrite)
+			}
+			for _, d := range decisions {
+				state.Validation[d.submission] = models.ValidationWrite{Status: d.status, Row: d.row, Sent: sent}
+			}
+		})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"form_id": id, "error": err}).Error("error while saving job state")
+		}
+	}
+	return nil
+}
+
+func (e *ExpImp) patchValidation(assetURL string, token string, client *http.Client, status string, decisions []validationDecision) error {
+	var payload validationPayload
+	payload.Payload.Status = validationUIDPrefix + status
+	for _, d := range decisions {
+		submission, err := strconv.Atoi(d.submission)
+		if err != nil {
+			return fmt.Errorf("invalid submission id %q in row %d", d.submission, d.row)
+		}
+		payload.Payload.SubmissionIDs = append(payload.Payload.SubmissionIDs, submission)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	response, err := e.koboRequest(http.MethodPatch, assetURL+"data/validation_statuses/", token, bytes.NewReader(body), client)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
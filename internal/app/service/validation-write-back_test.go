@@ -0,0 +1,104 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+func TestParseDecision(t *testing.T) {
+	values := map[string]string{"ok": validationApproved}
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"OK", validationApproved},
+		{"On Hold", validationOnHold},
+		{"validation_status_not_approved", validationNotApproved},
+		{"maybe", ""},
+		{" ", ""},
+	}
+	for _, tt := range tests {
+		if got := parseDecision(tt.value, values); got != tt.want {
+			t.Errorf("parseDecision(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestGetValidationDecisions(t *testing.T) {
+	values := [][]string{
+		{"Report"},
+		{"name", "_id", "_validation_status", "", "Validation"},
+		{"Frank", "10", "", "", "ok"},
+		{"John", "11", "Approved", "", "Approved"},
+		{"Anna", "12", "", "", "maybe"},
+		{"Olha", "13", "On Hold"},
+		{"Ivan", "", "", "", "ok"},
+		{"Petro", "14", "Approved", "", "Not Approved"},
+	}
+	cfg := config.ValidationWriteBack{Column: "Validation", Values: map[string]string{"ok": validationApproved}}
+
+	got, cells, err := getValidationDecisions(values, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []validationDecision{
+		{row: 3, submission: "10", status: validationApproved},
+		{row: 8, submission: "14", status: validationNotApproved},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getValidationDecisions() = %+v, want %+v", got, want)
+	}
+
+	if cells[3] != (models.ValidationCell{ID: "10", Value: "ok"}) || len(cells) != 4 {
+		t.Errorf("cells = %+v", cells)
+	}
+
+	if _, _, err := getValidationDecisions(values, config.ValidationWriteBack{Column: "Review"}, nil); err == nil {
+		t.Error("no error without the column")
+	}
+}
+
+func TestValidationDecisionsMovedRows(t *testing.T) {
+	cfg := config.ValidationWriteBack{Column: "Validation"}
+	cells := map[int]models.ValidationCell{
+		2: {ID: "10", Value: "Approved"},
+		3: {ID: "11", Value: "On Hold"},
+	}
+	// Анкету 10 видалено, рядки піднялись під ручною колонкою
+	values := [][]string{
+		{"_id", "Validation"},
+		{"11", "Approved"},
+		{"12", "Not Approved"},
+		{"13", "On Hold"},
+	}
+
+	got, seen, err := getValidationDecisions(values, cfg, cells)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []validationDecision{{row: 3, submission: "12", status: validationNotApproved}, {row: 4, submission: "13", status: validationOnHold}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getValidationDecisions() = %+v, want %+v", got, want)
+	}
+	if seen[2] != cells[2] {
+		t.Errorf("moved cell = %+v, want %+v", seen[2], cells[2])
+	}
+}
+
+func TestRowsOption(t *testing.T) {
+	tests := map[string]string{
+		"Report":                       "",
+		"Report -labels":               "",
+		"Report deleted=mark":          "deleted",
+		"Report validation='approved'": "validation",
+		"Report filter='consent'":      "filter",
+	}
+	for title, want := range tests {
+		if got := rowsOption(title); got != want {
+			t.Errorf("rowsOption(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	validationApproved    = "approved"
+	validationNotApproved = "not_approved"
+	validationOnHold      = "on_hold"
+	// validationNone is a submission without a validation status.
+	validationNone = "none"
+
+	validationColumn      = "_validation_status"
+	validationLabelColumn = "_validation_status_label"
+	validationUIDPrefix   = "validation_status_"
+)
+
+// validationLabels are readable statuses, like Kobo shows them.
+var validationLabels = map[string]string{
+	validationApproved:    "Approved",
+	validationNotApproved: "Not Approved",
+	validationOnHold:      "On Hold",
+}
+
+// validationStatuses are statuses the validation option accepts.
+var validationStatuses = []string{validationApproved, validationNotApproved, validationOnHold, validationNone}
+
+var validationOption = regexp.MustCompile(` validation=["']([^"']*)["']`)
+
+// getValidationStatuses parses " validation='approved,on_hold'" from the title.
+// The statuses are approved, not_approved, on_hold and none, other values are logged
+// and skipped. The result is not nil with the option, so no status keeps no rows.
+func getValidationStatuses(title string) []string {
+	matches := validationOption.FindStringSubmatch(title)
+	if len(matches) < 2 {
+		return nil
+	}
+	statuses := []string{}
+	for _, status := range strings.Split(matches[1], ",") {
+		status = strings.ToLower(strings.TrimSpace(status))
+		switch {
+		case status == "":
+		case containsString(validationStatuses, status):
+			statuses = append(statuses, status)
+		default:
+			logrus.WithFields(logrus.Fields{"spreadsheet_name": title, "status": status}).Error("unknown validation status, use approved, not_approved, on_hold or none")
+		}
+	}
+	return statuses
+}
+
+// parseValidationStatus returns the status code of a _validation_status value: a JSON
+// object from the data API, a status uid or a label from exports. It is none when empty.
+func parseValidationStatus(value string) string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "{") {
+		var status struct {
+			UID string `json:"uid"`
+		}
+		if err := json.Unmarshal([]byte(value), &status); err == nil {
+			value = status.UID
+		}
+	}
+	if value == "" {
+		return validationNone
+	}
+	value = strings.TrimPrefix(strings.ToLower(value), validationUIDPrefix)
+	return strings.ReplaceAll(value, " ", "_")
+}
+
+// ValidationLink adds the server-side filter by validation status to a JSON data link.
+// Submissions without status cannot be queried, so with "none" the link is not changed
+// and the filter is applied only to the records. With " deleted=..." all submissions
+// are needed to tell deleted ones from filtered ones, so the link is not changed either.
+func ValidationLink(spreadSheetName string, link string) string {
+	statuses := getValidationStatuses(spreadSheetName)
+	if statuses == nil || containsString(statuses, validationNone) || getDeletedMode(spreadSheetName) != "" {
+		return link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+
+	uids := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		uids = append(uids, validationUIDPrefix+status)
+	}
+	query, _ := json.Marshal(map[string]interface{}{
+		validationColumn + ".uid": map[string][]string{"$in": uids},
+	})
+	values := u.Query()
+	values.Set("query", string(query))
+	u.RawQuery = values.Encode()
+	return u.String()
+}
+
+// validationFilter keeps submissions with statuses from " validation='approved'" and adds
+// the readable status after the _validation_status column with " -validation-label".
+// It is applied to the export before other options.
+type validationFilter struct {
+	column   int
+	statuses []string
+	label    bool
+}
+
+// newValidationFilter returns nil when the job has no validation options or the header
+// has no _validation_status column.
+func newValidationFilter(spreadSheetName string, header []string) *validationFilter {
+	statuses := getValidationStatuses(spreadSheetName)
+	label := strings.Contains(spreadSheetName, " -validation-label")
+	if statuses == nil && !label {
+		return nil
+	}
+	for i, title := range header {
+		if title == validationColumn {
+			return &validationFilter{column: i, statuses: statuses, label: label}
+		}
+	}
+	return nil
+}
+
+// status returns the status code of the data row.
+func (v *validationFilter) status(row []string) string {
+	if v.column >= len(row) {
+		return validationNone
+	}
+	return parseValidationStatus(row[v.column])
+}
+
+// keeps reports whether the data row has one of the statuses.
+func (v *validationFilter) keeps(row []string) bool {
+	return v.statuses == nil || containsString(v.statuses, v.status(row))
+}
+
+// apply returns the row with the label column, the row is dropped when the second result is false.
+func (v *validationFilter) apply(row []string, isHeader bool) ([]string, bool) {
+	status := ""
+	if !isHeader {
+		if !v.keeps(row) {
+			return nil, false
+		}
+		status = v.status(row)
+	}
+	if !v.label {
+		return row, true
+	}
+
+	label := validationLabelColumn
+	if !isHeader {
+		label = validationLabels[status]
+	}
+	end := v.column + 1
+	if end > len(row) {
+		end = len(row)
+	}
+	result := make([]string, 0, len(row)+1)
+	result = append(result, row[:end]...)
+	result = append(result, label)
+	result = append(result, row[end:]...)
+	return result, true
+}
+
+// validationDropped returns _uuid of submissions dropped by validation options of sheets with
+// the _validation_status column. Rows of other sheets with the validation option are dropped
+// with their submission by _submission__uuid.
+func validationDropped(id int, spreadSheetName string, workbook Workbook) (map[string]bool, error) {
+	dropped := make(map[string]bool)
+	for sheetName, sheet := range workbook {
+		header := sheet.Records.Header()
+		options, _ := getTabOptions(id, spreadSheetName, sheetName)
+		v := newValidationFilter(options, header)
+		uuidColumn := columnIndex(header, "_uuid")
+		if v == nil || uuidColumn < 0 {
+			continue
+		}
+		err := sheet.Records.Each(func(i int, row []string) error {
+			if i > 0 && !v.keeps(row) && uuidColumn < len(row) && row[uuidColumn] != "" {
+				dropped[row[uuidColumn]] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dropped, nil
+}
+
+// columnIndex returns the index of the column in the header, -1 if there is none.
+func columnIndex(header []string, column string) int {
+	for i, title := range header {
+		if title == column {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseValidationStatus(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`{"uid": "validation_status_approved", "label": "Approved"}`, validationApproved},
+		{"validation_status_on_hold", validationOnHold},
+		{"Not Approved", validationNotApproved},
+		{"", validationNone},
+		{"{}", validationNone},
+	}
+	for _, tt := range tests {
+		if got := parseValidationStatus(tt.value); got != tt.want {
+			t.Errorf("parseValidationStatus(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestValidationLink(t *testing.T) {
+	link := "https://eu.kobotoolbox.org/api/v2/assets/aBc/data/?format=json"
+	got, err := url.Parse(ValidationLink("Report validation='approved'", link))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"_validation_status.uid":{"$in":["validation_status_approved"]}}`; got.Query().Get("query") != want {
+		t.Errorf("query = %q, want %q", got.Query().Get("query"), want)
+	}
+	if got.Query().Get("format") != "json" {
+		t.Error("format is lost")
+	}
+
+	for _, title := range []string{"Report", "Report validation='approved,none'"} {
+		if got := ValidationLink(title, link); got != link {
+			t.Errorf("ValidationLink(%q) = %q, want the link", title, got)
+		}
+	}
+}
+
+func TestFilterValidation(t *testing.T) {
+	records := [][]string{
+		{"name", "_validation_status", "_uuid"},
+		{"Frank", "Approved", "u1"},
+		{"John", "On Hold", "u2"},
+		{"Anna", "", "u3"},
+	}
+
+	got, _ := prepareRows(t, "Report validation='approved,none' -validation-label", records, nil)
+	want := [][]string{
+		{"name", "_validation_status", "_validation_status_label", "_uuid"},
+		{"Frank", "Approved", "Approved", "u1"},
+		{"Anna", "", "", "u3"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("prepared records = %q, want %q", got, want)
+	}
+
+	if got, _ := prepareRows(t, "Report", records, nil); !reflect.DeepEqual(got, records) {
+		t.Errorf("records are changed without options: %q", got)
+	}
+}
+
+func TestFilterValidationXLS(t *testing.T) {
+	workbook := workbookOf(t, map[string][][]string{
+		"main": {
+			{"name", "_validation_status", "_uuid"},
+			{"Frank", "Approved", "u1"},
+			{"John", "Not Approved", "u2"},
+		},
+		"members": {
+			{"m_name", "_submission__uuid"},
+			{"Anna", "u1"},
+			{"Olha", "u2"},
+		},
+	})
+
+	tabs, err := prepareXLSTabs(0, "Report validation='approved'", workbook, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTabs(tabs)
+	if want := [][]string{{"name", "_validation_status", "_uuid"}, {"Frank", "Approved", "u1"}}; !reflect.DeepEqual(allRows(t, tabs["main"].records), want) {
+		t.Errorf("main = %q, want %q", allRows(t, tabs["main"].records), want)
+	}
+	if want := [][]string{{"m_name", "_submission__uuid"}, {"Anna", "u1"}}; !reflect.DeepEqual(allRows(t, tabs["members"].records), want) {
+		t.Errorf("members = %q, want %q", allRows(t, tabs["members"].records), want)
+	}
+	if workbook["members"].Records.Len() != 3 {
+		t.Error("the source workbook is changed")
+	}
+}
+
+func TestGetValidationStatuses(t *testing.T) {
+	if got := getValidationStatuses("Report validation='Approved, aproved,none'"); !reflect.DeepEqual(got, []string{"approved", "none"}) {
+		t.Errorf("getValidationStatuses() = %q", got)
+	}
+	// Жодного відомого статусу: фільтр лишається і не пропускає рядків
+	if got := getValidationStatuses("Report validation='aproved'"); got == nil || len(got) != 0 {
+		t.Errorf("getValidationStatuses() with unknown status = %q", got)
+	}
+	if got := getValidationStatuses("Report"); got != nil {
+		t.Errorf("getValidationStatuses() without the option = %q", got)
+	}
+}
+
+func TestFilterValidationXLSApplyTo(t *testing.T) {
+	sheets := map[string][][]string{
+		"main": {
+			{"name", "_validation_status", "_uuid"},
+			{"Frank", "Approved", "u1"},
+			{"John", "Not Approved", "u2"},
+		},
+		"members": {
+			{"m_name", "_submission__uuid"},
+			{"Anna", "u1"},
+			{"Olha", "u2"},
+		},
+	}
+	workbook := workbookOf(t, sheets)
+
+	tabs, err := prepareXLSTabs(0, "Report validation='approved' apply-to='members'", workbook, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTabs(tabs)
+	if got := allRows(t, tabs["main"].records); !reflect.DeepEqual(got, sheets["main"]) {
+		t.Errorf("main = %q, want it unfiltered", got)
+	}
+	if got := allRows(t, tabs["members"].records); !reflect.DeepEqual(got, sheets["members"]) {
+		t.Errorf("members = %q, want it unfiltered", got)
+	}
+
+	tabs, err = prepareXLSTabs(0, "Report validation='approved' apply-to='main'", workbook, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTabs(tabs)
+	if main, members := allRows(t, tabs["main"].records), allRows(t, tabs["members"].records); len(main) != 2 || !reflect.DeepEqual(members, sheets["members"]) {
+		t.Errorf("main = %q, members = %q", main, members)
+	}
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/sheets/v4"
+)
+
+// ErrAppendUnsupported is returned by AppendSubmission when the job needs a full run instead.
+var ErrAppendUnsupported = errors.New("submission cannot be appended")
+
+// SubmissionAsset returns the asset uid of a submission posted by a Kobo REST Service.
+func SubmissionAsset(submission []byte) (string, error) {
+	var s struct {
+		Asset string `json:"_xform_id_string"`
+	}
+	if err := json.Unmarshal(submission, &s); err != nil {
+		return "", fmt.Errorf("invalid submission: %w", err)
+	}
+	if s.Asset == "" {
+		return "", fmt.Errorf("submission has no _xform_id_string")
+	}
+	return s.Asset, nil
+}
+
+// AssetUID returns the asset uid of the export link, empty if there is none.
+func AssetUID(link string) string {
+	_, after, found := strings.Cut(link, "/api/v2/assets/")
+	if !found {
+		return ""
+	}
+	uid, _, _ := strings.Cut(after, "/")
+	return uid
+}
+
+// appendBlocker returns the job option the appended row cannot follow, empty if there is none.
+// Such jobs change columns or rows of the export, so they are run instead.
+func appendBlocker(spreadSheetName string) string {
+	switch {
+	case strings.Contains(spreadSheetName, " -wot"):
+		return "-wot"
+	case strings.Contains(spreadSheetName, " -idx"):
+		return "-idx"
+	case strings.Contains(spreadSheetName, " filter='"):
+		return "filter"
+	case needsForm(spreadSheetName):
+		return "form options"
+	case getGeoColumns(spreadSheetName) != nil:
+		return "geo"
+	case getValidationStatuses(spreadSheetName) != nil || strings.Contains(spreadSheetName, " -validation-label"):
+		return "validation"
+	case needsMedia(spreadSheetName):
+		return "media"
+	case hasColumnTypes(spreadSheetName):
+		// Рядок пишеться як USER_ENTERED, а типізовані колонки — RAW
+		return "column types"
+	case getDeletedMode(spreadSheetName) == deletedMark || getDeletedMode(spreadSheetName) == deletedArchive:
+		// Доданий рядок не має колонки позначки і не відстежується до повного запуску
+		return "deleted=" + getDeletedMode(spreadSheetName)
+	}
+	return ""
+}
+
+// submissionRow maps fields of the submission to the header by full path or by question name.
+// Repeat groups are skipped. The second result is false when no column matches.
+func submissionRow(header []string, fields []jsonField) ([]string, bool) {
+	values := make(map[string]string, len(fields))
+	names := make(map[string]string, len(fields))
+	for _, field := range fields {
+		if strings.HasPrefix(strings.TrimSpace(string(field.value)), "[{") {
+			continue
+		}
+		text := jsonText(field.value)
+		values[field.key] = text
+		if _, name, found := cutLast(field.key, "/"); found {
+			names[name] = text
+		}
+	}
+
+	row := make([]string, len(header))
+	matched := false
+	for i, title := range header {
+		if value, ok := values[title]; ok {
+			row[i], matched = value, true
+		} else if value, ok := names[title]; ok {
+			row[i], matched = value, true
+		}
+	}
+	return row, matched
+}
+
+// AppendSubmission appends a submission posted by a Kobo REST Service below the records
+// of the job range. The header row is read from the first row of the range, submissions
+// already in the _uuid column are skipped. The next poll rewrites the range as usual.
+// Jobs with an export task are run instead, their columns follow the task settings.
+func (e *ExpImp) AppendSubmission(id int, credentials string, spreadSheetName string, spreadsheetId string, sheetName string, submission []byte) error {
+	if ExportTaskKey(id) != "" {
+		return fmt.Errorf("%w: job has an export task", ErrAppendUnsupported)
+	}
+	if option := appendBlocker(spreadSheetName); option != "" {
+		return fmt.Errorf("%w: job has %s option", ErrAppendUnsupported, option)
+	}
+	fields, err := parseJSONObject(submission)
+	if err != nil {
+		return fmt.Errorf("invalid submission: %w", err)
+	}
+	tab := getTabName(sheetName)
+	if tab == "" {
+		return fmt.Errorf("%w: tab of the range is not set", ErrAppendUnsupported)
+	}
+	firstRow := getStringNumber(sheetName)
+	if firstRow < 1 {
+		firstRow = 1
+	}
+
+	ctx := context.Background()
+	srv, err := e.getService(credentials)
+	if err != nil {
+		return err
+	}
+	header, err := readValues(ctx, srv, spreadsheetId, fmt.Sprintf("%s!A%d:XYZ%d", quoteTab(tab), firstRow, firstRow), "FORMATTED_VALUE")
+	if err != nil {
+		return fmt.Errorf("error while reading header: %w", err)
+	}
+	if len(header) == 0 || columnIndex(header[0], uuidColumn) < 0 {
+		return fmt.Errorf("%w: header with _uuid not found", ErrAppendUnsupported)
+	}
+	row, ok := submissionRow(header[0], fields)
+	if !ok {
+		return fmt.Errorf("%w: no header column matches the submission", ErrAppendUnsupported)
+	}
+
+	column := columnIndex(header[0], uuidColumn)
+	uuid := row[column]
+	if uuid != "" {
+		uuids, err := readValues(ctx, srv, spreadsheetId, fmt.Sprintf("%s!%s%d:%[2]s", quoteTab(tab), columnName(column), firstRow+1), "FORMATTED_VALUE")
+		if err != nil {
+			return fmt.Errorf("error while reading _uuid column: %w", err)
+		}
+		for _, value := range uuids {
+			if len(value) > 0 && value[0] == uuid {
+				logrus.WithFields(logrus.Fields{"tab": tab, "uuid": uuid}).Info("Submission is already in the sheet")
+				return nil
+			}
+		}
+	}
+
+	opts := writeOptions{sanitize: getSanitizePolicy(spreadSheetName)}
+	opts.numeric = resolveNumericColumns(header[0], getNumericColumns(spreadSheetName))
+	_, err = srv.Spreadsheets.Values.Append(spreadsheetId, fmt.Sprintf("%s!A%d", quoteTab(tab), firstRow), &sheets.ValueRange{
+		Values: e.convertValues([][]string{row}, opts),
+	}).ValueInputOption(opts.inputOption()).InsertDataOption("INSERT_ROWS").Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error while appending submission: %w", err)
+	}
+	logrus.WithFields(logrus.Fields{"tab": tab, "uuid": uuid}).Info("Submission is appended")
+	return nil
+}
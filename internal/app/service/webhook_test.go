@@ -0,0 +1,73 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/app/repository"
+)
+
+func TestSubmissionAsset(t *testing.T) {
+	uid, err := SubmissionAsset([]byte(`{"_id": 5, "_xform_id_string": "aBc123"}`))
+	if err != nil || uid != "aBc123" {
+		t.Errorf("SubmissionAsset() = %q, %v", uid, err)
+	}
+	if _, err := SubmissionAsset([]byte(`{"_id": 5}`)); err == nil {
+		t.Error("SubmissionAsset() accepts a submission without asset")
+	}
+	if got := AssetUID("https://eu.kobotoolbox.org/api/v2/assets/aBc123/export-settings/es1/data.csv"); got != "aBc123" {
+		t.Errorf("AssetUID() = %q", got)
+	}
+}
+
+func TestAppendBlocker(t *testing.T) {
+	tests := map[string]string{
+		"Report":                       "",
+		"Report deleted=remove":        "",
+		"Report deleted=mark":          "deleted=mark",
+		"Report deleted=archive":       "deleted=archive",
+		"Report -wot":                  "-wot",
+		"Report filter='consent'":      "filter",
+		"Report -labels":               "form options",
+		"Report validation='approved'": "validation",
+		"Report -idx -sanitize=strip":  "-idx",
+		"Report media='photo'":         "media",
+		"Report types='age:integer'":   "column types",
+	}
+	for title, want := range tests {
+		if got := appendBlocker(title); got != want {
+			t.Errorf("appendBlocker(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestSubmissionRow(t *testing.T) {
+	fields, err := parseJSONObject([]byte(`{"_id": 7, "grp/name": "Olena", "age": "30",
+		"kids": [{"kids/name": "A"}], "tags": ["a", "b"], "_uuid": "u1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, ok := submissionRow([]string{"name", "age", "tags", "kids", "_uuid", "_id", "other"}, fields)
+	want := []string{"Olena", "30", "a b", "", "u1", "7", ""}
+	if !ok || !reflect.DeepEqual(row, want) {
+		t.Errorf("submissionRow() = %q, %v, want %q", row, ok, want)
+	}
+
+	if _, ok := submissionRow([]string{"Name", "Age"}, fields); ok {
+		t.Error("submissionRow() matches a header without submission columns")
+	}
+}
+
+func TestAppendSubmissionExportTask(t *testing.T) {
+	config.SetJobs([]config.JobConfig{{ID: 4, Export: &config.ExportTask{Type: "csv", Lang: "English (en)"}}})
+	defer config.SetJobs(nil)
+
+	// Колонки експорту за завданням можуть не збігатися із заголовком аркуша
+	err := NewExpImp(repository.Repository{}).AppendSubmission(4, "creds", "Report", "sheet", "kobo", []byte(`{"_uuid": "u1"}`))
+	if !errors.Is(err, ErrAppendUnsupported) {
+		t.Errorf("AppendSubmission() = %v, want ErrAppendUnsupported", err)
+	}
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/sheets/v4"
+)
+
+// xlsTab is a workbook sheet prepared for writing. Previous uuids of deleted are set by the importer.
+type xlsTab struct {
+	*preparedRange
+	target     string
+	sheetRange string
+	index      *int
+	color      string
+}
+
+var applyToOption = regexp.MustCompile(` apply-to=["']([^"']*)["']`)
+
+// getApplyTo returns sheets from " apply-to='sheet1,sheet2'", job options are
+// applied only to them. Nil means every sheet.
+func getApplyTo(title string) []string {
+	matches := applyToOption.FindStringSubmatch(title)
+	if len(matches) < 2 {
+		return nil
+	}
+	var sheetNames []string
+	for _, sheetName := range strings.Split(matches[1], ",") {
+		if sheetName = strings.TrimSpace(sheetName); sheetName != "" {
+			sheetNames = append(sheetNames, sheetName)
+		}
+	}
+	return sheetNames
+}
+
+// getTabOptions returns options and range for the source sheet of the job.
+// Job options apply to every sheet or to sheets from apply-to, and are
+// replaced by options of the sheet from config. The range is in the target tab.
+func getTabOptions(id int, spreadSheetName string, sheetName string) (string, string) {
+	options := spreadSheetName
+	if applyTo := getApplyTo(spreadSheetName); applyTo != nil && !containsString(applyTo, sheetName) {
+		options = ""
+	}
+
+	target := sheetName
+	sheetRange := ""
+	if tab, ok := config.GetTab(id, sheetName); ok {
+		if tab.Options != "" {
+			options = " " + tab.Options
+		}
+		if tab.Name != "" {
+			target = tab.Name
+		}
+		sheetRange = tab.Range
+	}
+	if sheetRange == "" {
+		return options, target
+	}
+	return options, target + "!" + sheetRange
+}
+
+// isSheetSelected checks include and exclude lists of the job.
+func isSheetSelected(id int, sheetName string) bool {
+	job := config.Jobs[id]
+	if len(job.Include) > 0 && !containsString(job.Include, sheetName) {
+		return false
+	}
+	return !containsString(job.Exclude, sheetName)
+}
+
+// prepareXLSTabs applies validation, one-hot, geo, -idx, filter, -wot, label and deleted options to every sheet of the workbook.
+// Column types of xlsx cells are used unless the title has " -xls-strings",
+// types from config and title take precedence over them. The caller must close the tabs.
+func prepareXLSTabs(id int, spreadSheetName string, workbook Workbook, types map[string]string, form *models.Form) (map[string]xlsTab, error) {
+	dropped, err := validationDropped(id, spreadSheetName, workbook)
+	if err != nil {
+		return nil, err
+	}
+
+	tabs := make(map[string]xlsTab, len(workbook))
+	for sheetName, sheet := range workbook {
+		if !isSheetSelected(id, sheetName) {
+			continue
+		}
+
+		options, sheetRange := getTabOptions(id, spreadSheetName, sheetName)
+		if !strings.Contains(sheetRange, "!") {
+			sheetRange += "!A1:XYZ"
+		}
+
+		sheetTypes := make(map[string]string)
+		if !strings.Contains(spreadSheetName, " -xls-strings") {
+			for column, columnType := range sheet.Types {
+				sheetTypes[column] = columnType
+			}
+		}
+		for column, columnType := range types {
+			sheetTypes[column] = columnType
+		}
+
+		prepared, err := prepareRange(sheet.Records, rangeOptions{
+			title:      spreadSheetName,
+			options:    idxOptions(options, sheet.Records.Header()),
+			sheetRange: sheetRange,
+			types:      sheetTypes,
+			form:       form,
+			dropped:    dropped,
+		})
+		if err != nil {
+			closeTabs(tabs)
+			return nil, fmt.Errorf("sheet %s: %w", sheetName, err)
+		}
+
+		tab := xlsTab{
+			preparedRange: prepared,
+			target:        getTabName(sheetRange),
+			sheetRange:    sheetRange,
+		}
+		if tabConfig, ok := config.GetTab(id, sheetName); ok {
+			tab.index = tabConfig.Index
+			tab.color = tabConfig.Color
+		}
+		tabs[sheetName] = tab
+	}
+	return tabs, nil
+}
+
+// closeTabs removes spools of the tabs.
+func closeTabs(tabs map[string]xlsTab) {
+	for _, tab := range tabs {
+		tab.close()
+	}
+}
+
+var idxFlag = regexp.MustCompile(` -idx( |$)`)
+
+// idxOptions drops -idx from options of a sheet without the _index column,
+// so a job-level -idx applies only to sheets that have it.
+func idxOptions(options string, header []string) string {
+	if !idxFlag.MatchString(options) || columnIndex(header, "_index") >= 0 {
+		return options
+	}
+	logrus.WithFields(logrus.Fields{"spreadsheet_name": options}).Debug("Sheet has no _index, -idx is skipped")
+	return idxFlag.ReplaceAllString(options, "$1")
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hashKey describes where and how the records are written, it is hashed with them.
+func (tab xlsTab) hashKey() string {
+	key := tab.sheetRange + tab.opts.hashKey() + tab.color
+	if tab.deleted != nil {
+		key += tab.deleted.mode
+	}
+	if tab.index != nil {
+		key += fmt.Sprintf("#%d", *tab.index)
+	}
+	return key
+}
+
+// properties returns properties of the target tab from config and the field mask.
+// The index is set by orderTabs for all tabs at once.
+func (tab xlsTab) properties() (*sheets.SheetProperties, string) {
+	properties := &sheets.SheetProperties{Title: tab.target}
+	var fields []string
+	if tab.color != "" {
+		color, err := parseColor(tab.color)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"tab": tab.target, "error": err}).Warn("Tab color is skipped")
+		} else {
+			properties.TabColorStyle = &sheets.ColorStyle{RgbColor: color}
+			fields = append(fields, "tabColorStyle")
+		}
+	}
+	return properties, strings.Join(fields, ",")
+}
+
+// orderTabs returns requests that move tabs of the spreadsheet to indexes from config.
+// Tabs are placed by configured index, tabs without one keep their relative order.
+// Requests are built from the final order front to back, so each one moves a tab back
+// to a position before it and the indexes of the batch do not depend on each other.
+func orderTabs(spreadSheet *sheets.Spreadsheet, tabs map[string]xlsTab) []*sheets.Request {
+	ids := make(map[string]int64, len(spreadSheet.Sheets))
+	var current []string
+	for _, s := range spreadSheet.Sheets {
+		ids[s.Properties.Title] = s.Properties.SheetId
+		current = append(current, s.Properties.Title)
+	}
+
+	var indexed []xlsTab
+	placed := make(map[string]bool)
+	for _, tab := range tabs {
+		if _, ok := ids[tab.target]; ok && tab.index != nil && !placed[tab.target] {
+			indexed = append(indexed, tab)
+			placed[tab.target] = true
+		}
+	}
+	if len(indexed) == 0 {
+		return nil
+	}
+	sort.Slice(indexed, func(i, j int) bool {
+		if *indexed[i].index != *indexed[j].index {
+			return *indexed[i].index < *indexed[j].index
+		}
+		return indexed[i].target < indexed[j].target
+	})
+
+	var order []string
+	for _, title := range current {
+		if !placed[title] {
+			order = append(order, title)
+		}
+	}
+	for _, tab := range indexed {
+		index := *tab.index
+		if index < 0 {
+			index = 0
+		}
+		if index > len(order) {
+			index = len(order)
+		}
+		order = append(order[:index], append([]string{tab.target}, order[index:]...)...)
+	}
+
+	var requests []*sheets.Request
+	for position, title := range order {
+		if current[position] == title {
+			continue
+		}
+		for i := position + 1; i < len(current); i++ {
+			if current[i] == title {
+				current = append(current[:i], current[i+1:]...)
+				break
+			}
+		}
+		current = append(current[:position], append([]string{title}, current[position:]...)...)
+		requests = append(requests, &sheets.Request{
+			UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+				Properties: &sheets.SheetProperties{
+					SheetId:         ids[title],
+					Index:           int64(position),
+					ForceSendFields: []string{"SheetId", "Index"},
+				},
+				Fields: "index",
+			},
+		})
+	}
+	return requests
+}
+
+// parseColor parses "#RRGGBB".
+func parseColor(hex string) (*sheets.Color, error) {
+	var r, g, b uint8
+	if _, err := fmt.Sscanf(hex, "#%02x%02x%02x", &r, &g, &b); err != nil {
+		return nil, fmt.Errorf("invalid color %q: %w", hex, err)
+	}
+	return &sheets.Color{
+		Red:   float64(r) / 255,
+		Green: float64(g) / 255,
+		Blue:  float64(b) / 255,
+	}, nil
+}
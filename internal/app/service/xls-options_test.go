@@ -0,0 +1,220 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+)
+
+func TestGetTabOptions(t *testing.T) {
+	config.SetJobs([]config.JobConfig{
+		{ID: 7, Tabs: []config.TabConfig{{Sheet: "roster", Options: "-wot", Range: "A10:XYZ"}}},
+	})
+	defer config.SetJobs(nil)
+
+	title := "Report -idx filter='consent' apply-to='main,roster'"
+
+	options, sheetRange := getTabOptions(7, title, "main")
+	if options != title || sheetRange != "main" {
+		t.Errorf("main: got %q, %q", options, sheetRange)
+	}
+
+	options, sheetRange = getTabOptions(7, title, "roster")
+	if options != " -wot" || sheetRange != "roster!A10:XYZ" {
+		t.Errorf("roster: got %q, %q", options, sheetRange)
+	}
+
+	options, _ = getTabOptions(7, title, "other")
+	if options != "" {
+		t.Errorf("other: got %q, want no options", options)
+	}
+}
+
+func TestPrepareXLSTabs(t *testing.T) {
+	workbook := workbookOf(t, map[string][][]string{
+		"main": {
+			{"name", "consent", "_index"},
+			{"Frank", "1", "1"},
+			{"John", "0", "2"},
+		},
+		"roster": {
+			{"member", "_index"},
+			{"Anna", "1"},
+		},
+	})
+
+	tabs, err := prepareXLSTabs(1, "Report -wot filter='consent' apply-to='main'", workbook, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTabs(tabs)
+
+	main := tabs["main"]
+	if records := allRows(t, main.records); main.sheetRange != "main!A1:XYZ" || len(records) != 1 || records[0][0] != "Frank" || main.opts.header {
+		t.Errorf("main: unexpected tab %+v, records %q", main, records)
+	}
+
+	roster := tabs["roster"]
+	if roster.records.Len() != 2 || !roster.opts.header {
+		t.Errorf("roster: unexpected tab %+v", roster)
+	}
+}
+
+func TestPrepareXLSTabsIdx(t *testing.T) {
+	workbook := workbookOf(t, map[string][][]string{
+		"main": {
+			{"name", "_index"},
+			{"Frank", "1"},
+		},
+		"notes": {
+			{"note", "_submission__uuid"},
+			{"checked", "u1"},
+		},
+	})
+
+	// Аркуш без _index не ламає завдання з -idx
+	tabs, err := prepareXLSTabs(1, "Report -idx", workbook, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTabs(tabs)
+	if got := allRows(t, tabs["notes"].records); got[1][0] != "checked" {
+		t.Errorf("notes = %q", got)
+	}
+	if idxOptions("Report -idx -wot", []string{"note"}) != "Report -wot" || idxOptions("Report -idx", []string{"_index"}) != "Report -idx" {
+		t.Error("idxOptions() changes the wrong sheets")
+	}
+}
+
+func TestSelectAndRenameTabs(t *testing.T) {
+	index := 0
+	config.SetJobs([]config.JobConfig{
+		{
+			ID:      3,
+			Exclude: []string{"assets"},
+			Tabs:    []config.TabConfig{{Sheet: "roster", Name: "Members", Index: &index, Color: "#FF8000"}},
+		},
+	})
+	defer config.SetJobs(nil)
+
+	workbook := workbookOf(t, map[string][][]string{
+		"main":   {{"name"}},
+		"roster": {{"member"}},
+		"assets": {{"asset"}},
+	})
+
+	tabs, err := prepareXLSTabs(3, "Report", workbook, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTabs(tabs)
+	if len(tabs) != 2 {
+		t.Fatalf("len(tabs) = %d, want 2", len(tabs))
+	}
+
+	roster := tabs["roster"]
+	if roster.target != "Members" || roster.sheetRange != "Members!A1:XYZ" {
+		t.Errorf("roster: unexpected target %q, range %q", roster.target, roster.sheetRange)
+	}
+
+	properties, fields := roster.properties()
+	if fields != "tabColorStyle" || properties.TabColorStyle.RgbColor.Red != 1 {
+		t.Errorf("roster: unexpected properties %+v, fields %q", properties, fields)
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	color, err := parseColor("#00FF80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if color.Red != 0 || color.Green != 1 || color.Blue != float64(0x80)/255 {
+		t.Errorf("parseColor() = %+v", color)
+	}
+
+	if _, err := parseColor("green"); err == nil {
+		t.Error("parseColor() of invalid color should fail")
+	}
+}
+
+func TestGetVanishedTabs(t *testing.T) {
+	config.SetJobs([]config.JobConfig{{ID: 5, RemoveVanished: true}})
+	defer config.SetJobs(nil)
+
+	state := models.JobState{Tabs: map[string]models.TabState{
+		"main":   {Target: "main", Created: true},
+		"old":    {Target: "Old repeat", Created: true},
+		"manual": {Target: "manual"},
+	}}
+	workbook := workbookOf(t, map[string][][]string{"main": {{"name"}}})
+
+	got := getVanishedTabs(5, state, workbook)
+	if len(got) != 1 || got["old"] != "Old repeat" {
+		t.Errorf("getVanishedTabs() = %v", got)
+	}
+
+	if got := getVanishedTabs(6, state, workbook); len(got) != 0 {
+		t.Errorf("getVanishedTabs() without remove-vanished = %v", got)
+	}
+}
+
+func TestPrepareXLSTabsTypes(t *testing.T) {
+	workbook := Workbook{
+		"main": {
+			Records: recordsOf(t, [][]string{{"start", "age", "name"}, {"2024-03-01", "42", "Frank"}}),
+			Types:   map[string]string{"start": typeDate, "age": typeNumber, "name": typeText},
+		},
+	}
+
+	tabs, err := prepareXLSTabs(1, "Report", workbook, map[string]string{"age": typeInteger}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTabs(tabs)
+	want := []string{typeDate, typeInteger, typeText}
+	if got := tabs["main"].opts.types; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("types = %v, want %v", got, want)
+	}
+
+	tabs, err = prepareXLSTabs(1, "Report -xls-strings", workbook, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTabs(tabs)
+	if got := tabs["main"].opts.types; got != nil {
+		t.Errorf("types with -xls-strings = %v, want nil", got)
+	}
+}
+
+func TestPrepareXLSTabsSpilled(t *testing.T) {
+	config.SetStreaming(200, t.TempDir(), 0)
+	defer config.SetStreaming(0, "", 0)
+
+	rows := [][]string{{"name", "consent", "_index"}}
+	for i := 1; i <= 20; i++ {
+		rows = append(rows, []string{fmt.Sprintf("name %d", i), strconv.Itoa(i % 2), strconv.Itoa(i)})
+	}
+	workbook := workbookOf(t, map[string][][]string{"main": rows})
+	if !workbook["main"].Records.Spilled() {
+		t.Fatal("sheet is not spilled over the memory limit")
+	}
+
+	tabs, err := prepareXLSTabs(1, "Report filter='consent'", workbook, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTabs(tabs)
+
+	main := tabs["main"]
+	if !main.records.Spilled() {
+		t.Error("prepared records are not spilled over the memory limit")
+	}
+	got := allRows(t, main.records)
+	if len(got) != 11 || got[1][0] != "name 1" || got[10][0] != "name 19" {
+		t.Errorf("main = %q", got)
+	}
+}
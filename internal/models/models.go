@@ -15,3 +15,118 @@ type Data struct {
 	APIKey          string
 	LastResult      sql.NullString
 }
+
+// KoboAsset is a form of a Kobo account with its export settings.
+type KoboAsset struct {
+	UID            string          `json:"uid"`
+	Name           string          `json:"name"`
+	Deployed       bool            `json:"deployed"`
+	Submissions    int             `json:"submissions"`
+	ExportSettings []ExportSetting `json:"export_settings"`
+}
+
+// ExportSetting is a saved export of an asset with its links like …/export-settings/{uid}/data.csv.
+type ExportSetting struct {
+	UID     string `json:"uid"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	CSVLink string `json:"csv_link"`
+	XLSLink string `json:"xls_link"`
+}
+
+// JobState keeps what the app remembers about a job between runs.
+type JobState struct {
+	Tabs map[string]TabState `json:"tabs"`
+	// Media are links to stored attachments by media key.
+	Media map[string]string `json:"media,omitempty"`
+	// MediaSecret is the random key of tokens in media keys, so links cannot be guessed.
+	MediaSecret string `json:"media_secret,omitempty"`
+	// Validation are validation statuses sent to Kobo by submission id.
+	Validation map[string]ValidationWrite `json:"validation,omitempty"`
+	// ValidationCells are decision cells of the validation column by sheet row,
+	// with the _id they were first seen next to.
+	ValidationCells map[int]ValidationCell `json:"validation_cells,omitempty"`
+	// Columns are columns of JSON export sheets by sheet name, in the order they are written.
+	Columns map[string][]string `json:"columns,omitempty"`
+	// Repeats are sheet names of JSON export repeat groups by group path, so groups
+	// with the same name keep their sheets when they come in another order.
+	Repeats map[string]string `json:"repeats,omitempty"`
+}
+
+// ExportState keeps exports created on demand, they are shared by jobs with the same
+// form and export parameters.
+type ExportState struct {
+	// Exports are links of exports by asset and export parameters, the latest last.
+	Exports map[string][]string `json:"exports"`
+}
+
+// ValidationWrite is a validation decision taken from a sheet row and sent to Kobo.
+type ValidationWrite struct {
+	Status string `json:"status"`
+	Row    int    `json:"row"`
+	Sent   string `json:"sent"`
+}
+
+// ValidationCell is a decision value in the validation column and the _id of its row
+// when the value was first seen.
+type ValidationCell struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+// TabState describes the last successful write to one sheet tab.
+type TabState struct {
+	Rows int    `json:"rows"`
+	Hash string `json:"hash,omitempty"`
+	// Width is the number of columns written, cells to the right of them are kept.
+	Width int `json:"width,omitempty"`
+	// Target is the tab name the sheet was written to, Created is true
+	// when the tab was added by the app.
+	Target  string `json:"target,omitempty"`
+	Created bool   `json:"created,omitempty"`
+	// UUIDs are _uuid of submissions in the tab, kept with " deleted=..." to find deleted ones.
+	UUIDs []string `json:"uuids,omitempty"`
+}
+
+// SheetDiff describes what a write would change in a sheet range.
+type SheetDiff struct {
+	Range   string
+	Added   []RowDiff
+	Changed []RowDiff
+	Removed []RowDiff
+}
+
+// RowDiff is one row of SheetDiff. Row is the sheet row number.
+type RowDiff struct {
+	Row   int
+	Cells []CellDiff
+}
+
+type CellDiff struct {
+	Column string
+	Old    string
+	New    string
+}
+
+// Form is the schema of a Kobo form: questions and choice lists with labels
+// in every form language.
+type Form struct {
+	// Languages are translations of the form like "English (en)", labels are in the same order.
+	Languages []string
+	Questions []Question
+	// Choices are choice lists by list name.
+	Choices map[string][]Choice
+}
+
+type Question struct {
+	Type   string
+	Name   string
+	XPath  string
+	List   string
+	Labels []string
+}
+
+type Choice struct {
+	Name   string
+	Labels []string
+}
@@ -1,9 +1,11 @@
 package app
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 	_ "time/tzdata"
 
@@ -18,19 +20,43 @@ type App struct {
 	service *service.Service
 	repo    *repository.Repository
 	client  *http.Client
+	dryRun  bool
+	// downloads are released after their last job and reset after every iteration
+	downloads *downloads
+	// events are webhook posts handled between iterations, queueMu serialises posts queuing them
+	events  chan webhookEvent
+	queueMu sync.Mutex
+	// jobs are jobs of the last iteration, webhook posts are matched to them
+	jobs       []models.Data
+	jobsLoaded bool
+	jobsMu     sync.RWMutex
 }
 
-func NewApp(dbconf repository.Config) (*App, error) {
+func NewApp(dbconf repository.Config, storage repository.StorageConfig) (*App, error) {
 	a := &App{}
 	db, err := repository.NewMariaDB(dbconf)
 	if err != nil {
 		return nil, err
 	}
-	a.repo = repository.NewRepository(db)
+	state, err := repository.NewFileState(storage.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := repository.NewFileSnapshots(storage.SnapshotDir, storage.SnapshotKeep)
+	if err != nil {
+		return nil, err
+	}
+	media, err := repository.NewMedia(storage.Media)
+	if err != nil {
+		return nil, err
+	}
+	a.repo = repository.NewRepository(db, state, snapshots, media)
 	a.service = service.NewService(*a.repo)
 	a.client = &http.Client{
 		Timeout: 10 * time.Minute,
 	}
+	a.downloads = newDownloads()
+	a.events = make(chan webhookEvent, webhookQueueSize)
 
 	return a, err
 }
@@ -56,6 +82,7 @@ func (a *App) Run(sleepTime string, logLevel string) error {
 			logrus.WithFields(logrus.Fields{"error": err}).Error("error while getting data from DB")
 			continue
 		}
+		a.setJobs(data)
 
 		filteredData := service.FilterTask(data)
 
@@ -65,6 +92,10 @@ func (a *App) Run(sleepTime string, logLevel string) error {
 
 		logrus.Info("Data is successfully sorted")
 
+		for _, dataSlice := range sortedData {
+			a.expectDownloads(dataSlice)
+		}
+
 		for keyAPI, dataSlice := range sortedData {
 			shortKeyAPI := []rune(keyAPI)
 			if len([]rune(keyAPI)) > 20 {
@@ -73,24 +104,52 @@ func (a *App) Run(sleepTime string, logLevel string) error {
 			logrus.WithFields(logrus.Fields{"api_key": string(shortKeyAPI)}).Info("Working with API-key`s set")
 
 			for _, data := range dataSlice {
-				switch {
-				case strings.HasSuffix(data.CSVLink, ".csv"):
-					a.processCSV(data)
-				case strings.HasSuffix(data.CSVLink, ".xls") || strings.HasSuffix(data.CSVLink, ".xlsx"):
-					a.processXLS(data)
-				default:
-					logrus.WithFields(logrus.Fields{"csv_link": data.CSVLink, "form_id": data.Id}).Error("wrong kobo link")
-				}
-
+				a.process(data)
 			}
 
 		}
+		a.downloads.reset()
 
 		logrus.WithFields(logrus.Fields{"wait_time": sleepTime}).Info("Iteration completed")
-		time.Sleep(sleepTimeParsedDuration)
+		a.wait(sleepTimeParsedDuration)
 	}
 }
 
+func (a *App) process(data models.Data) {
+	if key, ok := a.downloadKey(data); ok {
+		defer a.downloads.release(key)
+	}
+	switch exportKind(data) {
+	case kindCSV:
+		a.processCSV(data)
+	case kindXLS:
+		a.processXLS(data)
+	default:
+		logrus.WithFields(logrus.Fields{"csv_link": data.CSVLink, "form_id": data.Id}).Error("wrong kobo link")
+	}
+}
+
+const (
+	kindCSV = "csv"
+	kindXLS = "xls"
+)
+
+// exportKind returns how the job is exported: kindCSV, kindXLS for XLS and JSON exports,
+// or empty for a wrong link. An export task of the job takes precedence over the link.
+func exportKind(data models.Data) string {
+	switch {
+	case service.ExportTaskType(data.Id) == "csv":
+		return kindCSV
+	case service.ExportTaskType(data.Id) == "xls":
+		return kindXLS
+	case strings.HasSuffix(data.CSVLink, ".csv"):
+		return kindCSV
+	case strings.HasSuffix(data.CSVLink, ".xls") || strings.HasSuffix(data.CSVLink, ".xlsx") || isJSONLink(data.CSVLink):
+		return kindXLS
+	}
+	return ""
+}
+
 func (a *App) processCSV(data models.Data) {
 	startTime := time.Now()
 	logrus.WithFields(logrus.Fields{"csv_link": data.CSVLink, "form_id": data.Id}).Info("Working with Kobo-form`s set")
@@ -100,11 +159,13 @@ func (a *App) processCSV(data models.Data) {
 		return
 	}
 
-	var records [][]string
+	a.writeBackValidation(data)
+
+	var records *service.Records
 	var err error
 	for i := 0; i < 3; i++ {
-		records, err = a.service.Export(data.CSVLink, data.KoboToken, a.client)
-		if err == nil {
+		records, err = a.export(data)
+		if err == nil || errors.Is(err, errCreateExport) {
 			break
 		}
 		logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id, "error": err}).Errorf("attempt %d failed: error while exporting from Kobo", i+1)
@@ -117,22 +178,50 @@ func (a *App) processCSV(data models.Data) {
 		}
 		return
 	}
-	logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id, "duration": time.Since(startTime).String()}).Info("Info is obtained from form successful")
+	logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id, "duration": time.Since(startTime).String(), "spilled": records.Spilled()}).Info("Info is obtained from form successful")
 
-	if len(records) == 0 {
+	if records.Len() == 0 {
 		logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id}).Warn("No values")
 		return
 	}
 
+	form := a.service.Form(data.SpreadSheetName, data.CSVLink, data.KoboToken, a.client)
+
+	// Посилання на вкладення, у dry-run лише вже збережені
+	withMedia, err := a.service.Media(data.Id, data.SpreadSheetName, data.CSVLink, data.KoboToken, a.client, records, form, a.isDryRun(data))
+	if err != nil {
+		a.writeMediaError(data, err)
+		return
+	}
+	if withMedia != records {
+		defer withMedia.Close()
+		records = withMedia
+	}
+
+	if a.isDryRun(data) {
+		a.dryRunCSV(data, records, form)
+		return
+	}
+
+	types := a.service.ColumnTypes(data.SpreadSheetName, data.CSVLink, data.KoboToken, a.client)
+
 	importStartTime := time.Now()
 	for i := 0; i < 3; i++ {
-		err = a.service.Importer(data.APIKey, data.SpreadSheetName, data.SpreadSheetID, data.SheetName, records)
-		if err == nil {
+		err = a.service.Importer(data.Id, data.APIKey, data.SpreadSheetName, data.SpreadSheetID, data.SheetName, records, types, form)
+		if err == nil || errors.Is(err, service.ErrBlocked) || errors.Is(err, service.ErrUnchanged) {
 			break
 		}
 		logrus.WithFields(logrus.Fields{"form_name": data.FormName, "spreadsheet_name": data.SpreadSheetName, "form_id": data.Id, "error": err}).Errorf("attempt %d failed: Error while importing", i+1)
 		time.Sleep(5 * time.Second)
 	}
+	if errors.Is(err, service.ErrBlocked) {
+		a.writeBlocked(data, err)
+		return
+	}
+	if errors.Is(err, service.ErrUnchanged) {
+		a.writeUnchanged(data)
+		return
+	}
 	if err != nil {
 		logrus.WithFields(logrus.Fields{"form_name": data.FormName, "spreadsheet_name": data.SpreadSheetName, "form_id": data.Id, "error": err}).Error("Error while importing")
 		if err := a.repo.WriteInfo(data.Id, fmt.Sprintf("ERROR; %s; %s", GetTime(), fmt.Sprintf("GoogleSheets: %s", err))); err != nil {
@@ -148,6 +237,7 @@ func (a *App) processCSV(data models.Data) {
 	}
 }
 
+// processXLS imports sources with several sheets: XLS exports and JSON data with repeat groups.
 func (a *App) processXLS(data models.Data) {
 	startTime := time.Now()
 	logrus.WithFields(logrus.Fields{"csv_link": data.CSVLink, "form_id": data.Id}).Info("Working with Kobo-form`s set")
@@ -157,11 +247,13 @@ func (a *App) processXLS(data models.Data) {
 		return
 	}
 
-	var records map[string][][]string
+	a.writeBackValidation(data)
+
+	var records service.Workbook
 	var err error
 	for i := 0; i < 3; i++ {
-		records, err = a.service.ExportXLS(data.CSVLink, data.KoboToken, a.client)
-		if err == nil {
+		records, err = a.exportXLS(data)
+		if err == nil || errors.Is(err, errCreateExport) {
 			break
 		}
 		logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id, "error": err}).Errorf("attempt %d failed: error while exporting from Kobo", i+1)
@@ -176,15 +268,40 @@ func (a *App) processXLS(data models.Data) {
 	}
 	logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id, "duration": time.Since(startTime).String()}).Info("Info is obtained from form successful")
 
+	form := a.service.Form(data.SpreadSheetName, data.CSVLink, data.KoboToken, a.client)
+
+	withMedia, err := a.service.MediaXLS(data.Id, data.SpreadSheetName, data.CSVLink, data.KoboToken, a.client, records, form, a.isDryRun(data))
+	if err != nil {
+		a.writeMediaError(data, err)
+		return
+	}
+	defer withMedia.CloseNew(records)
+	records = withMedia
+
+	if a.isDryRun(data) {
+		a.dryRunXLS(data, records, form)
+		return
+	}
+
+	types := a.service.ColumnTypes(data.SpreadSheetName, data.CSVLink, data.KoboToken, a.client)
+
 	importStartTime := time.Now()
 	for i := 0; i < 3; i++ {
-		err = a.service.ImporterXLS(data.APIKey, data.SpreadSheetID, records)
-		if err == nil {
+		err = a.service.ImporterXLS(data.Id, data.APIKey, data.SpreadSheetName, data.SpreadSheetID, records, types, form)
+		if err == nil || errors.Is(err, service.ErrBlocked) || errors.Is(err, service.ErrUnchanged) {
 			break
 		}
 		logrus.WithFields(logrus.Fields{"form_name": data.FormName, "spreadsheet_name": data.SpreadSheetName, "form_id": data.Id, "error": err}).Errorf("attempt %d failed: Error while importing", i+1)
 		time.Sleep(5 * time.Second)
 	}
+	if errors.Is(err, service.ErrBlocked) {
+		a.writeBlocked(data, err)
+		return
+	}
+	if errors.Is(err, service.ErrUnchanged) {
+		a.writeUnchanged(data)
+		return
+	}
 	if err != nil {
 		logrus.WithFields(logrus.Fields{"form_name": data.FormName, "spreadsheet_name": data.SpreadSheetName, "form_id": data.Id, "error": err}).Error("Error while importing")
 		if err := a.repo.WriteInfo(data.Id, fmt.Sprintf("ERROR; %s; %s", GetTime(), fmt.Sprintf("GoogleSheets: %s", err))); err != nil {
@@ -198,6 +315,41 @@ func (a *App) processXLS(data models.Data) {
 	}
 }
 
+func (a *App) writeBlocked(data models.Data, err error) {
+	logrus.WithFields(logrus.Fields{"form_name": data.FormName, "spreadsheet_name": data.SpreadSheetName, "form_id": data.Id, "error": err}).Warn("Import blocked, add -allow-shrink to the spreadsheet name to allow it")
+	if err := a.repo.WriteInfo(data.Id, fmt.Sprintf("BLOCKED; %s; %s", GetTime(), err)); err != nil {
+		logrus.WithFields(logrus.Fields{"form_id": data.Id, "error": err}).Error("error while updating db")
+	}
+}
+
+// writeBackValidation sends validation decisions from the sheet before the export,
+// so the export already has them. Errors do not stop the import.
+func (a *App) writeBackValidation(data models.Data) {
+	err := a.service.WriteBackValidation(data.Id, data.APIKey, data.SpreadSheetName, data.SpreadSheetID, data.SheetName, data.CSVLink, data.KoboToken, a.client, a.isDryRun(data))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id, "error": err}).Error("error while writing validation statuses back to Kobo")
+	}
+}
+
+func (a *App) writeMediaError(data models.Data, err error) {
+	logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id, "error": err}).Error("error while storing attachments")
+	if err := a.repo.WriteInfo(data.Id, fmt.Sprintf("ERROR; %s; %s", GetTime(), fmt.Sprintf("Media: %s", err))); err != nil {
+		logrus.WithFields(logrus.Fields{"form_id": data.Id, "error": err}).Error("error while updating db")
+	}
+}
+
+func (a *App) writeUnchanged(data models.Data) {
+	logrus.WithFields(logrus.Fields{"form_name": data.FormName, "spreadsheet_name": data.SpreadSheetName, "form_id": data.Id}).Info("No changes since the last import, skipped")
+	if err := a.repo.WriteInfo(data.Id, fmt.Sprintf("Ok (unchanged); %s", GetTime())); err != nil {
+		logrus.WithFields(logrus.Fields{"form_id": data.Id, "error": err}).Error("error while updating db")
+	}
+}
+
+// isJSONLink checks for the Kobo data API link like …/data/?format=json or …/data.json.
+func isJSONLink(link string) bool {
+	return strings.HasSuffix(link, ".json") || strings.Contains(link, "format=json")
+}
+
 func GetTime() string {
 	loc, err := time.LoadLocation("Europe/Kyiv")
 	if err != nil {
@@ -0,0 +1,193 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/app/service"
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// DiscoverRequest describes assets of a Kobo token to list and jobs to add for them.
+type DiscoverRequest struct {
+	// Server is the Kobo host, the first of config.KoboServers if empty.
+	Server string
+	Token  string
+	// All lists surveys which are not deployed too.
+	All bool
+	// UIDs are assets to add jobs for, assets are only listed if there are none.
+	UIDs []string
+	// Format of the export link: csv or xls.
+	Format        string
+	UserID        int
+	SpreadSheetID string
+	// SheetName is the range of the jobs, "{name}" is replaced by the asset name.
+	SheetName string
+	// Options are added after the asset name in the spreadsheet name.
+	Options string
+}
+
+// defaultKoboServer returns the server of the request or the first allowed one.
+func defaultKoboServer(server string) (string, error) {
+	if server != "" {
+		return server, nil
+	}
+	if len(config.KoboServers) == 0 {
+		return "", fmt.Errorf("kobo server is not set")
+	}
+	return config.KoboServers[0], nil
+}
+
+// listedKoboServer checks the server against config.KoboServers, none is listed if they are empty.
+func listedKoboServer(server string) bool {
+	host := server
+	if _, after, found := strings.Cut(host, "://"); found {
+		host = after
+	}
+	host = strings.TrimRight(host, "/")
+	for _, listed := range config.KoboServers {
+		if strings.EqualFold(host, listed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Discover prints assets of the token with their export settings and adds jobs
+// for the assets of the request. Export settings are created when the asset has none
+// of the format, assets which already have a job with the link are skipped.
+// Jobs are added disabled, so they run only after someone enables them.
+func (a *App) Discover(r DiscoverRequest) error {
+	server, err := defaultKoboServer(r.Server)
+	if err != nil {
+		return err
+	}
+	assets, err := a.service.DiscoverAssets(server, r.Token, r.All, a.client)
+	if err != nil {
+		return err
+	}
+	printAssets(assets)
+	if len(r.UIDs) == 0 {
+		return nil
+	}
+	if r.SpreadSheetID == "" || r.SheetName == "" || r.UserID == 0 {
+		return fmt.Errorf("user, spreadsheet and sheet are required to add jobs")
+	}
+	// Рядок без користувача ламає GetAllData для всіх завдань
+	exists, err := a.repo.UserExists(r.UserID)
+	if err != nil {
+		return fmt.Errorf("error while getting user from DB: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("user %d has no Google credentials", r.UserID)
+	}
+
+	byUID := make(map[string]models.KoboAsset, len(assets))
+	for _, asset := range assets {
+		byUID[asset.UID] = asset
+	}
+	for _, uid := range r.UIDs {
+		asset, ok := byUID[uid]
+		if !ok {
+			return fmt.Errorf("asset %s not found", uid)
+		}
+		if err := a.addJob(server, asset, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *App) addJob(server string, asset models.KoboAsset, r DiscoverRequest) error {
+	link, ok := service.ExportLink(asset.ExportSettings, r.Format)
+	if !ok {
+		setting, err := a.service.CreateExportSetting(server, asset.UID, r.Token, r.Format, a.client)
+		if err != nil {
+			return err
+		}
+		if link, ok = service.ExportLink([]models.ExportSetting{setting}, r.Format); !ok {
+			return fmt.Errorf("created export setting of %s has no %s link", asset.UID, r.Format)
+		}
+	}
+
+	ids, err := a.repo.GetIDsByLink(link)
+	if err != nil {
+		return fmt.Errorf("error while getting forms from DB: %w", err)
+	}
+	if len(ids) > 0 {
+		logrus.WithFields(logrus.Fields{"asset": asset.UID, "csv_link": link, "form_ids": ids}).Warn("Job with the link exists, skipped")
+		return nil
+	}
+
+	data := models.Data{
+		UserId:          r.UserID,
+		Status:          0,
+		KoboToken:       r.Token,
+		CSVLink:         link,
+		FormName:        asset.Name,
+		SpreadSheetID:   r.SpreadSheetID,
+		SpreadSheetName: strings.TrimSpace(asset.Name + " " + r.Options),
+		SheetName:       strings.ReplaceAll(r.SheetName, "{name}", asset.Name),
+	}
+	id, err := a.repo.AddData(data)
+	if err != nil {
+		return fmt.Errorf("error while adding form to DB: %w", err)
+	}
+	logrus.WithFields(logrus.Fields{"form_id": id, "asset": asset.UID, "csv_link": link, "sheet_name": data.SheetName}).Info("Job is added disabled, set status to 1 to run it")
+	return nil
+}
+
+func printAssets(assets []models.KoboAsset) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "UID\tNAME\tDEPLOYED\tSUBMISSIONS\tEXPORT SETTINGS")
+	for _, asset := range assets {
+		settings := make([]string, 0, len(asset.ExportSettings))
+		for _, s := range asset.ExportSettings {
+			settings = append(settings, fmt.Sprintf("%s (%s %s)", s.Name, s.Type, s.UID))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%d\t%s\n", asset.UID, asset.Name, asset.Deployed, asset.Submissions, strings.Join(settings, ", "))
+	}
+	w.Flush()
+}
+
+// handleAssets lists assets of the token from the "Authorization: Token …" header as JSON.
+// The server is the server query parameter or the default one, only servers of
+// config.KoboServers are requested. all=true adds surveys which are not deployed.
+func (a *App) handleAssets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Token ")
+	if !ok || token == "" {
+		http.Error(w, "kobo token is required", http.StatusUnauthorized)
+		return
+	}
+	// Інакше запит з токеном піде на будь-яку адресу
+	if server := r.URL.Query().Get("server"); server != "" && !listedKoboServer(server) {
+		http.Error(w, "kobo server is not allowed", http.StatusForbidden)
+		return
+	}
+	server, err := defaultKoboServer(r.URL.Query().Get("server"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	assets, err := a.service.DiscoverAssets(server, token, r.URL.Query().Get("all") == "true", a.client)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"server": server, "error": err}).Error("error while listing assets")
+		http.Error(w, "cannot list assets", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(assets); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Error("error while writing assets")
+	}
+}
@@ -0,0 +1,211 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/app/service"
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// downloads shares Kobo exports between jobs of one iteration. Jobs with the same link,
+// token and CSV dialect get the same records, and a download in flight is waited for instead of repeated.
+// Uses of every key are counted before the iteration, and the records are released after
+// the last job with the key, so only shared exports are kept. Failed downloads are not kept,
+// so a retry downloads again.
+type downloads struct {
+	mu    sync.Mutex
+	calls map[downloadKey]*download
+	// uses are jobs of the iteration which have not finished with the key yet
+	uses map[downloadKey]int
+	// exports are files of exports created on demand, a failed download is retried
+	// from the same export
+	exports map[downloadKey]string
+}
+
+type downloadKey struct {
+	link    string
+	token   string
+	dialect service.CSVDialect
+	sheet   string
+	// task are parameters of an export created on demand
+	task string
+}
+
+type download struct {
+	done     chan struct{}
+	records  *service.Records
+	workbook service.Workbook
+	err      error
+}
+
+func newDownloads() *downloads {
+	return &downloads{calls: make(map[downloadKey]*download), uses: make(map[downloadKey]int), exports: make(map[downloadKey]string)}
+}
+
+// expect counts one more job of the iteration with the key.
+func (d *downloads) expect(key downloadKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.uses[key]++
+}
+
+// do returns the download by the key, fetch fills it if there is none yet.
+func (d *downloads) do(key downloadKey, fetch func(dl *download)) *download {
+	d.mu.Lock()
+	if dl, ok := d.calls[key]; ok {
+		d.mu.Unlock()
+		<-dl.done
+		logrus.WithFields(logrus.Fields{"csv_link": key.link}).Info("Export is shared with another job")
+		return dl
+	}
+	// Помилка лишається, якщо fetch панікує, тоді очікувачі не отримають порожніх записів
+	dl := &download{done: make(chan struct{}), err: fmt.Errorf("download of %s is not finished", key.link)}
+	d.calls[key] = dl
+	d.mu.Unlock()
+
+	defer close(dl.done)
+	defer func() {
+		if dl.err != nil {
+			d.mu.Lock()
+			delete(d.calls, key)
+			d.mu.Unlock()
+		}
+	}()
+	fetch(dl)
+	return dl
+}
+
+// release is called when a job has finished with the key, records are closed
+// after the last expected job.
+func (d *downloads) release(key downloadKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.uses[key]--
+	if d.uses[key] > 0 {
+		return
+	}
+	delete(d.uses, key)
+	delete(d.exports, key)
+	if dl, ok := d.calls[key]; ok {
+		delete(d.calls, key)
+		closeDownload(key, dl)
+	}
+}
+
+// reset releases records of the finished iteration.
+func (d *downloads) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, dl := range d.calls {
+		closeDownload(key, dl)
+	}
+	d.calls = make(map[downloadKey]*download)
+	d.uses = make(map[downloadKey]int)
+	d.exports = make(map[downloadKey]string)
+}
+
+func closeDownload(key downloadKey, dl *download) {
+	if dl.workbook != nil {
+		dl.workbook.Close()
+	}
+	if dl.records == nil {
+		return
+	}
+	if err := dl.records.Close(); err != nil {
+		logrus.WithFields(logrus.Fields{"csv_link": key.link, "error": err}).Error("error while removing spool file")
+	}
+}
+
+// expectDownloads counts download keys of the jobs before they are processed.
+func (a *App) expectDownloads(data []models.Data) {
+	for _, d := range data {
+		if key, ok := a.downloadKey(d); ok {
+			a.downloads.expect(key)
+		}
+	}
+}
+
+// downloadKey returns the key of the export the job is processed with, like process does.
+func (a *App) downloadKey(data models.Data) (downloadKey, bool) {
+	switch exportKind(data) {
+	case kindCSV:
+		return csvKey(data), true
+	case kindXLS:
+		return xlsKey(data), true
+	}
+	return downloadKey{}, false
+}
+
+func csvKey(data models.Data) downloadKey {
+	return downloadKey{link: data.CSVLink, token: data.KoboToken, dialect: service.GetCSVDialect(data.SpreadSheetName), task: service.ExportTaskKey(data.Id)}
+}
+
+func xlsKey(data models.Data) downloadKey {
+	key := downloadKey{link: data.CSVLink, token: data.KoboToken, task: service.ExportTaskKey(data.Id)}
+	if key.task == "" && isJSONLink(data.CSVLink) {
+		// Назва основного аркуша і фільтр за статусом залежать від завдання
+		key.link = service.ValidationLink(data.SpreadSheetName, data.CSVLink)
+		key.sheet = data.SheetName
+	}
+	return key
+}
+
+func (a *App) export(data models.Data) (*service.Records, error) {
+	key := csvKey(data)
+	dl := a.downloads.do(key, func(dl *download) {
+		link, err := a.exportLink(data, key)
+		if err != nil {
+			dl.err = err
+			return
+		}
+		dl.records, dl.err = a.service.Export(link, data.KoboToken, key.dialect, a.client)
+	})
+	return dl.records, dl.err
+}
+
+func (a *App) exportXLS(data models.Data) (service.Workbook, error) {
+	key := xlsKey(data)
+	dl := a.downloads.do(key, func(dl *download) {
+		if key.task == "" && isJSONLink(data.CSVLink) {
+			dl.workbook, dl.err = a.service.ExportJSON(data.Id, key.link, data.KoboToken, data.SheetName, a.client)
+			return
+		}
+		link, err := a.exportLink(data, key)
+		if err != nil {
+			dl.err = err
+			return
+		}
+		dl.workbook, dl.err = a.service.ExportXLS(link, data.KoboToken, a.client)
+	})
+	return dl.workbook, dl.err
+}
+
+// errCreateExport marks errors of exports created on demand, they are not retried
+// because CreateExport already waits for the export.
+var errCreateExport = errors.New("error while creating export")
+
+// exportLink returns the link to download: the job link, or the file of an export
+// created on demand when the job has an export task. The export is created once per
+// iteration, retries download the same file.
+func (a *App) exportLink(data models.Data, key downloadKey) (string, error) {
+	if key.task == "" {
+		return data.CSVLink, nil
+	}
+	a.downloads.mu.Lock()
+	link, ok := a.downloads.exports[key]
+	a.downloads.mu.Unlock()
+	if ok {
+		return link, nil
+	}
+	link, err := a.service.CreateExport(data.Id, data.CSVLink, data.KoboToken, a.client)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errCreateExport, err)
+	}
+	a.downloads.mu.Lock()
+	a.downloads.exports[key] = link
+	a.downloads.mu.Unlock()
+	return link, nil
+}
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/app/service"
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// DryRun processes the form with the given id, or every active form if id is 0,
+// and prints what would change in the sheets. Neither sheets nor DB are written.
+func (a *App) DryRun(id int) error {
+	a.dryRun = true
+
+	var data []models.Data
+	if id != 0 {
+		d, err := a.repo.GetDataByID(id)
+		if err != nil {
+			return fmt.Errorf("error while getting form from DB: %w", err)
+		}
+		data = append(data, d)
+	} else {
+		all, err := a.repo.GetAllData()
+		if err != nil {
+			return fmt.Errorf("error while getting data from DB: %w", err)
+		}
+		data = all
+	}
+
+	a.expectDownloads(data)
+	for _, d := range data {
+		a.process(d)
+	}
+	a.downloads.reset()
+	return nil
+}
+
+func (a *App) isDryRun(data models.Data) bool {
+	return a.dryRun || strings.Contains(data.SpreadSheetName, " -dry-run")
+}
+
+func (a *App) dryRunCSV(data models.Data, records *service.Records, form *models.Form) {
+	diff, err := a.service.DryRun(data.Id, data.APIKey, data.SpreadSheetName, data.SpreadSheetID, data.SheetName, records, form)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id, "error": err}).Error("error while making dry run")
+		return
+	}
+	printDiff(data, diff)
+	a.writeDryRun(data, []models.SheetDiff{diff})
+}
+
+func (a *App) dryRunXLS(data models.Data, records service.Workbook, form *models.Form) {
+	diffs, err := a.service.DryRunXLS(data.Id, data.APIKey, data.SpreadSheetName, data.SpreadSheetID, records, form)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id, "error": err}).Error("error while making dry run")
+		return
+	}
+	for _, diff := range diffs {
+		printDiff(data, diff)
+	}
+	a.writeDryRun(data, diffs)
+}
+
+// writeDryRun records the result of a " -dry-run" job, so its period is respected.
+// Nothing is recorded in the dry-run mode of the whole app.
+func (a *App) writeDryRun(data models.Data, diffs []models.SheetDiff) {
+	if a.dryRun {
+		return
+	}
+	var added, changed, removed int
+	for _, diff := range diffs {
+		added += len(diff.Added)
+		changed += len(diff.Changed)
+		removed += len(diff.Removed)
+	}
+	if err := a.repo.WriteInfo(data.Id, fmt.Sprintf("DRY-RUN; %s; +%d ~%d -%d", GetTime(), added, changed, removed)); err != nil {
+		logrus.WithFields(logrus.Fields{"form_id": data.Id, "error": err}).Error("error while updating db")
+	}
+}
+
+func printDiff(data models.Data, diff models.SheetDiff) {
+	fmt.Printf("=== form %d %q -> %s: %d added, %d changed, %d removed\n", data.Id, data.FormName, diff.Range, len(diff.Added), len(diff.Changed), len(diff.Removed))
+	for _, row := range diff.Added {
+		fmt.Printf("+ row %d:%s\n", row.Row, formatCells(row.Cells, false))
+	}
+	for _, row := range diff.Changed {
+		fmt.Printf("~ row %d:%s\n", row.Row, formatCells(row.Cells, true))
+	}
+	for _, row := range diff.Removed {
+		fmt.Printf("- row %d:%s\n", row.Row, formatCells(row.Cells, false))
+	}
+}
+
+func formatCells(cells []models.CellDiff, changed bool) string {
+	var b strings.Builder
+	for _, cell := range cells {
+		switch {
+		case changed:
+			fmt.Fprintf(&b, " %s: %q -> %q;", cell.Column, cell.Old, cell.New)
+		case cell.New != "":
+			fmt.Fprintf(&b, " %s=%q", cell.Column, cell.New)
+		default:
+			fmt.Fprintf(&b, " %s=%q", cell.Column, cell.Old)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ListSnapshots prints local snapshots of the job.
+func (a *App) ListSnapshots(id int) error {
+	names, err := a.repo.ListSnapshots(id)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		logrus.WithFields(logrus.Fields{"form_id": id}).Info("No snapshots")
+		return nil
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+// Restore writes the snapshot back to the job's spreadsheet. If name is empty,
+// all snapshots of the latest run are restored. With fromTab the latest hidden
+// backup tabs of the job are restored instead of local snapshots.
+func (a *App) Restore(id int, name string, fromTab bool) error {
+	data, err := a.repo.GetDataByID(id)
+	if err != nil {
+		return fmt.Errorf("error while getting form from DB: %w", err)
+	}
+
+	if fromTab {
+		return a.restoreTabs(data)
+	}
+
+	names := []string{name}
+	if name == "" {
+		all, err := a.repo.ListSnapshots(id)
+		if err != nil {
+			return err
+		}
+		if len(all) == 0 {
+			return fmt.Errorf("no snapshots for form %d", id)
+		}
+		names = latestRun(all)
+	}
+
+	for _, name := range names {
+		sheetRange, records, err := a.repo.LoadSnapshot(id, name)
+		if err != nil {
+			return fmt.Errorf("error while loading snapshot %s: %w", name, err)
+		}
+
+		if err := a.service.Restore(data.APIKey, data.SpreadSheetID, sheetRange, records); err != nil {
+			return fmt.Errorf("error while restoring %s: %w", name, err)
+		}
+
+		logrus.WithFields(logrus.Fields{"form_id": id, "snapshot": name, "range": sheetRange, "rows": len(records)}).Info("Snapshot restored")
+	}
+	return nil
+}
+
+// latestRun returns snapshots with the time of the latest one, names start with it:
+// "20060102-150405.000000_tab.csv.gz".
+func latestRun(names []string) []string {
+	taken, _, _ := strings.Cut(names[len(names)-1], "_")
+	var run []string
+	for _, name := range names {
+		if strings.HasPrefix(name, taken+"_") {
+			run = append(run, name)
+		}
+	}
+	return run
+}
+
+// restoreTabs restores backup tabs of the job range and of the tabs written from XLS sheets.
+func (a *App) restoreTabs(data models.Data) error {
+	state, err := a.repo.GetJobState(data.Id)
+	if err != nil {
+		return fmt.Errorf("error while reading job state: %w", err)
+	}
+	tab, _, _ := strings.Cut(data.SheetName, "!")
+	tabs := []string{strings.Trim(tab, "'")}
+	for sheetName, tabState := range state.Tabs {
+		if tabState.Target != "" {
+			sheetName = tabState.Target
+		}
+		if sheetName != tabs[0] {
+			tabs = append(tabs, sheetName)
+		}
+	}
+
+	restored, err := a.service.RestoreTabs(data.APIKey, data.SpreadSheetID, tabs)
+	for _, backup := range restored {
+		logrus.WithFields(logrus.Fields{"form_id": data.Id, "backup": backup}).Info("Backup tab restored")
+	}
+	return err
+}
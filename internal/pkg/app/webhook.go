@@ -0,0 +1,196 @@
+package app
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rostis232/kobo2googlesheet-db/config"
+	"github.com/rostis232/kobo2googlesheet-db/internal/app/service"
+	"github.com/rostis232/kobo2googlesheet-db/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	webhookModeRun    = "run"
+	webhookModeAppend = "append"
+
+	// maxSubmissionSize limits the body of a REST Service post.
+	maxSubmissionSize = 10 << 20
+	// webhookQueueSize is how many posts wait for the run loop.
+	webhookQueueSize = 1000
+)
+
+// webhookEvent is a job to run, or a submission to append when it is not nil.
+type webhookEvent struct {
+	id         int
+	submission []byte
+	queued     time.Time
+}
+
+// ServeAPI receives submissions from Kobo REST Services on webhookPath and lists assets
+// of a Kobo token on assetsPath, an empty path is not served. Posts are matched to active
+// jobs of the last iteration by the asset uid and the job secret, and handled by the run
+// loop between iterations.
+// Polling stays as it is.
+func (a *App) ServeAPI(listen string, webhookPath string, assetsPath string) error {
+	mux := http.NewServeMux()
+	if webhookPath != "" {
+		mux.HandleFunc(webhookPath, a.handleWebhook)
+	}
+	if assetsPath != "" {
+		mux.HandleFunc(assetsPath, a.handleAssets)
+	}
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logrus.WithFields(logrus.Fields{"listen": listen, "webhook_path": webhookPath, "assets_path": assetsPath}).Info("API server started")
+	return server.ListenAndServe()
+}
+
+func (a *App) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	submission, err := io.ReadAll(io.LimitReader(r.Body, maxSubmissionSize))
+	if err != nil {
+		http.Error(w, "cannot read body", http.StatusBadRequest)
+		return
+	}
+	uid, err := service.SubmissionAsset(submission)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, ok := a.cachedJobs()
+	if !ok {
+		http.Error(w, "jobs are not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+	// Невідомий актив і хибний секрет мають однакову відповідь, щоб не видавати uid завдань
+	events, known := webhookEvents(data, uid, webhookSecret(r), submission)
+	if len(events) == 0 {
+		if known {
+			logrus.WithFields(logrus.Fields{"asset": uid, "remote": r.RemoteAddr}).Warn("Webhook with a wrong secret")
+		} else {
+			logrus.WithFields(logrus.Fields{"asset": uid, "remote": r.RemoteAddr}).Warn("Webhook for an asset without jobs")
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Місце для всіх подій перевіряємо до запису, щоб повтор від Kobo не запускав завдання двічі.
+	// Черга лише звільняється циклом запуску, тож під замком місця не стане менше.
+	a.queueMu.Lock()
+	defer a.queueMu.Unlock()
+	if cap(a.events)-len(a.events) < len(events) {
+		logrus.WithFields(logrus.Fields{"asset": uid, "events": len(events)}).Warn("Webhook queue is full")
+		http.Error(w, "queue is full", http.StatusServiceUnavailable)
+		return
+	}
+	for _, event := range events {
+		a.events <- event
+		logrus.WithFields(logrus.Fields{"asset": uid, "form_id": event.id, "append": event.submission != nil}).Info("Webhook is queued")
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// setJobs keeps jobs of the iteration for webhook posts.
+func (a *App) setJobs(data []models.Data) {
+	a.jobsMu.Lock()
+	defer a.jobsMu.Unlock()
+	a.jobs, a.jobsLoaded = data, true
+}
+
+// cachedJobs returns jobs of the last iteration, false before the first one. The run loop
+// reads a job again before handling its event, so a job changed since then is not stale.
+func (a *App) cachedJobs() ([]models.Data, bool) {
+	a.jobsMu.RLock()
+	defer a.jobsMu.RUnlock()
+	return a.jobs, a.jobsLoaded
+}
+
+// webhookSecret returns the secret of the post from the header, basic auth or the query.
+func webhookSecret(r *http.Request) string {
+	if secret := r.Header.Get("X-Webhook-Secret"); secret != "" {
+		return secret
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return r.URL.Query().Get("secret")
+}
+
+// webhookEvents returns events for active jobs of the asset with the secret.
+// known is false when no job of the asset accepts webhooks.
+func webhookEvents(data []models.Data, uid string, secret string, submission []byte) (events []webhookEvent, known bool) {
+	for _, d := range data {
+		cfg := config.Jobs[d.Id].Webhook
+		if d.Status == 0 || cfg == nil || cfg.Secret == "" || service.AssetUID(d.CSVLink) != uid {
+			continue
+		}
+		known = true
+		if subtle.ConstantTimeCompare([]byte(cfg.Secret), []byte(secret)) != 1 {
+			continue
+		}
+		event := webhookEvent{id: d.Id, queued: time.Now()}
+		if cfg.Mode == webhookModeAppend {
+			event.submission = submission
+		}
+		events = append(events, event)
+	}
+	return events, known
+}
+
+// wait sleeps until the next iteration, handling webhook events meanwhile.
+// A job is not run again for events queued before its last run started.
+func (a *App) wait(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	started := make(map[int]time.Time)
+	for {
+		select {
+		case <-timer.C:
+			return
+		case event := <-a.events:
+			if event.queued.Before(started[event.id]) {
+				continue
+			}
+			a.handleEvent(event, started)
+		}
+	}
+}
+
+func (a *App) handleEvent(event webhookEvent, started map[int]time.Time) {
+	data, err := a.repo.GetDataByID(event.id)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"form_id": event.id, "error": err}).Error("error while getting data from DB")
+		return
+	}
+	if data.Status == 0 {
+		return
+	}
+
+	// Рядок додається лише для CSV, інші експорти мають кілька вкладок
+	if event.submission != nil && exportKind(data) == kindCSV {
+		if a.isDryRun(data) {
+			logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id}).Info("Dry run: submission is not appended, the job is run")
+		} else if err := a.service.AppendSubmission(data.Id, data.APIKey, data.SpreadSheetName, data.SpreadSheetID, data.SheetName, event.submission); err == nil {
+			return
+		} else if errors.Is(err, service.ErrAppendUnsupported) {
+			logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id, "reason": err}).Info("Submission is not appended, the job is run")
+		} else {
+			logrus.WithFields(logrus.Fields{"form_name": data.FormName, "form_id": data.Id, "error": err}).Error("error while appending submission, the job is run")
+		}
+	}
+
+	started[data.Id] = time.Now()
+	a.process(data)
+	a.downloads.reset()
+}